@@ -0,0 +1,113 @@
+// Command apikey creates and revokes the api keys of the url shortener in the configured database.
+//
+// Usage:
+//
+//	apikey [-config path] -owner NAME [-scopes create,manage] create   prints a new api key of the owner
+//	apikey [-config path] -hash HASH revoke                            revokes the api key with the hash
+//	apikey [-config path] revoke < key                                 revokes the api key read from stdin
+//
+// The scopes are create, manage and admin. The key is printed once, only its hash is stored,
+// so it is logged on create and a lost key can still be revoked by it.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"os"
+	"strings"
+)
+
+const defaultConfigFilePath = "config/config.development.json"
+
+func main() {
+	os.Exit(run())
+}
+
+// run executes the command and returns its exit code, so that the database is closed before the exit.
+func run() int {
+	configFilePath := flag.String("config", defaultConfigFilePath, "path to the configuration file")
+	owner := flag.String("owner", "", "owner of the api key to create")
+	scopes := flag.String("scopes", model.ScopeCreate+","+model.ScopeManage,
+		"comma separated scopes of the api key to create")
+	keyHash := flag.String("hash", "", "hash of the api key to revoke, the key is read from stdin if it is empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] create|revoke\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (flag.Arg(0) != "create" && flag.Arg(0) != "revoke") {
+		flag.Usage()
+		return 2
+	}
+
+	// The key is read before connecting to the database, so that a missing key is reported as a usage error
+	if flag.Arg(0) == "revoke" && *keyHash == "" {
+		key, err := readKey()
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		*keyHash = urlshortener_service.HashApiKey(key)
+	}
+
+	configuration := util.ReadConfiguration(*configFilePath)
+	databasePersistence := storage.NewDatabasePersistence(configuration)
+	defer databasePersistence.Close()
+
+	apiKeyStore, supported := databasePersistence.(storage.ApiKeyStore)
+	if !supported {
+		log.Printf("The api keys are %v.\n", storage.ErrUnsupported)
+		return 1
+	}
+
+	switch flag.Arg(0) {
+	case "create":
+		key, apiKey, err := urlshortener_service.NewApiKey(*owner, strings.Split(*scopes, ","))
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		if err := apiKeyStore.SaveApiKey(context.Background(), apiKey); err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Created the api key with hash: %s.\n", apiKey.KeyHash)
+		fmt.Println(key)
+	case "revoke":
+		if err := apiKeyStore.DeleteApiKey(context.Background(), *keyHash); err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Revoked the api key with hash: %s.\n", *keyHash)
+	}
+
+	return 0
+}
+
+// readKey reads the api key from the first line of stdin, so that it does not show up in the shell history
+// or in the process list.
+func readKey() (string, error) {
+	scanner := bufio.NewScanner(os.Stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", errors.New("expected the api key to revoke on stdin or its hash in -hash")
+	}
+
+	key := strings.TrimSpace(scanner.Text())
+	if key == "" {
+		return "", errors.New("expected the api key to revoke on stdin or its hash in -hash")
+	}
+
+	return key, nil
+}
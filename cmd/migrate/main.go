@@ -0,0 +1,76 @@
+// Command migrate applies or reverts the schema migrations of the configured database.
+//
+// Usage:
+//
+//	migrate [-config path] up          applies all the pending migrations
+//	migrate [-config path] down [-steps N]  reverts the last N applied migrations, 1 by default
+//	migrate [-config path] version     prints the applied and the latest migration versions
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"os"
+)
+
+const defaultConfigFilePath = "config/config.development.json"
+
+func main() {
+	os.Exit(run())
+}
+
+// run executes the command and returns its exit code, so that the migrator is closed before the exit.
+func run() int {
+	configFilePath := flag.String("config", defaultConfigFilePath, "path to the configuration file")
+	steps := flag.Int("steps", 1, "number of migrations to revert with down")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] up|down|version\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return 2
+	}
+
+	configuration := util.ReadConfiguration(*configFilePath)
+	migrator, err := storage.NewMigrator(configuration)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer migrator.Close()
+
+	switch flag.Arg(0) {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Applied %d migrations.\n", applied)
+	case "down":
+		reverted, err := migrator.Down(*steps)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		log.Printf("Reverted %d migrations.\n", reverted)
+	case "version":
+		version, err := migrator.Version()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		fmt.Printf("Schema version: %d, latest: %d.\n", version, migrator.LatestVersion())
+	default:
+		flag.Usage()
+		return 2
+	}
+
+	return 0
+}
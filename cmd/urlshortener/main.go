@@ -1,28 +1,132 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"github.com/gdgenchev/urlshortener/internal/model"
 	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
 	"github.com/gdgenchev/urlshortener/internal/util"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const configFilePath = "config/config.development.json"
 
+const staticDirectory = "./web/static/"
+
+// shutdownTimeout is how long the requests in progress are waited for on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	configuration := util.ReadConfiguration(configFilePath)
 
 	urlShortenerService := urlshortener_service.NewUrlShortenerService(configuration)
 	defer urlShortenerService.ClosePersistenceManager()
 
+	expvar.Publish("storage", expvar.Func(func() interface{} {
+		return urlShortenerService.Stats()
+	}))
+
+	if configuration.Debug.Address != "" {
+		go serveDebug(configuration.Debug.Address)
+	}
+
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/api/create", urlShortenerService.HandleGenerateShortSlug).Methods("POST")
+	router.HandleFunc("/api/create",
+		urlShortenerService.WithScope(model.ScopeCreate, urlShortenerService.HandleGenerateShortSlug)).Methods("POST")
+	router.HandleFunc("/api/links:batch",
+		urlShortenerService.WithScope(model.ScopeCreate, urlShortenerService.HandleCreateLinksBatch)).Methods("POST")
+	router.HandleFunc("/api/links",
+		urlShortenerService.WithScope(model.ScopeManage, urlShortenerService.HandleListLinks)).Methods("GET")
+	router.HandleFunc("/api/links/{short-slug}",
+		urlShortenerService.WithScope(model.ScopeManage, urlShortenerService.HandleGetLink)).Methods("GET")
+	router.HandleFunc("/api/links/{short-slug}",
+		urlShortenerService.WithScope(model.ScopeManage, urlShortenerService.HandlePatchLink)).Methods("PATCH")
+	router.HandleFunc("/api/links/{short-slug}",
+		urlShortenerService.WithScope(model.ScopeManage, urlShortenerService.HandleDeleteLink)).Methods("DELETE")
+	router.HandleFunc("/api/admin/archive/{short-slug}",
+		urlShortenerService.WithScope(model.ScopeAdmin, urlShortenerService.HandleGetArchivedUrlData)).Methods("GET")
 	router.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "/web/static/favicon.ico")
 	})
 	router.HandleFunc("/{short-slug}", urlShortenerService.HandleRedirectToRealUrl).Methods("GET")
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/static/")))
+	router.PathPrefix("/").Handler(http.FileServer(http.Dir(staticDirectory)))
+
+	// The paths served next to the redirects cannot be used as short slugs
+	urlShortenerService.ReserveShortSlugs(routerShortSlugs(router)...)
+	urlShortenerService.ReserveShortSlugs(staticShortSlugs(staticDirectory)...)
+
+	server := &http.Server{Addr: ":8080", Handler: router}
+	go shutdownOnSignal(server)
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// routerShortSlugs returns the first segments of the router paths which could be taken for a short slug.
+func routerShortSlugs(router *mux.Router) []string {
+	var shortSlugs []string
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		pathTemplate, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+
+		firstSegment := strings.SplitN(strings.TrimPrefix(pathTemplate, "/"), "/", 2)[0]
+		if firstSegment != "" && !strings.HasPrefix(firstSegment, "{") {
+			shortSlugs = append(shortSlugs, firstSegment)
+		}
+		return nil
+	})
+
+	return shortSlugs
+}
+
+// staticShortSlugs returns the names of the files and directories served from the static directory.
+func staticShortSlugs(directory string) []string {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		log.Printf("Error in staticShortSlugs() - ioutil.ReadDir(): %v.\n", err)
+		return nil
+	}
+
+	shortSlugs := make([]string, 0, len(files))
+	for _, file := range files {
+		shortSlugs = append(shortSlugs, file.Name())
+	}
+
+	return shortSlugs
+}
+
+// shutdownOnSignal stops the server gracefully on SIGINT or SIGTERM,
+// so that main returns and closes the persistence, stopping its background work.
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error in shutdownOnSignal(): %v.\n", err)
+	}
+}
+
+// serveDebug serves the monitoring values on an address of its own, apart from the public router.
+func serveDebug(address string) {
+	debugRouter := http.NewServeMux()
+	debugRouter.Handle("/debug/vars", expvar.Handler())
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	if err := http.ListenAndServe(address, debugRouter); err != nil {
+		log.Printf("Error in serveDebug(): %v.\n", err)
+	}
 }
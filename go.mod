@@ -3,9 +3,12 @@ module github.com/gdgenchev/urlshortener
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.11.4
 	github.com/go-mysql/errors v0.0.0-20180603193453-03314bea68e0
 	github.com/go-redis/redis/v8 v8.0.0-beta.3
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/gorilla/mux v1.7.4
 	github.com/jinzhu/gorm v1.9.13
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v2.0.1+incompatible
 )
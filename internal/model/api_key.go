@@ -0,0 +1,35 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// The scopes of an api key. ScopeCreate allows creating short urls, ScopeManage allows reading, changing
+// and deleting the short urls of the owner and ScopeAdmin allows everything, for the short urls of anyone.
+const (
+	ScopeCreate = "create"
+	ScopeManage = "manage"
+	ScopeAdmin  = "admin"
+)
+
+// ApiKey denotes a key which authorizes the requests of its owner.
+// Only the hash of the key is stored, the key itself is shown once, when it is created.
+// Scopes is a comma separated list of the scopes of the key.
+type ApiKey struct {
+	KeyHash   string    `json:"-" gorm:"column:key_hash; type:varchar(64); primary_key"`
+	Owner     string    `json:"owner" gorm:"column:owner; type:varchar(64)"`
+	Scopes    string    `json:"scopes" gorm:"column:scopes; type:varchar(255)"`
+	CreatedAt time.Time `json:"created-at" gorm:"column:created_at"`
+}
+
+// HasScope reports whether the api key has the scope. The admin scope includes all the others.
+func (apiKey ApiKey) HasScope(scope string) bool {
+	for _, keyScope := range strings.Split(apiKey.Scopes, ",") {
+		if keyScope != "" && (keyScope == scope || keyScope == ScopeAdmin) {
+			return true
+		}
+	}
+
+	return false
+}
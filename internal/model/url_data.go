@@ -2,22 +2,103 @@
 package model
 
 import (
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"net/url"
 	"strings"
 	"time"
 )
 
 // CustomTime denotes the expiration time in format dd/mm/yyyy hh:mm
 type CustomTime struct {
-	time.Time `gorm:"column:expires; type:datetime"`
+	time.Time `gorm:"column:expires"`
 }
 
 // UrlData denotes the url data that is sent by the user.
+// Owner is the owner of the api key which has created it, empty for an anonymous one.
+// Host is the lower case host of the real url, kept in its own column for filtering, see UrlHost.
 type UrlData struct {
 	ShortSlug string     `json:"short-slug" gorm:"column:short_slug; type:varchar(50); primary_key"`
 	RealUrl   string     `json:"real-url" gorm:"column:real_url; type:text"`
 	Expires   CustomTime `json:"expires" gorm:"embedded"`
+	Owner     string     `json:"owner" gorm:"column:owner; type:varchar(64)"`
+	Tags      Tags       `json:"tags" gorm:"column:tags; type:varchar(255)"`
+	Host      string     `json:"-" gorm:"column:host; type:varchar(255)"`
+	CreatedAt time.Time  `json:"created-at" gorm:"column:created_at"`
+}
+
+// Tags are the labels of an url data. They are stored in a single column, with a comma at both ends,
+// so that a single tag is matched with LIKE '%,tag,%'.
+type Tags []string
+
+// Value returns the column value of the tags.
+func (tags Tags) Value() (driver.Value, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+
+	return "," + strings.Join(tags, ",") + ",", nil
+}
+
+// Scan reads the tags from their column value.
+func (tags *Tags) Scan(value interface{}) error {
+	var column string
+	switch value := value.(type) {
+	case nil:
+	case string:
+		column = value
+	case []byte:
+		column = string(value)
+	default:
+		return fmt.Errorf("cannot scan %T into tags", value)
+	}
+
+	*tags = nil
+	for _, tag := range strings.Split(column, ",") {
+		if tag != "" {
+			*tags = append(*tags, tag)
+		}
+	}
+
+	return nil
+}
+
+// HasTag reports whether the tag is one of the tags.
+func (tags Tags) HasTag(tag string) bool {
+	for _, existing := range tags {
+		if existing == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UrlHost returns the lower case host of the url without the port, or an empty string if it has none.
+func UrlHost(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(parsedUrl.Hostname())
+}
+
+// ArchivedUrlData denotes an expired url data which is kept for the history of its short slug.
+type ArchivedUrlData struct {
+	ID         uint       `json:"-" gorm:"primary_key"`
+	ShortSlug  string     `json:"short-slug" gorm:"column:short_slug; type:varchar(50); index"`
+	RealUrl    string     `json:"real-url" gorm:"column:real_url; type:text"`
+	Expires    CustomTime `json:"expires" gorm:"embedded"`
+	ArchivedAt time.Time  `json:"archived-at" gorm:"column:archived_at"`
+}
+
+// NewArchivedUrlData creates the archived copy of the url data.
+func NewArchivedUrlData(urlData UrlData, archivedAt time.Time) ArchivedUrlData {
+	return ArchivedUrlData{ShortSlug: urlData.ShortSlug, RealUrl: urlData.RealUrl, Expires: urlData.Expires,
+		ArchivedAt: archivedAt}
 }
 
 // UnmarshalJSON overrides the base method to handle dd/mm/yyyy hh:mm
@@ -2,92 +2,314 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"github.com/gdgenchev/urlshortener/internal/model"
 	"github.com/gdgenchev/urlshortener/internal/util"
 	"github.com/go-redis/redis/v8"
-	"log"
+	"io/ioutil"
 	"strconv"
+	"sync"
+	"time"
 )
 
-// TODO: Think whether it is really needed to fallback to a database, as the redis client takes too long
-//  to realize that the redis server is down, which results in a very low performance.
-//  I think the best decision for now is just to assume that the Redis cache server won't be down
-//  or if it is down, we might have a switchover to another cache server?
-//  This is overengineering at this point.
+// Redis deployment modes, used in Configuration.Redis.Mode. An empty value falls back to a standalone server.
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// The redis client takes too long to realize that the redis server is down, which results in a very low
+// performance if every request waits for it. Configure CacheCircuitBreaker, so that the PersistenceManager
+// stops calling a dead cache and falls back to a database only persistence until it recovers.
+
+func init() {
+	RegisterCachePersistence(RedisBackend, func(configuration util.Configuration) CachePersistence {
+		return NewRedisCachePersistence(configuration)
+	})
+}
 
 // CachePersistence provides a util interface for short term in memory url data persistence.
+// Every method returns ErrUnavailable if the cache cannot be reached, so that the callers can fall back to the database.
 type CachePersistence interface {
-	SaveUrlData(urlData model.UrlData)
-	GetRealUrl(shortSlug string) (string, bool)
-	Exists(shortSlug string) bool
-	Close()
+	// SaveUrlData caches the url data and forgets that its short slug is unknown.
+	SaveUrlData(ctx context.Context, urlData model.UrlData) error
+	// SaveUrlDataBatch saves several url data at once, as SaveUrlData does.
+	SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData) error
+	// SaveUnknownSlug remembers until expires that the short slug does not exist.
+	SaveUnknownSlug(ctx context.Context, shortSlug string, expires time.Time) error
+	// GetUrlData returns ErrNotFound on a cache miss and ErrUnknownSlug if the short slug is known not to exist.
+	GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error)
+	// Exists reports whether the url data of the short slug is cached.
+	Exists(ctx context.Context, shortSlug string) (bool, error)
+	// DeleteUrlData removes the url data and the unknown entry of a changed short slug,
+	// so that it is read from the database again.
+	DeleteUrlData(ctx context.Context, shortSlug string) error
+	// Close releases the connections of the cache.
+	Close() error
+}
+
+// deletionNotifier is implemented by the caches which tell about every DeleteUrlData, including the ones made
+// by the other instances sharing the cache, so that the copies of the url data kept in process memory are dropped.
+type deletionNotifier interface {
+	OnDeleteUrlData(handler func(shortSlug string))
+}
+
+// onDeleteUrlData registers the handler if the cache tells about the deleted url data.
+func onDeleteUrlData(cachePersistence CachePersistence, handler func(shortSlug string)) {
+	if deletionNotifier, ok := cachePersistence.(deletionNotifier); ok {
+		deletionNotifier.OnDeleteUrlData(handler)
+	}
 }
 
 // RedisCachePersistence is a concrete implementation of CachePersistence
-// If the cache is not running, the methods should log errors but not stop the complete execution
+// If the cache is not running, the methods return ErrUnavailable instead of stopping the complete execution
 // because the application can fallback to a database only persistence.
+// It works with a standalone server, a Sentinel monitored master or a Cluster, depending on Configuration.Redis.Mode.
+// The deleted short slugs are published on deletedSlugsChannel, see OnDeleteUrlData.
 type RedisCachePersistence struct {
-	client *redis.Client
+	client           redis.UniversalClient
+	mutex            sync.Mutex
+	pubSub           *redis.PubSub
+	deletionHandlers []func(shortSlug string)
 }
 
+// deletedSlugsChannel is the channel on which the instances sharing the cache publish the deleted short slugs.
+const deletedSlugsChannel = "urlshortener:deleted"
+
 func NewRedisCachePersistence(configuration util.Configuration) *RedisCachePersistence {
-	redisCachePersistence := new(RedisCachePersistence)
+	client, err := newRedisClient(configuration)
+	if err != nil {
+		panic(err)
+	}
 
-	redisCachePersistence.client = redis.NewClient(&redis.Options{
-		Addr:     configuration.Redis.Host + ":" + strconv.Itoa(configuration.Redis.Port),
-		Password: configuration.Redis.Password,
-		DB:       configuration.Redis.DB,
-	})
+	redisCachePersistence := new(RedisCachePersistence)
+	redisCachePersistence.client = client
 
 	return redisCachePersistence
 }
 
-// SaveUrlData saves the url data in the cache.
-func (redisCachePersistence *RedisCachePersistence) SaveUrlData(urlData model.UrlData) {
+// newRedisClient creates the client for the configured Redis mode. The mode is chosen explicitly
+// instead of by the number of addresses, so that a cluster can be reached through a single seed address.
+func newRedisClient(configuration util.Configuration) (redis.UniversalClient, error) {
+	options := &redis.UniversalOptions{
+		Addrs:        configuration.Redis.Addrs,
+		DB:           configuration.Redis.DB,
+		Password:     configuration.Redis.Password,
+		PoolSize:     configuration.Redis.PoolSize,
+		DialTimeout:  time.Duration(configuration.Redis.DialTimeoutMillis) * time.Millisecond,
+		ReadTimeout:  time.Duration(configuration.Redis.ReadTimeoutMillis) * time.Millisecond,
+		WriteTimeout: time.Duration(configuration.Redis.WriteTimeoutMillis) * time.Millisecond,
+		MasterName:   configuration.Redis.MasterName,
+	}
+	if len(options.Addrs) == 0 {
+		options.Addrs = []string{configuration.Redis.Host + ":" + strconv.Itoa(configuration.Redis.Port)}
+	}
+
+	if configuration.Redis.TLS.Enabled {
+		tlsConfig, err := newRedisTLSConfig(configuration)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	switch configuration.Redis.Mode {
+	case "", RedisStandalone:
+		return redis.NewClient(options.Simple()), nil
+	case RedisSentinel:
+		if options.MasterName == "" {
+			return nil, errors.New("storage: redis sentinel mode requires Redis.MasterName")
+		}
+		return redis.NewFailoverClient(options.Failover()), nil
+	case RedisCluster:
+		return redis.NewClusterClient(options.Cluster()), nil
+	default:
+		return nil, errors.New("storage: unknown redis mode: " + configuration.Redis.Mode)
+	}
+}
+
+func newRedisTLSConfig(configuration util.Configuration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         configuration.Redis.TLS.ServerName,
+		InsecureSkipVerify: configuration.Redis.TLS.InsecureSkipVerify,
+	}
+
+	if configuration.Redis.TLS.CAFile != "" {
+		caCertificate, err := ioutil.ReadFile(configuration.Redis.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCertificate) {
+			return nil, errors.New("storage: no certificates found in Redis.TLS.CAFile")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// SaveUrlData saves the url data in the cache and removes the unknown short slug entry for it,
+// in a single transaction so that no instance sees both. Both keys are in the same cluster hash slot.
+func (redisCachePersistence *RedisCachePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
 	urlDataAsJson, err := json.Marshal(&urlData)
 	if err != nil {
-		log.Printf("Error in RedisCachePersistence.SaveUrlData(): %v.\n", err)
-		return
+		return err
+	}
+
+	_, err = redisCachePersistence.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, urlData.ShortSlug, urlDataAsJson, 0)
+		pipe.ExpireAt(ctx, urlData.ShortSlug, urlData.Expires.Time)
+		pipe.Del(ctx, unknownSlugKey(urlData.ShortSlug))
+		return nil
+	})
+	if err != nil {
+		return unavailable(err)
+	}
+
+	return nil
+}
+
+// SaveUrlDataBatch saves the url data in the cache with a single round trip per server.
+// The short slugs are spread over the cluster, so the batch is pipelined instead of a transaction.
+// The url data is saved before the unknown short slug entry is removed and GetUrlData prefers the url data,
+// so seeing both in the meantime is harmless.
+func (redisCachePersistence *RedisCachePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData) error {
+	_, err := redisCachePersistence.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, batchUrlData := range urlData {
+			urlDataAsJson, err := json.Marshal(&batchUrlData)
+			if err != nil {
+				return err
+			}
+
+			pipe.Set(ctx, batchUrlData.ShortSlug, urlDataAsJson, 0)
+			pipe.ExpireAt(ctx, batchUrlData.ShortSlug, batchUrlData.Expires.Time)
+			pipe.Del(ctx, unknownSlugKey(batchUrlData.ShortSlug))
+		}
+		return nil
+	})
+	if err != nil {
+		return unavailable(err)
+	}
+
+	return nil
+}
+
+// SaveUnknownSlug remembers that the short slug does not exist until expires.
+// The entry is kept under its own key, so that Exists does not report the short slug as taken.
+func (redisCachePersistence *RedisCachePersistence) SaveUnknownSlug(ctx context.Context, shortSlug string,
+	expires time.Time) error {
+	err := redisCachePersistence.client.Set(ctx, unknownSlugKey(shortSlug), "", time.Until(expires)).Err()
+	if err != nil {
+		return unavailable(err)
 	}
 
-	redisCachePersistence.client.Set(context.Background(), urlData.ShortSlug, urlDataAsJson, 0)
-	redisCachePersistence.client.ExpireAt(context.Background(), urlData.ShortSlug, urlData.Expires.Time)
+	return nil
 }
 
-// GetRealUrl retrieves the real url from the cache given a short slug.
-func (redisCachePersistence *RedisCachePersistence) GetRealUrl(shortSlug string) (string, bool) {
-	urlDataAsJson, err := redisCachePersistence.client.Get(context.Background(), shortSlug).Result()
+// GetUrlData retrieves the url data from the cache given a short slug.
+// Returns ErrNotFound on a cache miss and ErrUnknownSlug if the short slug is known not to exist.
+// Both keys are read with a single round trip.
+func (redisCachePersistence *RedisCachePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	values, err := redisCachePersistence.client.MGet(ctx, shortSlug, unknownSlugKey(shortSlug)).Result()
 	if err != nil {
-		log.Printf("Error in RedisCachePersistence.GetRealUrl(): %v.\n", err)
-		return "", false
+		return model.UrlData{}, unavailable(err)
+	}
+
+	urlDataAsJson, found := values[0].(string)
+	if !found {
+		if values[1] != nil {
+			return model.UrlData{}, ErrUnknownSlug
+		}
+		return model.UrlData{}, ErrNotFound
 	}
 
 	var urlData model.UrlData
 	err = json.Unmarshal([]byte(urlDataAsJson), &urlData)
 	if err != nil {
-		log.Printf("Error in RedisCachePersistence.GetRealUrl(): %v.\n", err)
-		return "", false
+		return model.UrlData{}, err
 	}
 
-	return urlData.RealUrl, true
+	return urlData, nil
 }
 
 // Exists checks whether the short slug is present in the cache.
-func (redisCachePersistence *RedisCachePersistence) Exists(shortSlug string) bool {
-	exists, err := redisCachePersistence.client.Exists(context.Background(), shortSlug).Result()
+func (redisCachePersistence *RedisCachePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	exists, err := redisCachePersistence.client.Exists(ctx, shortSlug).Result()
 	if err != nil {
-		log.Printf("Error in RedisCachePersistence.Exists(): %v.\n", err)
-		return false
+		return false, unavailable(err)
 	}
-	return exists == 1
+
+	return exists == 1, nil
 }
 
-// Close closes the cache client.
-func (redisCachePersistence *RedisCachePersistence) Close() {
-	err := redisCachePersistence.client.Close()
+// DeleteUrlData removes the url data and the unknown short slug entry from the cache and publishes the short slug
+// to the instances sharing it. The keys are deleted before the short slug is published, so an instance dropping
+// its local copy on the message does not read the old url data from the cache again.
+func (redisCachePersistence *RedisCachePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	err := redisCachePersistence.client.Del(ctx, shortSlug, unknownSlugKey(shortSlug)).Err()
 	if err != nil {
-		log.Printf("Error in RedisCachePersistence.Close(): %v.\n", err)
+		return unavailable(err)
+	}
+
+	err = redisCachePersistence.client.Publish(ctx, deletedSlugsChannel, shortSlug).Err()
+	if err != nil {
+		return unavailable(err)
+	}
+
+	return nil
+}
+
+// OnDeleteUrlData calls the handler with every short slug published by DeleteUrlData of any instance,
+// until the cache is closed. The subscription is made with the first handler and is reconnected by the client
+// if the connection is lost.
+func (redisCachePersistence *RedisCachePersistence) OnDeleteUrlData(handler func(shortSlug string)) {
+	redisCachePersistence.mutex.Lock()
+	defer redisCachePersistence.mutex.Unlock()
+
+	redisCachePersistence.deletionHandlers = append(redisCachePersistence.deletionHandlers, handler)
+	if redisCachePersistence.pubSub != nil {
 		return
 	}
+
+	redisCachePersistence.pubSub = redisCachePersistence.client.Subscribe(context.Background(), deletedSlugsChannel)
+	go redisCachePersistence.notifyDeletions(redisCachePersistence.pubSub.Channel())
+}
+
+// notifyDeletions calls the handlers with the published short slugs until the subscription is closed.
+func (redisCachePersistence *RedisCachePersistence) notifyDeletions(messages <-chan *redis.Message) {
+	for message := range messages {
+		redisCachePersistence.mutex.Lock()
+		deletionHandlers := redisCachePersistence.deletionHandlers
+		redisCachePersistence.mutex.Unlock()
+
+		for _, handler := range deletionHandlers {
+			handler(message.Payload)
+		}
+	}
+}
+
+// Close stops the subscription for the deleted short slugs and closes the cache client.
+func (redisCachePersistence *RedisCachePersistence) Close() error {
+	redisCachePersistence.mutex.Lock()
+	pubSub := redisCachePersistence.pubSub
+	redisCachePersistence.pubSub = nil
+	redisCachePersistence.mutex.Unlock()
+	if pubSub != nil {
+		pubSub.Close()
+	}
+
+	return redisCachePersistence.client.Close()
+}
+
+// unknownSlugKey returns the key of the unknown short slug entry.
+// The short slug is a hash tag, so that the key is in the same cluster hash slot as the url data key
+// and both can be used in a single MGET or transaction.
+func unknownSlugKey(shortSlug string) string {
+	return "unknown:{" + shortSlug + "}"
 }
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the cache while the circuit breaker is open.
+// It wraps ErrUnavailable, so the callers fall back to the database as for any other cache outage.
+var ErrCircuitOpen = fmt.Errorf("%w: cache circuit breaker is open", ErrUnavailable)
+
+// CircuitBreakerState is the state of a CircuitBreakerCachePersistence.
+type CircuitBreakerState int
+
+const (
+	// CircuitClosed lets every call through to the cache.
+	CircuitClosed CircuitBreakerState = iota
+	// CircuitOpen fails every call with ErrCircuitOpen until the retry timeout passes.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe call through to find out whether the cache has recovered.
+	CircuitHalfOpen
+)
+
+func (circuitBreakerState CircuitBreakerState) String() string {
+	switch circuitBreakerState {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerCachePersistence is a CachePersistence decorator which stops calling a failing cache.
+// A slow or dead Redis server makes every call wait for the timeout, so after FailureThreshold consecutive
+// failures the circuit opens and the calls fail immediately. Once RetryMillis pass, the next call is let
+// through as a probe - if it succeeds the circuit closes, otherwise it opens again.
+// Only ErrUnavailable counts as a failure, a cache miss is a perfectly healthy answer.
+type CircuitBreakerCachePersistence struct {
+	cachePersistence    CachePersistence
+	failureThreshold    int
+	retryTimeout        time.Duration
+	mutex               sync.Mutex
+	state               CircuitBreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	trips               int
+}
+
+func NewCircuitBreakerCachePersistence(configuration util.Configuration,
+	cachePersistence CachePersistence) *CircuitBreakerCachePersistence {
+	circuitBreakerCachePersistence := new(CircuitBreakerCachePersistence)
+
+	circuitBreakerCachePersistence.cachePersistence = cachePersistence
+	circuitBreakerCachePersistence.failureThreshold = configuration.CacheCircuitBreaker.FailureThreshold
+	circuitBreakerCachePersistence.retryTimeout =
+		time.Duration(configuration.CacheCircuitBreaker.RetryMillis) * time.Millisecond
+
+	return circuitBreakerCachePersistence
+}
+
+// SaveUrlData saves the url data in the cache if the circuit lets the call through.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) SaveUrlData(ctx context.Context,
+	urlData model.UrlData) error {
+	if !circuitBreakerCachePersistence.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := circuitBreakerCachePersistence.cachePersistence.SaveUrlData(ctx, urlData)
+	circuitBreakerCachePersistence.record(ctx, err)
+
+	return err
+}
+
+// SaveUrlDataBatch saves the url data in the cache if the circuit lets the call through.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData) error {
+	if !circuitBreakerCachePersistence.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := circuitBreakerCachePersistence.cachePersistence.SaveUrlDataBatch(ctx, urlData)
+	circuitBreakerCachePersistence.record(ctx, err)
+
+	return err
+}
+
+// SaveUnknownSlug remembers the unknown short slug in the cache if the circuit lets the call through.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) SaveUnknownSlug(ctx context.Context,
+	shortSlug string, expires time.Time) error {
+	if !circuitBreakerCachePersistence.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := circuitBreakerCachePersistence.cachePersistence.SaveUnknownSlug(ctx, shortSlug, expires)
+	circuitBreakerCachePersistence.record(ctx, err)
+
+	return err
+}
+
+// GetUrlData retrieves the url data from the cache if the circuit lets the call through.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) GetUrlData(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	if !circuitBreakerCachePersistence.allow() {
+		return model.UrlData{}, ErrCircuitOpen
+	}
+
+	urlData, err := circuitBreakerCachePersistence.cachePersistence.GetUrlData(ctx, shortSlug)
+	circuitBreakerCachePersistence.record(ctx, err)
+
+	return urlData, err
+}
+
+// Exists checks whether the short slug is present in the cache if the circuit lets the call through.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) Exists(ctx context.Context,
+	shortSlug string) (bool, error) {
+	if !circuitBreakerCachePersistence.allow() {
+		return false, ErrCircuitOpen
+	}
+
+	exists, err := circuitBreakerCachePersistence.cachePersistence.Exists(ctx, shortSlug)
+	circuitBreakerCachePersistence.record(ctx, err)
+
+	return exists, err
+}
+
+// DeleteUrlData removes the url data from the cache. It is tried even while the circuit is open,
+// as an url data left in the cache would be served again with its old real url once the cache recovers.
+// Its result is recorded only while the circuit is closed, so that it neither closes the circuit
+// behind the probe nor keeps an open circuit from retrying.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) DeleteUrlData(ctx context.Context,
+	shortSlug string) error {
+	err := circuitBreakerCachePersistence.cachePersistence.DeleteUrlData(ctx, shortSlug)
+
+	circuitBreakerCachePersistence.mutex.Lock()
+	defer circuitBreakerCachePersistence.mutex.Unlock()
+	if circuitBreakerCachePersistence.state == CircuitClosed {
+		circuitBreakerCachePersistence.update(ctx, err)
+	}
+
+	return err
+}
+
+// OnDeleteUrlData registers the handler with the wrapped cache if it tells about the deleted url data.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) OnDeleteUrlData(
+	handler func(shortSlug string)) {
+	onDeleteUrlData(circuitBreakerCachePersistence.cachePersistence, handler)
+}
+
+// Close closes the wrapped cache.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) Close() error {
+	return circuitBreakerCachePersistence.cachePersistence.Close()
+}
+
+// State returns the current state of the circuit.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) State() CircuitBreakerState {
+	circuitBreakerCachePersistence.mutex.Lock()
+	defer circuitBreakerCachePersistence.mutex.Unlock()
+
+	return circuitBreakerCachePersistence.state
+}
+
+// Stats returns the state of the circuit, how many times it has opened and the stats of the wrapped cache.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) Stats() Stats {
+	circuitBreakerCachePersistence.mutex.Lock()
+	stats := Stats{
+		"cache.circuit_breaker.state":                circuitBreakerCachePersistence.state.String(),
+		"cache.circuit_breaker.trips":                circuitBreakerCachePersistence.trips,
+		"cache.circuit_breaker.consecutive_failures": circuitBreakerCachePersistence.consecutiveFailures,
+	}
+	circuitBreakerCachePersistence.mutex.Unlock()
+
+	return collectStats(stats, circuitBreakerCachePersistence.cachePersistence)
+}
+
+// allow reports whether a call may go to the cache and switches an open circuit to half-open
+// once the retry timeout has passed.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) allow() bool {
+	circuitBreakerCachePersistence.mutex.Lock()
+	defer circuitBreakerCachePersistence.mutex.Unlock()
+
+	switch circuitBreakerCachePersistence.state {
+	case CircuitOpen:
+		if time.Since(circuitBreakerCachePersistence.openedAt) < circuitBreakerCachePersistence.retryTimeout {
+			return false
+		}
+		circuitBreakerCachePersistence.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the circuit with the result of a call.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) record(ctx context.Context, err error) {
+	circuitBreakerCachePersistence.mutex.Lock()
+	defer circuitBreakerCachePersistence.mutex.Unlock()
+
+	circuitBreakerCachePersistence.update(ctx, err)
+}
+
+// update updates the circuit with the result of a call. The caller must hold the mutex.
+func (circuitBreakerCachePersistence *CircuitBreakerCachePersistence) update(ctx context.Context, err error) {
+	// The caller has given up, so the call tells nothing about the health of the cache
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if circuitBreakerCachePersistence.state == CircuitHalfOpen {
+			circuitBreakerCachePersistence.state = CircuitOpen
+		}
+		return
+	}
+
+	if !errors.Is(err, ErrUnavailable) {
+		if circuitBreakerCachePersistence.state != CircuitClosed {
+			log.Printf("Cache circuit breaker closed - the cache has recovered.\n")
+		}
+		circuitBreakerCachePersistence.state = CircuitClosed
+		circuitBreakerCachePersistence.consecutiveFailures = 0
+		return
+	}
+
+	circuitBreakerCachePersistence.consecutiveFailures++
+	if circuitBreakerCachePersistence.state == CircuitHalfOpen ||
+		circuitBreakerCachePersistence.consecutiveFailures >= circuitBreakerCachePersistence.failureThreshold {
+		if circuitBreakerCachePersistence.state == CircuitClosed {
+			circuitBreakerCachePersistence.trips++
+			log.Printf("Cache circuit breaker opened after %d consecutive failures: %v.\n",
+				circuitBreakerCachePersistence.consecutiveFailures, err)
+		}
+		circuitBreakerCachePersistence.state = CircuitOpen
+		circuitBreakerCachePersistence.openedAt = time.Now()
+	}
+}
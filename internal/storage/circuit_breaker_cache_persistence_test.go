@@ -0,0 +1,130 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	testing_utils "github.com/gdgenchev/urlshortener/internal/testing"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"testing"
+	"time"
+)
+
+func newTestCircuitBreaker(failureThreshold int, retryMillis int) (*storage.CircuitBreakerCachePersistence,
+	*testing_utils.FaultyCachePersistence) {
+	var configuration util.Configuration
+	configuration.CacheCircuitBreaker.FailureThreshold = failureThreshold
+	configuration.CacheCircuitBreaker.RetryMillis = retryMillis
+
+	faultyCachePersistence := testing_utils.NewFaultyCachePersistence(storage.NewMemoryCachePersistence())
+	return storage.NewCircuitBreakerCachePersistence(configuration, faultyCachePersistence), faultyCachePersistence
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	circuitBreaker, faultyCachePersistence := newTestCircuitBreaker(3, 60000)
+	faultyCachePersistence.SetDown(true)
+
+	for i := 0; i < 3; i++ {
+		if circuitBreaker.State() != storage.CircuitClosed {
+			t.Fatalf("The circuit opened after %d failures, expected 3.", i)
+		}
+		circuitBreaker.GetUrlData(context.Background(), testUrlData.ShortSlug)
+	}
+
+	if circuitBreaker.State() != storage.CircuitOpen {
+		t.Fatalf("Expected an open circuit, got: %v.", circuitBreaker.State())
+	}
+
+	// The cache is healthy again, but the circuit does not call it before the retry timeout
+	faultyCachePersistence.SetDown(false)
+	if _, err := circuitBreaker.GetUrlData(context.Background(), testUrlData.ShortSlug); err != storage.ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen while the circuit is open, got: %v.", err)
+	}
+}
+
+func TestCircuitBreakerDoesNotCountCacheMisses(t *testing.T) {
+	circuitBreaker, _ := newTestCircuitBreaker(1, 60000)
+
+	if _, err := circuitBreaker.GetUrlData(context.Background(), "missing-short-slug"); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a cache miss, got: %v.", err)
+	}
+
+	if circuitBreaker.State() != storage.CircuitClosed {
+		t.Errorf("A cache miss opened the circuit.")
+	}
+}
+
+func TestCircuitBreakerClosesAfterSuccessfulProbe(t *testing.T) {
+	circuitBreaker, faultyCachePersistence := newTestCircuitBreaker(1, 10)
+	faultyCachePersistence.SetDown(true)
+	circuitBreaker.Exists(context.Background(), testUrlData.ShortSlug)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The probe fails, so the circuit opens again
+	circuitBreaker.Exists(context.Background(), testUrlData.ShortSlug)
+	if circuitBreaker.State() != storage.CircuitOpen {
+		t.Fatalf("Expected an open circuit after a failed probe, got: %v.", circuitBreaker.State())
+	}
+
+	faultyCachePersistence.SetDown(false)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := circuitBreaker.Exists(context.Background(), testUrlData.ShortSlug); err != nil {
+		t.Errorf("The probe failed after the cache recovered: %v.", err)
+	}
+	if circuitBreaker.State() != storage.CircuitClosed {
+		t.Errorf("Expected a closed circuit after a successful probe, got: %v.", circuitBreaker.State())
+	}
+
+	stats := circuitBreaker.Stats()
+	if stats["cache.circuit_breaker.state"] != "closed" || stats["cache.circuit_breaker.trips"] != 1 {
+		t.Errorf("Unexpected circuit breaker stats: %v.", stats)
+	}
+}
+
+func TestCircuitBreakerIgnoresDeletesWhileOpen(t *testing.T) {
+	circuitBreaker, faultyCachePersistence := newTestCircuitBreaker(1, 10)
+	faultyCachePersistence.SetDown(true)
+	circuitBreaker.Exists(context.Background(), testUrlData.ShortSlug)
+
+	// A successful delete does not close the circuit
+	faultyCachePersistence.SetDown(false)
+	circuitBreaker.DeleteUrlData(context.Background(), testUrlData.ShortSlug)
+	if circuitBreaker.State() != storage.CircuitOpen {
+		t.Fatalf("Expected an open circuit after a delete, got: %v.", circuitBreaker.State())
+	}
+
+	// Failing deletes do not keep the circuit from letting the probe through
+	faultyCachePersistence.SetDown(true)
+	time.Sleep(20 * time.Millisecond)
+	circuitBreaker.DeleteUrlData(context.Background(), testUrlData.ShortSlug)
+	faultyCachePersistence.SetDown(false)
+
+	if _, err := circuitBreaker.Exists(context.Background(), testUrlData.ShortSlug); err == storage.ErrCircuitOpen {
+		t.Errorf("Expected the probe to be let through after the retry timeout.")
+	}
+}
+
+func TestPersistenceManagerWhenCacheCircuitIsOpen(t *testing.T) {
+	circuitBreaker, faultyCachePersistence := newTestCircuitBreaker(1, 60000)
+	circuitPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		storage.NewMemoryDatabasePersistence(), circuitBreaker)
+
+	faultyCachePersistence.SetDown(true)
+
+	if err := circuitPersistenceManager.SaveUrlData(context.Background(), testUrlData); err != nil {
+		t.Fatalf("Could not save url data while the cache circuit is open: %v.", err)
+	}
+	if circuitBreaker.State() != storage.CircuitOpen {
+		t.Fatalf("Expected an open circuit, got: %v.", circuitBreaker.State())
+	}
+
+	foundRealUrl, err := circuitPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s from the database, got: %s, error: %v.", testUrlData.RealUrl, foundRealUrl, err)
+	}
+
+	if state := circuitPersistenceManager.Stats()["cache.circuit_breaker.state"]; state != "open" {
+		t.Errorf("Expected the open circuit in the persistence manager stats, got: %v.", state)
+	}
+}
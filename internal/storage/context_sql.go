@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// contextSQLCommon binds the statements executed by gorm to a context.
+// gorm v1 does not accept a context, so a gorm handle is opened on top of it for every operation,
+// which lets the database driver cancel the statement once the context is done.
+// The transactions are started with the context as well, so gorm can begin them through Begin and BeginTx.
+type contextSQLCommon struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+func (contextSQLCommon *contextSQLCommon) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return contextSQLCommon.db.ExecContext(contextSQLCommon.ctx, query, args...)
+}
+
+func (contextSQLCommon *contextSQLCommon) Prepare(query string) (*sql.Stmt, error) {
+	return contextSQLCommon.db.PrepareContext(contextSQLCommon.ctx, query)
+}
+
+func (contextSQLCommon *contextSQLCommon) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return contextSQLCommon.db.QueryContext(contextSQLCommon.ctx, query, args...)
+}
+
+func (contextSQLCommon *contextSQLCommon) QueryRow(query string, args ...interface{}) *sql.Row {
+	return contextSQLCommon.db.QueryRowContext(contextSQLCommon.ctx, query, args...)
+}
+
+func (contextSQLCommon *contextSQLCommon) Begin() (*sql.Tx, error) {
+	return contextSQLCommon.db.BeginTx(contextSQLCommon.ctx, nil)
+}
+
+func (contextSQLCommon *contextSQLCommon) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return contextSQLCommon.db.BeginTx(ctx, opts)
+}
@@ -2,96 +2,345 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gdgenchev/urlshortener/internal/model"
 	"github.com/gdgenchev/urlshortener/internal/util"
+	mysqlerrors "github.com/go-mysql/errors"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
+	"strconv"
+	"strings"
+	"time"
 )
 
+func init() {
+	RegisterDatabasePersistence(MysqlBackend, func(configuration util.Configuration) DatabasePersistence {
+		return NewMysqlPersistence(configuration)
+	})
+	databaseOpeners[MysqlBackend] = openMysqlDatabase
+}
+
 // DatabasePersistence provides a util interface for the long term url data persistence.
+// The methods return ErrNotFound, ErrDuplicate, ErrExpired or ErrUnavailable, so that the callers
+// can tell a missing short slug from a failing database. The optional operations are grouped in the interfaces
+// below, which the PersistenceManager finds by a type assertion. It returns ErrUnsupported for the operations
+// which the database does not implement.
 type DatabasePersistence interface {
-	SaveUrlData(urlData model.UrlData) bool
-	GetUrlData(shortUrl string) (model.UrlData, bool)
-	Exists(shortSlug string) bool
-	Close()
+	// SaveUrlData saves the url data and returns ErrDuplicate if the short slug is taken.
+	SaveUrlData(ctx context.Context, urlData model.UrlData) error
+	// GetUrlData returns the url data of the short slug, possibly from a read replica.
+	GetUrlData(ctx context.Context, shortUrl string) (model.UrlData, error)
+	// Exists reports whether the short slug has url data which has not expired.
+	Exists(ctx context.Context, shortSlug string) (bool, error)
+	// DeleteExpiredUrlData deletes at most limit url data which has expired before the provided time
+	// and returns how many it has deleted, so that the ExpirySweeper can remove them in batches.
+	// If ExpiredUrlData.Archive is configured, the deleted url data is moved to the archive.
+	DeleteExpiredUrlData(ctx context.Context, expiredBefore time.Time, limit int) (int, error)
+	// GetArchivedUrlData returns the archived url data of the short slug, newest first.
+	GetArchivedUrlData(ctx context.Context, shortSlug string) ([]model.ArchivedUrlData, error)
+	// Close closes the connections to the database.
+	Close() error
+}
+
+// LinkStore is implemented by the database persistences whose url data can be changed after it is saved.
+// The changes are made on the primary, so the url data is read from there while the replicas may lag behind.
+type LinkStore interface {
+	// GetUrlDataFromPrimary returns the url data of the short slug like GetUrlData, but never from a read replica.
+	GetUrlDataFromPrimary(ctx context.Context, shortSlug string) (model.UrlData, error)
+	// UpdateUrlData replaces the real url, the expire time and the tags of the short slug and returns ErrExpired
+	// if it has expired. If ExpiredUrlData.Archive is configured, the replaced url data is archived.
+	UpdateUrlData(ctx context.Context, urlData model.UrlData) error
+	// DeleteUrlData makes the url data of the short slug expire now and returns ErrExpired if it has expired.
+	// The short slug is not reused before the reuse cooldown and it is archived when it is removed.
+	DeleteUrlData(ctx context.Context, shortSlug string) error
+}
+
+// LinkBatchSaver is implemented by the database persistences which can save several url data at once.
+type LinkBatchSaver interface {
+	// SaveUrlDataBatch saves the url data and returns the error of each of them, nil for the saved ones.
+	// With allOrNothing either every url data is saved or none, the ones which have not failed get ErrBatchAborted.
+	SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData, allOrNothing bool) []error
+}
+
+// ApiKeyStore is implemented by the database persistences which can keep the api keys.
+// The api keys are saved, looked up and revoked by the hash of the key, the key itself is never stored.
+type ApiKeyStore interface {
+	// SaveApiKey saves the api key and returns ErrDuplicate if there is an api key with the same hash.
+	SaveApiKey(ctx context.Context, apiKey model.ApiKey) error
+	// GetApiKey returns the api key given its hash from the primary, so that a revoked key is rejected right away.
+	GetApiKey(ctx context.Context, keyHash string) (model.ApiKey, error)
+	// DeleteApiKey revokes the api key given its hash and returns ErrNotFound if there is no such api key.
+	DeleteApiKey(ctx context.Context, keyHash string) error
+}
+
+// SlugKeyStore is implemented by the database persistences which can keep the pool of pre-generated short slugs.
+type SlugKeyStore interface {
+	// SaveSlugKeys adds the short slugs which are not taken to the pool and returns how many it has added.
+	SaveSlugKeys(ctx context.Context, shortSlugs []string) (int, error)
+	// ClaimSlugKeys takes at most limit short slugs out of the pool, so that no other caller gets the same ones.
+	ClaimSlugKeys(ctx context.Context, limit int) ([]string, error)
+	// CountSlugKeys returns how many short slugs are left in the pool.
+	CountSlugKeys(ctx context.Context) (int, error)
+}
+
+// ShortSlugCounter is implemented by the database persistences which can count the stored short slugs by length,
+// which tells how much of the keyspace of a slug length is in use.
+type ShortSlugCounter interface {
+	// CountShortSlugs returns how many url data, even expired ones, have a short slug of the length.
+	CountShortSlugs(ctx context.Context, length int) (int, error)
+}
+
+// LinkLister is implemented by the database persistences which can list the url data for the links api.
+type LinkLister interface {
+	// ListUrlData returns the url data matching the query, even the expired one, newest first, see UrlDataQuery.
+	ListUrlData(ctx context.Context, query UrlDataQuery) ([]model.UrlData, error)
+}
+
+// UrlDataQuery filters the listed url data. The empty fields and the zero times do not filter.
+// The From times are inclusive and the To times are exclusive. Search is matched case insensitively
+// against the short slug and the real url. The url data is ordered by its creation time and short slug,
+// both descending, and a page starts after the url data at AfterCreatedAt and AfterShortSlug if the latter is set.
+// Limit is the maximum number of url data to return, 0 means no limit.
+type UrlDataQuery struct {
+	Owner          string
+	CreatedFrom    time.Time
+	CreatedTo      time.Time
+	ExpiresFrom    time.Time
+	ExpiresTo      time.Time
+	Host           string
+	Tag            string
+	Search         string
+	AfterCreatedAt time.Time
+	AfterShortSlug string
+	Limit          int
+}
+
+// matches reports whether the url data passes the filters and comes after the cursor of the query.
+func (query UrlDataQuery) matches(urlData model.UrlData) bool {
+	switch {
+	case query.Owner != "" && urlData.Owner != query.Owner,
+		!query.CreatedFrom.IsZero() && urlData.CreatedAt.Before(query.CreatedFrom),
+		!query.CreatedTo.IsZero() && !urlData.CreatedAt.Before(query.CreatedTo),
+		!query.ExpiresFrom.IsZero() && urlData.Expires.Before(query.ExpiresFrom),
+		!query.ExpiresTo.IsZero() && !urlData.Expires.Before(query.ExpiresTo),
+		query.Host != "" && urlData.Host != strings.ToLower(query.Host),
+		query.Tag != "" && !urlData.Tags.HasTag(query.Tag):
+		return false
+	}
+
+	if query.Search != "" {
+		search := strings.ToLower(query.Search)
+		if !strings.Contains(strings.ToLower(urlData.ShortSlug), search) &&
+			!strings.Contains(strings.ToLower(urlData.RealUrl), search) {
+			return false
+		}
+	}
+
+	return query.AfterShortSlug == "" || isListedAfter(query.AfterCreatedAt, query.AfterShortSlug, urlData)
+}
+
+// isListedAfter reports whether the url data comes after the one with the creation time and the short slug
+// in the newest first order of the listing.
+func isListedAfter(createdAt time.Time, shortSlug string, urlData model.UrlData) bool {
+	if urlData.CreatedAt.Equal(createdAt) {
+		return urlData.ShortSlug < shortSlug
+	}
+
+	return urlData.CreatedAt.Before(createdAt)
+}
+
+// batchErrors returns the errors of a batch of count url data which has failed as a whole.
+func batchErrors(count int, err error) []error {
+	errs := make([]error, count)
+	for i := range errs {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// abortBatch sets ErrBatchAborted as the error of the url data of a batch which have not failed.
+func abortBatch(errs []error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrBatchAborted
+		}
+	}
+
+	return errs
+}
+
+// prepareUrlDataForSave sets the fields of the url data which are derived on save - the host of the real url
+// and the creation time, if it is not set. The creation time is kept in whole seconds, in UTC, so that it
+// is the same after a round trip through every database and can be used as a listing cursor.
+func prepareUrlDataForSave(urlData model.UrlData) model.UrlData {
+	if urlData.CreatedAt.IsZero() {
+		urlData.CreatedAt = time.Now()
+	}
+	urlData.CreatedAt = urlData.CreatedAt.UTC().Truncate(time.Second)
+	urlData.Host = model.UrlHost(urlData.RealUrl)
+
+	return urlData
 }
 
 // MysqlPersistence is a concrete implementation of the DatabasePersistence.
+// The lookups are spread over the configured Mysql.Replicas, see ReplicaPool.
 type MysqlPersistence struct {
-	db *gorm.DB
+	*gormPersistence
 }
 
 func NewMysqlPersistence(configuration util.Configuration) *MysqlPersistence {
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?loc=Local&parseTime=True", configuration.Mysql.User,
-		configuration.Mysql.Password, configuration.Mysql.Host, configuration.Mysql.Port, configuration.Mysql.Database)
-	db, err := gorm.Open(configuration.Mysql.DriverName, connectionString)
+	db, err := openMysqlDatabase(configuration)
 	if err != nil {
 		panic(err)
 	}
 
 	mysqlPersistence := new(MysqlPersistence)
-	mysqlPersistence.db = db
+	mysqlPersistence.gormPersistence = &gormPersistence{db: db, isDuplicateKeyError: isMysqlDuplicateKeyError,
+		expiredUrlDataPolicy: newExpiredUrlDataPolicy(configuration)}
 
 	mysqlPersistence.init()
 
+	if len(configuration.Mysql.Replicas) > 0 {
+		replicaPool, err := openMysqlReplicaPool(configuration)
+		if err != nil {
+			panic(err)
+		}
+		mysqlPersistence.replicaPool = replicaPool
+		replicaPool.Start()
+	}
+
 	return mysqlPersistence
 }
 
-func (mysqlPersistence *MysqlPersistence) init() {
-	mysqlPersistence.db.AutoMigrate(model.UrlData{})
-	mysqlPersistence.db.Exec("CREATE EVENT IF NOT EXISTS expires_check ON SCHEDULE EVERY 1 DAY DO DELETE FROM url_data WHERE expires <= NOW()")
+func openMysqlDatabase(configuration util.Configuration) (*gorm.DB, error) {
+	return openMysqlHost(configuration, configuration.Mysql.Host, configuration.Mysql.Port)
 }
 
-// SaveUrlData saves the url data in the database.
-// Returns true if successful and false if the url short slug already exists
-func (mysqlPersistence *MysqlPersistence) SaveUrlData(urlData model.UrlData) bool {
-	//Workaround for an expired url, but not yet deleted by the mysql event
-	mysqlPersistence.deleteUrlDataIfExpired(urlData.ShortSlug)
+func openMysqlHost(configuration util.Configuration, host string, port int) (*gorm.DB, error) {
+	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?loc=Local&parseTime=True", configuration.Mysql.User,
+		configuration.Mysql.Password, host, port, configuration.Mysql.Database)
+	return gorm.Open(configuration.Mysql.DriverName, connectionString)
+}
 
-	if mysqlPersistence.Exists(urlData.ShortSlug) {
-		return false
+// openMysqlReplicaPool connects to the read replicas. The schema is migrated on the primary only,
+// the replicas receive it through the replication.
+func openMysqlReplicaPool(configuration util.Configuration) (*ReplicaPool, error) {
+	replicaPool := NewReplicaPool(configuration)
+
+	for _, replica := range configuration.Mysql.Replicas {
+		db, err := openMysqlHost(configuration, replica.Host, replica.Port)
+		if err != nil {
+			replicaPool.Close()
+			return nil, err
+		}
+		replicaPool.Add(fmt.Sprintf("%s:%d", replica.Host, replica.Port), db)
 	}
+	replicaPool.SetLagCheck(mysqlReplicationLag)
+
+	return replicaPool, nil
+}
 
-	err := mysqlPersistence.db.Create(&urlData).Error
+// mysqlReplicationLag returns how far the replica is behind the primary, read from Seconds_Behind_Master.
+// It fails if the replica does not replicate or its replication is stopped.
+func mysqlReplicationLag(ctx context.Context, db *gorm.DB) (time.Duration, error) {
+	rows, err := db.DB().QueryContext(ctx, "SHOW SLAVE STATUS")
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("storage: the replica does not replicate")
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]sql.NullString, len(columns))
+	valuePointers := make([]interface{}, len(columns))
+	for i := range values {
+		valuePointers[i] = &values[i]
+	}
+	if err := rows.Scan(valuePointers...); err != nil {
+		return 0, err
 	}
 
-	return true
+	for i, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("storage: the replication of the replica is stopped")
+		}
+		seconds, err := strconv.Atoi(values[i].String)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, errors.New("storage: SHOW SLAVE STATUS has no Seconds_Behind_Master")
 }
 
-// GetRealUrlData retrieves the url data given a short slug.
-// It checks only valid urls(which have not expired).
-func (mysqlPersistence *MysqlPersistence) GetUrlData(shortSlug string) (model.UrlData, bool) {
-	var urlData model.UrlData
-	found := !mysqlPersistence.db.
-		Where("short_slug = ?", shortSlug).
-		Where("expires > NOW()").
-		First(&urlData).
-		RecordNotFound()
+// Stats returns how many of the read replicas are in rotation, if there are any.
+func (mysqlPersistence *MysqlPersistence) Stats() Stats {
+	if mysqlPersistence.replicaPool == nil {
+		return Stats{}
+	}
 
-	return urlData, found
+	return mysqlPersistence.replicaPool.Stats()
 }
 
-// Exists checks whether the short slug is present in the database.
-// It also deletes an existent entry if it has expired.
-func (mysqlPersistence *MysqlPersistence) Exists(shortSlug string) bool {
-	_, found := mysqlPersistence.GetUrlData(shortSlug)
-	return found == true
+func (mysqlPersistence *MysqlPersistence) init() {
+	migrateUp(mysqlPersistence.db)
 }
 
-// Close closes the database client.
-func (mysqlPersistence *MysqlPersistence) Close() {
-	err := mysqlPersistence.db.Close()
-	if err != nil {
-		panic(err)
+// dropExpiryEvent drops the event which has removed the expired url data in the older versions,
+// once the ExpirySweeper has started to remove it.
+func (mysqlPersistence *MysqlPersistence) dropExpiryEvent(ctx context.Context) error {
+	return mysqlPersistence.withContext(ctx).Exec("DROP EVENT IF EXISTS expires_check").Error
+}
+
+// expiredUrlDataPolicy holds what happens to the url data once it expires.
+type expiredUrlDataPolicy struct {
+	archive       bool
+	reuseCooldown time.Duration
+}
+
+func newExpiredUrlDataPolicy(configuration util.Configuration) expiredUrlDataPolicy {
+	return expiredUrlDataPolicy{
+		archive:       configuration.ExpiredUrlData.Archive,
+		reuseCooldown: time.Duration(configuration.ExpiredUrlData.ReuseCooldownMinutes) * time.Minute,
 	}
 }
 
-func (mysqlPersistence *MysqlPersistence) deleteUrlDataIfExpired(shortSlug string) {
-	err := mysqlPersistence.db.Where("short_slug = ?", shortSlug).Where("expires < NOW()").Delete(model.UrlData{}).Error
-	if err != nil {
-		panic(err)
+// reusableExpiredBefore returns the time before which an url data must have expired,
+// so that its short slug can be taken by a new url data.
+func (expiredUrlDataPolicy expiredUrlDataPolicy) reusableExpiredBefore() time.Time {
+	return time.Now().Add(-expiredUrlDataPolicy.reuseCooldown)
+}
+
+// existsByGetUrlData converts the result of GetUrlData to the result of Exists.
+func existsByGetUrlData(urlData model.UrlData, err error) (bool, error) {
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound, ErrExpired:
+		return false, nil
+	default:
+		return false, err
 	}
 }
+
+func isMysqlDuplicateKeyError(err error) bool {
+	_, mysqlError := mysqlerrors.Error(err)
+	return mysqlError == mysqlerrors.ErrDupeKey
+}
@@ -0,0 +1,724 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// databasePersistenceFactories returns the DatabasePersistence implementations which are checked
+// against the same behaviour. The backends which need a running server (MySQL and PostgreSQL)
+// are part of the list only when they are selected in the testing configuration.
+// The ExpiredUrlData section of the provided configuration is applied to every backend.
+func databasePersistenceFactories(configuration util.Configuration) map[string]func(t *testing.T) storage.DatabasePersistence {
+	factories := map[string]func(t *testing.T) storage.DatabasePersistence{
+		storage.MemoryBackend: func(t *testing.T) storage.DatabasePersistence {
+			configuration.Storage.Database = storage.MemoryBackend
+			return storage.NewDatabasePersistence(configuration)
+		},
+		storage.SqliteBackend: func(t *testing.T) storage.DatabasePersistence {
+			directory, err := ioutil.TempDir("", "urlshortener")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			configuration.Sqlite.Path = filepath.Join(directory, "urlshortener.db")
+			sqlitePersistence := storage.NewSqlitePersistence(configuration)
+
+			return &closingDatabasePersistence{sqlitePersistence, func() { os.RemoveAll(directory) }}
+		},
+	}
+
+	serverConfiguration := testPersistence.GetTestConfiguration()
+	serverConfiguration.ExpiredUrlData = configuration.ExpiredUrlData
+	switch serverConfiguration.Storage.Database {
+	case storage.MysqlBackend, storage.PostgresBackend:
+		factories[serverConfiguration.Storage.Database] = func(t *testing.T) storage.DatabasePersistence {
+			if err := testPersistence.FlushTestPersistence(); err != nil {
+				t.Fatal(err)
+			}
+
+			return storage.NewDatabasePersistence(serverConfiguration)
+		}
+	}
+
+	return factories
+}
+
+// closingDatabasePersistence removes the resources of a test backend when it is closed.
+type closingDatabasePersistence struct {
+	storage.DatabasePersistence
+	onClose func()
+}
+
+func (closingDatabasePersistence *closingDatabasePersistence) Close() error {
+	defer closingDatabasePersistence.onClose()
+	return closingDatabasePersistence.DatabasePersistence.Close()
+}
+
+// optionalInterfaces returns the wrapped database persistence, whose optional interfaces are hidden by the wrapper.
+func optionalInterfaces(databasePersistence storage.DatabasePersistence) storage.DatabasePersistence {
+	if closingDatabasePersistence, wrapped := databasePersistence.(*closingDatabasePersistence); wrapped {
+		return closingDatabasePersistence.DatabasePersistence
+	}
+
+	return databasePersistence
+}
+
+func forEachDatabasePersistence(t *testing.T, test func(t *testing.T, databasePersistence storage.DatabasePersistence)) {
+	forEachConfiguredDatabasePersistence(t, util.Configuration{}, test)
+}
+
+func forEachConfiguredDatabasePersistence(t *testing.T, configuration util.Configuration,
+	test func(t *testing.T, databasePersistence storage.DatabasePersistence)) {
+	for backend, factory := range databasePersistenceFactories(configuration) {
+		t.Run(backend, func(t *testing.T) {
+			databasePersistence := factory(t)
+			defer databasePersistence.Close()
+
+			test(t, databasePersistence)
+		})
+	}
+}
+
+func newDatabaseTestUrlData(expires time.Time) model.UrlData {
+	return model.UrlData{ShortSlug: "db-short-slug", RealUrl: "http://db-real-url.com",
+		Expires: model.CustomTime{Time: expires}}
+}
+
+func TestDatabaseSaveUrlDataWhenUnique(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		if err := databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != nil {
+			t.Errorf("Could not save unique url data: %v.", err)
+		}
+	})
+}
+
+func TestDatabaseSaveUrlDataWhenDuplicate(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+
+		if err := databasePersistence.SaveUrlData(context.Background(), urlData); err != storage.ErrDuplicate {
+			t.Errorf("Expected ErrDuplicate for duplicate url data, got: %v.", err)
+		}
+	})
+}
+
+func TestDatabaseSaveUrlDataWhenPreviousHasExpired(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(-time.Minute)))
+
+		if err := databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != nil {
+			t.Errorf("Could not save url data over an expired short slug: %v.", err)
+		}
+	})
+}
+
+func TestDatabaseSaveUrlDataConcurrentlyReservesShortSlugOnce(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		const savers = 20
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+
+		errs := make(chan error, savers)
+		var waitGroup sync.WaitGroup
+		for i := 0; i < savers; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				errs <- databasePersistence.SaveUrlData(context.Background(), urlData)
+			}()
+		}
+		waitGroup.Wait()
+		close(errs)
+
+		saved := 0
+		for err := range errs {
+			switch err {
+			case nil:
+				saved++
+			case storage.ErrDuplicate:
+			default:
+				t.Errorf("Unexpected error while saving concurrently: %v.", err)
+			}
+		}
+
+		if saved != 1 {
+			t.Errorf("Expected the short slug to be saved exactly once, got: %d.", saved)
+		}
+	})
+}
+
+func TestDatabaseGetUrlData(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+
+		foundUrlData, err := databasePersistence.GetUrlData(context.Background(), urlData.ShortSlug)
+		if err != nil {
+			t.Fatalf("Url data for short slug: %s was not found: %v.", urlData.ShortSlug, err)
+		}
+		if foundUrlData.RealUrl != urlData.RealUrl {
+			t.Errorf("Expected real url: %s, got: %s.", urlData.RealUrl, foundUrlData.RealUrl)
+		}
+		if foundUrlData.Expires.Unix() != urlData.Expires.Unix() {
+			t.Errorf("Expected expires: %v, got: %v.", urlData.Expires.Time, foundUrlData.Expires.Time)
+		}
+	})
+}
+
+func TestDatabaseGetUrlDataWhenExpired(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		urlData := newDatabaseTestUrlData(time.Now().Add(-time.Minute))
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+
+		if _, err := databasePersistence.GetUrlData(context.Background(), urlData.ShortSlug); err != storage.ErrExpired {
+			t.Errorf("Expected ErrExpired for short slug: %s, got: %v.", urlData.ShortSlug, err)
+		}
+		if exists, err := databasePersistence.Exists(context.Background(), urlData.ShortSlug); exists || err != nil {
+			t.Errorf("Expired short slug: %s exists: %v, error: %v.", urlData.ShortSlug, exists, err)
+		}
+	})
+}
+
+func TestDatabaseGetUrlDataWhenNotPresent(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		if _, err := databasePersistence.GetUrlData(context.Background(), "missing-short-slug"); err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a missing short slug, got: %v.", err)
+		}
+		if exists, err := databasePersistence.Exists(context.Background(), "missing-short-slug"); exists || err != nil {
+			t.Errorf("Missing short slug exists: %v, error: %v.", exists, err)
+		}
+	})
+}
+
+func TestSqliteGetUrlDataWithCancelledContext(t *testing.T) {
+	databasePersistence := databasePersistenceFactories(util.Configuration{})[storage.SqliteBackend](t)
+	defer databasePersistence.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := databasePersistence.GetUrlData(ctx, "db-short-slug"); !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable for a cancelled context, got: %v.", err)
+	}
+}
+
+func TestDatabaseDeleteExpiredUrlData(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		for i, expires := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(-time.Minute),
+			time.Now().Add(-time.Minute), time.Now().Add(time.Hour)} {
+			urlData := newDatabaseTestUrlData(expires)
+			urlData.ShortSlug += strconv.Itoa(i)
+			databasePersistence.SaveUrlData(context.Background(), urlData)
+		}
+
+		deleted, err := databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now(), 2)
+		if err != nil || deleted != 2 {
+			t.Fatalf("Expected the first batch to delete 2 url data, got: %d, error: %v.", deleted, err)
+		}
+
+		deleted, err = databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now(), 2)
+		if err != nil || deleted != 1 {
+			t.Fatalf("Expected the second batch to delete the last expired url data, got: %d, error: %v.", deleted, err)
+		}
+
+		if exists, _ := databasePersistence.Exists(context.Background(), "db-short-slug3"); !exists {
+			t.Errorf("The url data which has not expired was deleted.")
+		}
+	})
+}
+
+func newArchivingConfiguration(reuseCooldownMinutes int) util.Configuration {
+	var configuration util.Configuration
+	configuration.ExpiredUrlData.Archive = true
+	configuration.ExpiredUrlData.ReuseCooldownMinutes = reuseCooldownMinutes
+
+	return configuration
+}
+
+func TestDatabaseArchivesExpiredUrlData(t *testing.T) {
+	forEachConfiguredDatabasePersistence(t, newArchivingConfiguration(0),
+		func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+			for _, realUrl := range []string{"http://first-real-url.com", "http://second-real-url.com"} {
+				urlData := newDatabaseTestUrlData(time.Now().Add(-time.Minute))
+				urlData.RealUrl = realUrl
+				if err := databasePersistence.SaveUrlData(context.Background(), urlData); err != nil {
+					t.Fatalf("Could not save url data: %v.", err)
+				}
+
+				deleted, err := databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now(), 10)
+				if err != nil || deleted != 1 {
+					t.Fatalf("Expected the expired url data to be archived, got: %d, error: %v.", deleted, err)
+				}
+			}
+
+			archivedUrlData, err := databasePersistence.GetArchivedUrlData(context.Background(), "db-short-slug")
+			if err != nil {
+				t.Fatalf("Could not get the archived url data: %v.", err)
+			}
+			if len(archivedUrlData) != 2 || archivedUrlData[0].RealUrl != "http://second-real-url.com" ||
+				archivedUrlData[1].RealUrl != "http://first-real-url.com" {
+				t.Errorf("Expected the archived url data newest first, got: %v.", archivedUrlData)
+			}
+		})
+}
+
+func TestDatabaseSaveUrlDataArchivesPreviousWhenReusable(t *testing.T) {
+	forEachConfiguredDatabasePersistence(t, newArchivingConfiguration(60),
+		func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+			databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(-2*time.Hour)))
+
+			if err := databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != nil {
+				t.Fatalf("Could not save url data over a short slug past its reuse cooldown: %v.", err)
+			}
+
+			archivedUrlData, _ := databasePersistence.GetArchivedUrlData(context.Background(), "db-short-slug")
+			if len(archivedUrlData) != 1 {
+				t.Errorf("Expected the previous url data to be archived, got: %v.", archivedUrlData)
+			}
+		})
+}
+
+func TestDatabaseSaveUrlDataWithinReuseCooldown(t *testing.T) {
+	forEachConfiguredDatabasePersistence(t, newArchivingConfiguration(60),
+		func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+			databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(-time.Minute)))
+
+			if err := databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != storage.ErrDuplicate {
+				t.Errorf("Expected ErrDuplicate for a short slug within its reuse cooldown, got: %v.", err)
+			}
+		})
+}
+
+func TestDatabaseSaveSlugKeysSkipsTakenShortSlugs(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		slugKeyStore := optionalInterfaces(databasePersistence).(storage.SlugKeyStore)
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+		slugKeyStore.SaveSlugKeys(context.Background(), []string{"pooled"})
+
+		saved, err := slugKeyStore.SaveSlugKeys(context.Background(),
+			[]string{urlData.ShortSlug, "pooled", "free"})
+		if err != nil || saved != 1 {
+			t.Errorf("Expected only the free short slug to be saved, got: %d, error: %v.", saved, err)
+		}
+		if count, err := slugKeyStore.CountSlugKeys(context.Background()); err != nil || count != 2 {
+			t.Errorf("Expected 2 short slugs in the pool, got: %d, error: %v.", count, err)
+		}
+
+		claimed, err := slugKeyStore.ClaimSlugKeys(context.Background(), 10)
+		if err != nil || len(claimed) != 2 {
+			t.Fatalf("Expected 2 claimed short slugs, got: %v, error: %v.", claimed, err)
+		}
+		for _, shortSlug := range claimed {
+			if shortSlug == urlData.ShortSlug {
+				t.Errorf("Claimed the short slug of an existing url data.")
+			}
+		}
+	})
+}
+
+func TestDatabaseClaimSlugKeysConcurrentlyClaimsEachOnce(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		const slugKeys = 100
+		const claimers = 10
+		slugKeyStore := optionalInterfaces(databasePersistence).(storage.SlugKeyStore)
+		shortSlugs := make([]string, slugKeys)
+		for i := range shortSlugs {
+			shortSlugs[i] = "key-" + strconv.Itoa(i)
+		}
+		if _, err := slugKeyStore.SaveSlugKeys(context.Background(), shortSlugs); err != nil {
+			t.Fatal(err)
+		}
+
+		var mutex sync.Mutex
+		var waitGroup sync.WaitGroup
+		claimCount := make(map[string]int)
+		for i := 0; i < claimers; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for {
+					claimed, err := slugKeyStore.ClaimSlugKeys(context.Background(), 7)
+					if err != nil {
+						t.Errorf("Unexpected error while claiming concurrently: %v.", err)
+						return
+					}
+					if len(claimed) == 0 {
+						return
+					}
+
+					mutex.Lock()
+					for _, shortSlug := range claimed {
+						claimCount[shortSlug]++
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+		waitGroup.Wait()
+
+		for _, shortSlug := range shortSlugs {
+			if claimCount[shortSlug] != 1 {
+				t.Errorf("Expected %q to be claimed once, got: %d.", shortSlug, claimCount[shortSlug])
+			}
+		}
+	})
+}
+
+func TestDatabaseCountShortSlugsByLength(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		for _, shortSlug := range []string{"abc", "xyz", "abcd"} {
+			urlData := newDatabaseTestUrlData(time.Now().Add(-time.Hour))
+			urlData.ShortSlug = shortSlug
+			databasePersistence.SaveUrlData(context.Background(), urlData)
+		}
+
+		shortSlugCounter := optionalInterfaces(databasePersistence).(storage.ShortSlugCounter)
+		if count, err := shortSlugCounter.CountShortSlugs(context.Background(), 3); err != nil || count != 2 {
+			t.Errorf("Expected 2 short slugs of 3 symbols, even expired ones, got: %d, error: %v.", count, err)
+		}
+	})
+}
+
+func TestDatabaseUpdateUrlData(t *testing.T) {
+	forEachConfiguredDatabasePersistence(t, newArchivingConfiguration(0),
+		func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+			linkStore := optionalInterfaces(databasePersistence).(storage.LinkStore)
+			urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+			databasePersistence.SaveUrlData(context.Background(), urlData)
+
+			updatedUrlData := urlData
+			updatedUrlData.RealUrl = "http://db-updated-real-url.com"
+			updatedUrlData.Expires.Time = time.Now().Add(2 * time.Hour)
+			if err := linkStore.UpdateUrlData(context.Background(), updatedUrlData); err != nil {
+				t.Fatalf("Could not update url data: %v.", err)
+			}
+
+			foundUrlData, err := linkStore.GetUrlDataFromPrimary(context.Background(), urlData.ShortSlug)
+			if err != nil {
+				t.Fatalf("Url data for short slug: %s was not found: %v.", urlData.ShortSlug, err)
+			}
+			if foundUrlData.RealUrl != updatedUrlData.RealUrl {
+				t.Errorf("Expected real url: %s, got: %s.", updatedUrlData.RealUrl, foundUrlData.RealUrl)
+			}
+			if foundUrlData.Expires.Unix() != updatedUrlData.Expires.Unix() {
+				t.Errorf("Expected expires: %v, got: %v.", updatedUrlData.Expires.Time, foundUrlData.Expires.Time)
+			}
+
+			// The replaced url data is kept in the history of the short slug
+			archivedUrlData, err := databasePersistence.GetArchivedUrlData(context.Background(), urlData.ShortSlug)
+			if err != nil || len(archivedUrlData) != 1 || archivedUrlData[0].RealUrl != urlData.RealUrl {
+				t.Errorf("Expected the replaced url data to be archived, got: %v, error: %v.", archivedUrlData, err)
+			}
+		})
+}
+
+func TestDatabaseUpdateUrlDataWithUnchangedValues(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		linkStore := optionalInterfaces(databasePersistence).(storage.LinkStore)
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+
+		// Updating with the same values is not reported as a missing short slug
+		for i := 0; i < 2; i++ {
+			if err := linkStore.UpdateUrlData(context.Background(), urlData); err != nil {
+				t.Fatalf("Could not update url data with unchanged values: %v.", err)
+			}
+		}
+	})
+}
+
+func TestDatabaseUpdateUrlDataWhenNotValid(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		linkStore := optionalInterfaces(databasePersistence).(storage.LinkStore)
+		if err := linkStore.UpdateUrlData(context.Background(),
+			newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound when updating a missing short slug, got: %v.", err)
+		}
+
+		databasePersistence.SaveUrlData(context.Background(), newDatabaseTestUrlData(time.Now().Add(-time.Minute)))
+		if err := linkStore.UpdateUrlData(context.Background(),
+			newDatabaseTestUrlData(time.Now().Add(time.Hour))); err != storage.ErrExpired {
+			t.Errorf("Expected ErrExpired when updating an expired short slug, got: %v.", err)
+		}
+	})
+}
+
+// A deleted short slug expires, so it keeps blocking new url data until the sweeper archives it.
+func TestDatabaseDeleteUrlData(t *testing.T) {
+	forEachConfiguredDatabasePersistence(t, newArchivingConfiguration(0),
+		func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+			linkStore := optionalInterfaces(databasePersistence).(storage.LinkStore)
+			urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+			databasePersistence.SaveUrlData(context.Background(), urlData)
+
+			if err := linkStore.DeleteUrlData(context.Background(), urlData.ShortSlug); err != nil {
+				t.Fatalf("Could not delete url data: %v.", err)
+			}
+			if _, err := databasePersistence.GetUrlData(context.Background(), urlData.ShortSlug); err != storage.ErrExpired {
+				t.Errorf("Expected ErrExpired for a deleted short slug, got: %v.", err)
+			}
+			if err := linkStore.DeleteUrlData(context.Background(), urlData.ShortSlug); err != storage.ErrExpired {
+				t.Errorf("Expected ErrExpired when deleting a deleted short slug, got: %v.", err)
+			}
+			if err := linkStore.DeleteUrlData(context.Background(), "db-missing-short-slug"); err != storage.ErrNotFound {
+				t.Errorf("Expected ErrNotFound when deleting a missing short slug, got: %v.", err)
+			}
+
+			deleted, err := databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now().Add(time.Second), 10)
+			if err != nil || deleted != 1 {
+				t.Fatalf("Expected the deleted url data to be swept, got: %d, error: %v.", deleted, err)
+			}
+			archivedUrlData, err := databasePersistence.GetArchivedUrlData(context.Background(), urlData.ShortSlug)
+			if err != nil || len(archivedUrlData) != 1 {
+				t.Errorf("Expected the deleted url data to be archived, got: %v, error: %v.", archivedUrlData, err)
+			}
+		})
+}
+
+func TestDatabaseSaveUrlDataKeepsOwner(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		urlData := newDatabaseTestUrlData(time.Now().Add(time.Hour))
+		urlData.Owner = "db-owner"
+		databasePersistence.SaveUrlData(context.Background(), urlData)
+
+		// The owner is not changed by an update
+		updatedUrlData := urlData
+		updatedUrlData.Owner = ""
+		optionalInterfaces(databasePersistence).(storage.LinkStore).UpdateUrlData(context.Background(), updatedUrlData)
+
+		foundUrlData, err := databasePersistence.GetUrlData(context.Background(), urlData.ShortSlug)
+		if err != nil || foundUrlData.Owner != urlData.Owner {
+			t.Errorf("Expected owner: %s, got: %s, error: %v.", urlData.Owner, foundUrlData.Owner, err)
+		}
+	})
+}
+
+func TestDatabaseApiKeys(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		apiKeyStore := optionalInterfaces(databasePersistence).(storage.ApiKeyStore)
+		apiKey := model.ApiKey{KeyHash: "db-key-hash", Owner: "db-owner", Scopes: "create,manage",
+			CreatedAt: time.Now()}
+		if err := apiKeyStore.SaveApiKey(context.Background(), apiKey); err != nil {
+			t.Fatalf("Could not save the api key: %v.", err)
+		}
+		if err := apiKeyStore.SaveApiKey(context.Background(), apiKey); err != storage.ErrDuplicate {
+			t.Errorf("Expected ErrDuplicate for a duplicate api key, got: %v.", err)
+		}
+
+		foundApiKey, err := apiKeyStore.GetApiKey(context.Background(), apiKey.KeyHash)
+		if err != nil || foundApiKey.Owner != apiKey.Owner || foundApiKey.Scopes != apiKey.Scopes {
+			t.Errorf("Expected api key: %v, got: %v, error: %v.", apiKey, foundApiKey, err)
+		}
+
+		if err := apiKeyStore.DeleteApiKey(context.Background(), apiKey.KeyHash); err != nil {
+			t.Fatalf("Could not delete the api key: %v.", err)
+		}
+		if _, err := apiKeyStore.GetApiKey(context.Background(), apiKey.KeyHash); err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted api key, got: %v.", err)
+		}
+		if err := apiKeyStore.DeleteApiKey(context.Background(), apiKey.KeyHash); err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound when deleting a missing api key, got: %v.", err)
+		}
+	})
+}
+
+func saveListingTestUrlData(t *testing.T, databasePersistence storage.DatabasePersistence,
+	createdAt time.Time) []model.UrlData {
+	listingTestUrlData := []model.UrlData{
+		{ShortSlug: "list-cats", RealUrl: "http://Cats.example.com:8080/meow", Owner: "db-owner",
+			Tags: model.Tags{"pets", "cats"}},
+		{ShortSlug: "list-dogs", RealUrl: "http://dogs.example.com/woof", Owner: "db-owner", Tags: model.Tags{"pets"}},
+		{ShortSlug: "list-news", RealUrl: "http://news.example.org/100%_fresh", Owner: "db-other-owner"},
+		{ShortSlug: "list-old", RealUrl: "http://cats.example.com/old", Owner: "db-owner"},
+	}
+	for i := range listingTestUrlData {
+		listingTestUrlData[i].CreatedAt = createdAt.Add(-time.Duration(i/2) * time.Minute)
+		listingTestUrlData[i].Expires.Time = createdAt.Add(time.Duration(i+1) * time.Hour)
+		if err := databasePersistence.SaveUrlData(context.Background(), listingTestUrlData[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return listingTestUrlData
+}
+
+func listedShortSlugs(urlData []model.UrlData) []string {
+	shortSlugs := make([]string, 0, len(urlData))
+	for _, listed := range urlData {
+		shortSlugs = append(shortSlugs, listed.ShortSlug)
+	}
+
+	return shortSlugs
+}
+
+func TestDatabaseListUrlData(t *testing.T) {
+	createdAt := time.Now().Truncate(time.Second)
+
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		saveListingTestUrlData(t, databasePersistence, createdAt)
+
+		tests := []struct {
+			name       string
+			query      storage.UrlDataQuery
+			shortSlugs []string
+		}{
+			{"all", storage.UrlDataQuery{}, []string{"list-dogs", "list-cats", "list-old", "list-news"}},
+			{"owner", storage.UrlDataQuery{Owner: "db-other-owner"}, []string{"list-news"}},
+			{"created", storage.UrlDataQuery{CreatedFrom: createdAt.Add(-time.Minute), CreatedTo: createdAt},
+				[]string{"list-old", "list-news"}},
+			{"expires", storage.UrlDataQuery{ExpiresFrom: createdAt.Add(2 * time.Hour),
+				ExpiresTo: createdAt.Add(4 * time.Hour)}, []string{"list-dogs", "list-news"}},
+			{"host", storage.UrlDataQuery{Host: "CATS.example.com"}, []string{"list-cats", "list-old"}},
+			{"tag", storage.UrlDataQuery{Tag: "cats"}, []string{"list-cats"}},
+			{"search in short slug", storage.UrlDataQuery{Search: "LIST-D"}, []string{"list-dogs"}},
+			{"search in real url", storage.UrlDataQuery{Search: "meow"}, []string{"list-cats"}},
+			{"search with wildcards", storage.UrlDataQuery{Search: "0%_"}, []string{"list-news"}},
+			{"wildcards are not matched", storage.UrlDataQuery{Search: "o_d"}, []string{}},
+			{"limit", storage.UrlDataQuery{Owner: "db-owner", Limit: 2}, []string{"list-dogs", "list-cats"}},
+			{"cursor", storage.UrlDataQuery{AfterCreatedAt: createdAt, AfterShortSlug: "list-dogs", Limit: 2},
+				[]string{"list-cats", "list-old"}},
+		}
+		linkLister := optionalInterfaces(databasePersistence).(storage.LinkLister)
+		for _, test := range tests {
+			listed, err := linkLister.ListUrlData(context.Background(), test.query)
+			if err != nil {
+				t.Fatalf("Could not list the url data by %s: %v.", test.name, err)
+			}
+			if shortSlugs := listedShortSlugs(listed); !reflect.DeepEqual(shortSlugs, test.shortSlugs) {
+				t.Errorf("Expected short slugs listed by %s: %v, got: %v.", test.name, test.shortSlugs, shortSlugs)
+			}
+		}
+	})
+}
+
+func TestDatabaseListUrlDataReturnsSavedFields(t *testing.T) {
+	createdAt := time.Now().Truncate(time.Second)
+
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		saveListingTestUrlData(t, databasePersistence, createdAt)
+
+		updatedUrlData := model.UrlData{ShortSlug: "list-dogs", RealUrl: "http://puppies.example.com",
+			Expires: model.CustomTime{Time: createdAt.Add(time.Hour)}, Tags: model.Tags{"puppies"}}
+		linkStore := optionalInterfaces(databasePersistence).(storage.LinkStore)
+		if err := linkStore.UpdateUrlData(context.Background(), updatedUrlData); err != nil {
+			t.Fatal(err)
+		}
+
+		linkLister := optionalInterfaces(databasePersistence).(storage.LinkLister)
+		listed, err := linkLister.ListUrlData(context.Background(), storage.UrlDataQuery{Limit: 1})
+		if err != nil || len(listed) != 1 {
+			t.Fatalf("Expected a single listed url data, got: %v, error: %v.", listed, err)
+		}
+		if !listed[0].CreatedAt.Equal(createdAt) || listed[0].Owner != "db-owner" {
+			t.Errorf("Expected the creation time and the owner to be kept, got: %v.", listed[0])
+		}
+		if listed[0].Host != "puppies.example.com" || !reflect.DeepEqual(listed[0].Tags, updatedUrlData.Tags) {
+			t.Errorf("Expected the host and the tags to be updated, got: %v.", listed[0])
+		}
+	})
+}
+
+func newBatchTestUrlData(expires time.Time, shortSlugs ...string) []model.UrlData {
+	urlData := make([]model.UrlData, 0, len(shortSlugs))
+	for _, shortSlug := range shortSlugs {
+		urlData = append(urlData, model.UrlData{ShortSlug: shortSlug, RealUrl: "http://db-batch-real-url.com/" + shortSlug,
+			Expires: model.CustomTime{Time: expires}, Tags: model.Tags{"batch"}})
+	}
+
+	return urlData
+}
+
+func TestDatabaseSaveUrlDataBatch(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		linkBatchSaver := optionalInterfaces(databasePersistence).(storage.LinkBatchSaver)
+		databasePersistence.SaveUrlData(context.Background(),
+			newBatchTestUrlData(time.Now().Add(time.Hour), "batch-taken")[0])
+		databasePersistence.SaveUrlData(context.Background(),
+			newBatchTestUrlData(time.Now().Add(-time.Minute), "batch-expired")[0])
+
+		urlData := newBatchTestUrlData(time.Now().Add(time.Hour), "batch-1", "batch-taken", "batch-expired", "batch-1")
+		errs := linkBatchSaver.SaveUrlDataBatch(context.Background(), urlData, false)
+
+		expectedErrs := []error{nil, storage.ErrDuplicate, nil, storage.ErrDuplicate}
+		if !reflect.DeepEqual(errs, expectedErrs) {
+			t.Fatalf("Expected errors: %v, got: %v.", expectedErrs, errs)
+		}
+		for _, shortSlug := range []string{"batch-1", "batch-expired"} {
+			foundUrlData, err := databasePersistence.GetUrlData(context.Background(), shortSlug)
+			if err != nil || foundUrlData.RealUrl != "http://db-batch-real-url.com/"+shortSlug ||
+				!foundUrlData.Tags.HasTag("batch") || foundUrlData.Host != "db-batch-real-url.com" {
+				t.Errorf("Expected the url data of short slug: %s to be saved, got: %v, error: %v.", shortSlug,
+					foundUrlData, err)
+			}
+		}
+	})
+}
+
+func TestDatabaseSaveUrlDataBatchInChunks(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		linkBatchSaver := optionalInterfaces(databasePersistence).(storage.LinkBatchSaver)
+		var shortSlugs []string
+		for i := 0; i < 250; i++ {
+			shortSlugs = append(shortSlugs, fmt.Sprintf("batch-%d", i))
+		}
+		databasePersistence.SaveUrlData(context.Background(),
+			newBatchTestUrlData(time.Now().Add(time.Hour), "batch-150")[0])
+
+		for _, allOrNothing := range []bool{true, false} {
+			errs := linkBatchSaver.SaveUrlDataBatch(context.Background(),
+				newBatchTestUrlData(time.Now().Add(time.Hour), shortSlugs...), allOrNothing)
+
+			for i, err := range errs {
+				if (i == 150) != (err == storage.ErrDuplicate) || (i != 150 && !allOrNothing && err != nil) {
+					t.Fatalf("Unexpected error: %v for url data: %d, all or nothing: %v.", err, i, allOrNothing)
+				}
+			}
+		}
+
+		listed, err := optionalInterfaces(databasePersistence).(storage.LinkLister).ListUrlData(context.Background(),
+			storage.UrlDataQuery{Tag: "batch"})
+		if err != nil || len(listed) != len(shortSlugs) {
+			t.Errorf("Expected %d saved url data, got: %d, error: %v.", len(shortSlugs), len(listed), err)
+		}
+	})
+}
+
+func TestDatabaseSaveUrlDataBatchAllOrNothing(t *testing.T) {
+	forEachDatabasePersistence(t, func(t *testing.T, databasePersistence storage.DatabasePersistence) {
+		linkBatchSaver := optionalInterfaces(databasePersistence).(storage.LinkBatchSaver)
+		databasePersistence.SaveUrlData(context.Background(),
+			newBatchTestUrlData(time.Now().Add(time.Hour), "batch-taken")[0])
+
+		urlData := newBatchTestUrlData(time.Now().Add(time.Hour), "batch-1", "batch-taken", "batch-2")
+		errs := linkBatchSaver.SaveUrlDataBatch(context.Background(), urlData, true)
+
+		expectedErrs := []error{storage.ErrBatchAborted, storage.ErrDuplicate, storage.ErrBatchAborted}
+		if !reflect.DeepEqual(errs, expectedErrs) {
+			t.Fatalf("Expected errors: %v, got: %v.", expectedErrs, errs)
+		}
+		for _, shortSlug := range []string{"batch-1", "batch-2"} {
+			if _, err := databasePersistence.GetUrlData(context.Background(), shortSlug); err != storage.ErrNotFound {
+				t.Errorf("Expected the url data of short slug: %s not to be saved, got error: %v.", shortSlug, err)
+			}
+		}
+
+		errs = linkBatchSaver.SaveUrlDataBatch(context.Background(), append(urlData[:1], urlData[2]), true)
+		if !reflect.DeepEqual(errs, []error{nil, nil}) {
+			t.Errorf("Expected the whole batch to be saved, got errors: %v.", errs)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when there is no url data for the short slug.
+	ErrNotFound = errors.New("short slug not found")
+
+	// ErrDuplicate is returned when the short slug is already taken by a url data which has not expired.
+	ErrDuplicate = errors.New("short slug already exists")
+
+	// ErrExpired is returned when the url data for the short slug exists, but it has expired.
+	ErrExpired = errors.New("short slug has expired")
+
+	// ErrUnavailable is returned when a backend cannot be reached or fails to execute the operation.
+	// The original backend error is wrapped in the message, so it can be logged.
+	ErrUnavailable = errors.New("storage unavailable")
+
+	// ErrBatchAborted is returned for the url data of an all-or-nothing batch which has not been saved,
+	// because another url data of the batch has failed.
+	ErrBatchAborted = errors.New("batch aborted")
+
+	// ErrUnknownSlug is returned by the cache when the short slug has recently been looked up and not found.
+	// It wraps ErrNotFound, so the callers which do not care about negative caching treat it as a cache miss.
+	ErrUnknownSlug = fmt.Errorf("%w: cached as unknown", ErrNotFound)
+
+	// ErrUnsupported is returned when the configured database backend does not implement an optional operation.
+	ErrUnsupported = errors.New("not supported by the database backend")
+)
+
+// unavailable wraps a backend error as ErrUnavailable.
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"sync"
+	"time"
+)
+
+// Used when ExpirySweeper.IntervalMillis and ExpirySweeper.BatchSize are not configured.
+// The interval matches the expires_check event which the sweeper replaces.
+const (
+	defaultExpirySweeperInterval  = 24 * time.Hour
+	defaultExpirySweeperBatchSize = 1000
+)
+
+// expiryEventDropper is implemented by the databases which have removed the expired url data
+// with a scheduled event before the ExpirySweeper.
+type expiryEventDropper interface {
+	dropExpiryEvent(ctx context.Context) error
+}
+
+// ExpirySweeper periodically removes the expired url data from the database.
+// It replaces the database specific scheduled events, so it works the same for every DatabasePersistence.
+// The url data is removed in batches until a batch comes back short, so a large backlog does not hold
+// a long running statement. Between two sweeps the expired url data is still treated as missing by the backends.
+type ExpirySweeper struct {
+	databasePersistence DatabasePersistence
+	interval            time.Duration
+	batchSize           int
+	databaseTimeout     time.Duration
+	expiredUrlDataPolicy
+	stop      chan struct{}
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	mutex     sync.Mutex
+	started   bool
+	removed   int
+	lastSweep time.Time
+}
+
+func NewExpirySweeper(configuration util.Configuration, databasePersistence DatabasePersistence) *ExpirySweeper {
+	expirySweeper := new(ExpirySweeper)
+
+	expirySweeper.databasePersistence = databasePersistence
+	expirySweeper.interval = time.Duration(configuration.ExpirySweeper.IntervalMillis) * time.Millisecond
+	if expirySweeper.interval == 0 {
+		expirySweeper.interval = defaultExpirySweeperInterval
+	}
+	expirySweeper.batchSize = configuration.ExpirySweeper.BatchSize
+	if expirySweeper.batchSize <= 0 {
+		expirySweeper.batchSize = defaultExpirySweeperBatchSize
+	}
+	expirySweeper.databaseTimeout = time.Duration(configuration.Storage.DatabaseTimeoutMillis) * time.Millisecond
+	expirySweeper.expiredUrlDataPolicy = newExpiredUrlDataPolicy(configuration)
+	expirySweeper.stop = make(chan struct{})
+	expirySweeper.stopped = make(chan struct{})
+
+	return expirySweeper
+}
+
+// Start sweeps right away and then on every interval until Stop is called.
+// The scheduled event of the database is dropped first, as the sweeper takes over its job.
+// With a negative interval it does nothing, Sweep can still be called directly.
+func (expirySweeper *ExpirySweeper) Start() {
+	if expirySweeper.interval <= 0 {
+		return
+	}
+
+	expirySweeper.mutex.Lock()
+	expirySweeper.started = true
+	expirySweeper.mutex.Unlock()
+
+	go expirySweeper.run()
+}
+
+// Stop stops the sweeper and waits for a sweep in progress to finish its current batch.
+// It is safe to call more than once.
+func (expirySweeper *ExpirySweeper) Stop() {
+	expirySweeper.stopOnce.Do(func() {
+		close(expirySweeper.stop)
+	})
+
+	expirySweeper.mutex.Lock()
+	started := expirySweeper.started
+	expirySweeper.mutex.Unlock()
+
+	if started {
+		<-expirySweeper.stopped
+	}
+}
+
+// Sweep removes all the url data whose short slug can be reused and returns how many rows have been removed.
+// The url data which has expired less than the reuse cooldown ago is kept, so that it still holds its short slug.
+// It stops between the batches when the context is done.
+func (expirySweeper *ExpirySweeper) Sweep(ctx context.Context) (int, error) {
+	removed := 0
+	expiredBefore := expirySweeper.reusableExpiredBefore()
+
+	for ctx.Err() == nil {
+		batchCtx, cancel := withTimeout(ctx, expirySweeper.databaseTimeout)
+		batchRemoved, err := expirySweeper.databasePersistence.DeleteExpiredUrlData(batchCtx, expiredBefore,
+			expirySweeper.batchSize)
+		cancel()
+
+		removed += batchRemoved
+		if err != nil {
+			expirySweeper.record(removed)
+			return removed, err
+		}
+		if batchRemoved < expirySweeper.batchSize {
+			break
+		}
+	}
+
+	expirySweeper.record(removed)
+	return removed, ctx.Err()
+}
+
+// Stats returns how many rows the sweeper has removed since it was created and when it has last swept.
+func (expirySweeper *ExpirySweeper) Stats() Stats {
+	expirySweeper.mutex.Lock()
+	defer expirySweeper.mutex.Unlock()
+
+	return Stats{
+		"database.expiry_sweeper.removed":    expirySweeper.removed,
+		"database.expiry_sweeper.last_sweep": expirySweeper.lastSweep,
+	}
+}
+
+func (expirySweeper *ExpirySweeper) run() {
+	defer close(expirySweeper.stopped)
+
+	// The context is cancelled on Stop, so a sweep of a large backlog does not delay the shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-expirySweeper.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	expirySweeper.dropExpiryEvent(ctx)
+
+	ticker := time.NewTicker(expirySweeper.interval)
+	defer ticker.Stop()
+
+	for {
+		expirySweeper.sweepAndLog(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-expirySweeper.stop:
+			return
+		}
+	}
+}
+
+func (expirySweeper *ExpirySweeper) dropExpiryEvent(ctx context.Context) {
+	eventDropper, ok := expirySweeper.databasePersistence.(expiryEventDropper)
+	if !ok {
+		return
+	}
+
+	dropCtx, cancel := withTimeout(ctx, expirySweeper.databaseTimeout)
+	defer cancel()
+	if err := eventDropper.dropExpiryEvent(dropCtx); err != nil {
+		log.Printf("Error in ExpirySweeper.dropExpiryEvent(): %v.\n", err)
+	}
+}
+
+func (expirySweeper *ExpirySweeper) sweepAndLog(ctx context.Context) {
+	removed, err := expirySweeper.Sweep(ctx)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Error in ExpirySweeper.Sweep(): %v.\n", err)
+	}
+	if removed > 0 {
+		log.Printf("ExpirySweeper removed %d expired url data.\n", removed)
+	}
+}
+
+func (expirySweeper *ExpirySweeper) record(removed int) {
+	expirySweeper.mutex.Lock()
+	defer expirySweeper.mutex.Unlock()
+
+	expirySweeper.removed += removed
+	expirySweeper.lastSweep = time.Now()
+}
@@ -0,0 +1,139 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	testing_utils "github.com/gdgenchev/urlshortener/internal/testing"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestExpirySweeper(intervalMillis int, batchSize int) (*storage.ExpirySweeper,
+	*storage.MemoryDatabasePersistence) {
+	var configuration util.Configuration
+	configuration.ExpirySweeper.IntervalMillis = intervalMillis
+	configuration.ExpirySweeper.BatchSize = batchSize
+
+	memoryDatabasePersistence := storage.NewMemoryDatabasePersistence()
+	return storage.NewExpirySweeper(configuration, memoryDatabasePersistence), memoryDatabasePersistence
+}
+
+func saveSweeperTestUrlData(databasePersistence storage.DatabasePersistence, count int, expires time.Time) {
+	for i := 0; i < count; i++ {
+		databasePersistence.SaveUrlData(context.Background(), model.UrlData{
+			ShortSlug: "sweeper-" + expires.Format("150405.000") + "-" + strconv.Itoa(i),
+			RealUrl:   "http://sweeper-real-url.com",
+			Expires:   model.CustomTime{Time: expires}})
+	}
+}
+
+func TestExpirySweeperRemovesExpiredUrlDataInBatches(t *testing.T) {
+	expirySweeper, memoryDatabasePersistence := newTestExpirySweeper(0, 2)
+	saveSweeperTestUrlData(memoryDatabasePersistence, 5, time.Now().Add(-time.Minute))
+	saveSweeperTestUrlData(memoryDatabasePersistence, 1, time.Now().Add(time.Hour))
+
+	removed, err := expirySweeper.Sweep(context.Background())
+	if err != nil || removed != 5 {
+		t.Fatalf("Expected the sweep to remove 5 url data, got: %d, error: %v.", removed, err)
+	}
+
+	if remaining, _ := memoryDatabasePersistence.DeleteExpiredUrlData(context.Background(),
+		time.Now().Add(2*time.Hour), 10); remaining != 1 {
+		t.Errorf("Expected the url data which has not expired to remain, got: %d.", remaining)
+	}
+
+	if stats := expirySweeper.Stats(); stats["database.expiry_sweeper.removed"] != 5 {
+		t.Errorf("Unexpected expiry sweeper stats: %v.", stats)
+	}
+}
+
+func TestExpirySweeperReportsDatabaseErrors(t *testing.T) {
+	var configuration util.Configuration
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	expirySweeper := storage.NewExpirySweeper(configuration, databasePersistence)
+
+	databasePersistence.SetDown(true)
+
+	if _, err := expirySweeper.Sweep(context.Background()); err == nil {
+		t.Errorf("Expected the sweep to fail while the database is unavailable.")
+	}
+}
+
+func TestExpirySweeperSweepsPeriodicallyUntilStopped(t *testing.T) {
+	expirySweeper, memoryDatabasePersistence := newTestExpirySweeper(10, 100)
+	expirySweeper.Start()
+
+	saveSweeperTestUrlData(memoryDatabasePersistence, 3, time.Now().Add(-time.Minute))
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		expirySweeper.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("The expiry sweeper did not stop.")
+	}
+
+	if stats := expirySweeper.Stats(); stats["database.expiry_sweeper.removed"] != 3 {
+		t.Errorf("Expected the periodic sweeps to remove 3 url data, got stats: %v.", stats)
+	}
+
+	// The sweeper is stopped, so the url data expiring from now on stays
+	saveSweeperTestUrlData(memoryDatabasePersistence, 1, time.Now().Add(-time.Minute))
+	time.Sleep(30 * time.Millisecond)
+	if stats := expirySweeper.Stats(); stats["database.expiry_sweeper.removed"] != 3 {
+		t.Errorf("The expiry sweeper removed url data after it was stopped: %v.", stats)
+	}
+
+	expirySweeper.Stop()
+}
+
+func TestExpirySweeperKeepsUrlDataWithinReuseCooldown(t *testing.T) {
+	var configuration util.Configuration
+	configuration.ExpiredUrlData.ReuseCooldownMinutes = 60
+
+	memoryDatabasePersistence := storage.NewMemoryDatabasePersistence()
+	expirySweeper := storage.NewExpirySweeper(configuration, memoryDatabasePersistence)
+	saveSweeperTestUrlData(memoryDatabasePersistence, 2, time.Now().Add(-2*time.Hour))
+	saveSweeperTestUrlData(memoryDatabasePersistence, 3, time.Now().Add(-time.Minute))
+
+	removed, err := expirySweeper.Sweep(context.Background())
+	if err != nil || removed != 2 {
+		t.Errorf("Expected the sweep to remove only the url data past its reuse cooldown, got: %d, error: %v.",
+			removed, err)
+	}
+}
+
+func TestExpirySweeperStartsWithDefaultInterval(t *testing.T) {
+	expirySweeper, memoryDatabasePersistence := newTestExpirySweeper(0, 100)
+	saveSweeperTestUrlData(memoryDatabasePersistence, 2, time.Now().Add(-time.Minute))
+
+	// Without a configured interval the sweeper still sweeps right away on start
+	expirySweeper.Start()
+	deadline := time.Now().Add(time.Second)
+	for expirySweeper.Stats()["database.expiry_sweeper.removed"] != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expirySweeper.Stop()
+
+	if stats := expirySweeper.Stats(); stats["database.expiry_sweeper.removed"] != 2 {
+		t.Errorf("Expected the sweeper to remove 2 url data without a configured interval, got stats: %v.", stats)
+	}
+
+	disabledSweeper, memoryDatabasePersistence := newTestExpirySweeper(-1, 100)
+	saveSweeperTestUrlData(memoryDatabasePersistence, 1, time.Now().Add(-time.Minute))
+	disabledSweeper.Start()
+	time.Sleep(30 * time.Millisecond)
+	disabledSweeper.Stop()
+
+	if stats := disabledSweeper.Stats(); stats["database.expiry_sweeper.removed"] != 0 {
+		t.Errorf("Expected a sweeper with a negative interval not to sweep, got stats: %v.", stats)
+	}
+}
@@ -0,0 +1,707 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// slugKeysChunkSize bounds the number of short slugs in a single IN clause or INSERT statement.
+const slugKeysChunkSize = 500
+
+// urlDataBatchChunkSize bounds the number of rows in a single INSERT, so that the bound values of a statement
+// stay within the limit of every database.
+const urlDataBatchChunkSize = 100
+
+// slugKey is a row of the slug_keys table - a short slug which has been generated in advance and is not taken.
+type slugKey struct {
+	ShortSlug string `gorm:"column:short_slug; primary_key"`
+}
+
+func (slugKey) TableName() string {
+	return "slug_keys"
+}
+
+// gormPersistence implements the DatabasePersistence methods which are common for the gorm backed databases.
+// Expire times are compared against a time passed from Go instead of a database specific NOW() function
+// and they are stored in UTC, so that the comparison is correct for databases storing the times as text.
+type gormPersistence struct {
+	db *gorm.DB
+	// isDuplicateKeyError reports whether the driver error is a primary key violation.
+	isDuplicateKeyError func(err error) bool
+	// replicaPool serves the lookups when it is set. SaveUrlData and the removal of the expired url data
+	// stay on the primary, so the uniqueness of the short slugs is checked against the up to date data.
+	replicaPool *ReplicaPool
+	expiredUrlDataPolicy
+}
+
+// SaveUrlData saves the url data in the database.
+// The short slug is reserved atomically by the primary key constraint, so concurrent saves
+// of the same short slug, even from different instances, result in exactly one success.
+// Returns ErrDuplicate if the url short slug already exists or has expired less than the reuse cooldown ago.
+func (gormPersistence *gormPersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	//Workaround for an expired url, but not yet removed by the sweeper
+	_, err := gormPersistence.removeExpiredUrlData(ctx, []string{urlData.ShortSlug},
+		gormPersistence.reusableExpiredBefore().UTC())
+	if err != nil {
+		return err
+	}
+
+	urlData = prepareUrlDataForSave(urlData)
+	urlData.Expires.Time = urlData.Expires.UTC()
+	err = gormPersistence.withContext(ctx).Create(&urlData).Error
+	if err != nil {
+		if gormPersistence.isDuplicateKeyError(err) {
+			return ErrDuplicate
+		}
+		return unavailable(err)
+	}
+
+	return nil
+}
+
+// SaveUrlDataBatch saves the url data on the primary with INSERT statements of at most urlDataBatchChunkSize rows.
+// The taken short slugs are looked up first and get ErrDuplicate, so that a statement fails only
+// if one of its short slugs is taken concurrently. The rows of such a statement are saved one by one,
+// while with allOrNothing the whole batch, which is saved in a single transaction, is rolled back.
+func (gormPersistence *gormPersistence) SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData,
+	allOrNothing bool) []error {
+	shortSlugs := make([]string, 0, len(urlData))
+	for _, batchUrlData := range urlData {
+		shortSlugs = append(shortSlugs, batchUrlData.ShortSlug)
+	}
+
+	//Workaround for the expired url data, but not yet removed by the sweeper
+	reusableExpiredBefore := gormPersistence.reusableExpiredBefore().UTC()
+	for _, chunk := range chunkShortSlugs(shortSlugs, slugKeysChunkSize) {
+		if _, err := gormPersistence.removeExpiredUrlData(ctx, chunk, reusableExpiredBefore); err != nil {
+			return batchErrors(len(urlData), err)
+		}
+	}
+
+	taken, err := gormPersistence.takenShortSlugs(ctx, shortSlugs)
+	if err != nil {
+		return batchErrors(len(urlData), err)
+	}
+
+	errs := make([]error, len(urlData))
+	var pending []model.UrlData
+	var pendingIndexes []int
+	for i, batchUrlData := range urlData {
+		if taken[batchUrlData.ShortSlug] {
+			errs[i] = ErrDuplicate
+			continue
+		}
+		// A later url data with the same short slug is a duplicate of this one
+		taken[batchUrlData.ShortSlug] = true
+		pending = append(pending, batchUrlData)
+		pendingIndexes = append(pendingIndexes, i)
+	}
+
+	if allOrNothing {
+		if len(pending) < len(urlData) {
+			return abortBatch(errs)
+		}
+		return gormPersistence.saveUrlDataInTransaction(ctx, urlData, shortSlugs)
+	}
+
+	for start := 0; start < len(pending); start += urlDataBatchChunkSize {
+		end := start + urlDataBatchChunkSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+
+		err := insertUrlData(gormPersistence.withContext(ctx), pending[start:end])
+		for j := start; j < end && err != nil; j++ {
+			if gormPersistence.isDuplicateKeyError(err) {
+				errs[pendingIndexes[j]] = gormPersistence.SaveUrlData(ctx, pending[j])
+			} else {
+				errs[pendingIndexes[j]] = unavailable(err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// saveUrlDataInTransaction saves every url data of the batch or none of them. If a short slug has been taken
+// concurrently, the taken short slugs are looked up again to report them as ErrDuplicate.
+func (gormPersistence *gormPersistence) saveUrlDataInTransaction(ctx context.Context, urlData []model.UrlData,
+	shortSlugs []string) []error {
+	tx := gormPersistence.withContext(ctx).BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return batchErrors(len(urlData), unavailable(tx.Error))
+	}
+
+	for start := 0; start < len(urlData); start += urlDataBatchChunkSize {
+		end := start + urlDataBatchChunkSize
+		if end > len(urlData) {
+			end = len(urlData)
+		}
+
+		err := insertUrlData(tx, urlData[start:end])
+		if err == nil {
+			continue
+		}
+		tx.Rollback()
+		if !gormPersistence.isDuplicateKeyError(err) {
+			return batchErrors(len(urlData), unavailable(err))
+		}
+
+		taken, err := gormPersistence.takenShortSlugs(ctx, shortSlugs)
+		if err != nil {
+			return batchErrors(len(urlData), err)
+		}
+		errs := make([]error, len(urlData))
+		for i, batchUrlData := range urlData {
+			if taken[batchUrlData.ShortSlug] {
+				errs[i] = ErrDuplicate
+			}
+		}
+		return abortBatch(errs)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return batchErrors(len(urlData), unavailable(err))
+	}
+
+	return make([]error, len(urlData))
+}
+
+// insertUrlData saves the url data with a single INSERT statement, as gorm inserts a single row at a time.
+func insertUrlData(db *gorm.DB, urlData []model.UrlData) error {
+	rows := make([]string, 0, len(urlData))
+	values := make([]interface{}, 0, 7*len(urlData))
+	for _, batchUrlData := range urlData {
+		batchUrlData = prepareUrlDataForSave(batchUrlData)
+		rows = append(rows, "(?, ?, ?, ?, ?, ?, ?)")
+		values = append(values, batchUrlData.ShortSlug, batchUrlData.RealUrl, batchUrlData.Expires.UTC(),
+			batchUrlData.Owner, batchUrlData.Tags, batchUrlData.Host, batchUrlData.CreatedAt)
+	}
+
+	return db.Exec("INSERT INTO url_data (short_slug, real_url, expires, owner, tags, host, created_at) VALUES "+
+		strings.Join(rows, ", "), values...).Error
+}
+
+// GetUrlData retrieves the url data given a short slug, from a read replica if there is a healthy one.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+// A replica may lag behind the primary, so a short slug missing or expired on the replica is looked up
+// on the primary before it is reported as such. A failing replica is taken out of rotation and the primary
+// is used instead.
+func (gormPersistence *gormPersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	if replica := gormPersistence.replicaPool.Next(); replica != nil {
+		urlData, err := getUrlData(ctx, replica, shortSlug)
+		if err == nil {
+			return urlData, nil
+		}
+		if errors.Is(err, ErrUnavailable) {
+			if ctx.Err() != nil {
+				return urlData, err
+			}
+			gormPersistence.replicaPool.MarkUnhealthy(replica)
+		}
+	}
+
+	return getUrlData(ctx, gormPersistence.db, shortSlug)
+}
+
+func getUrlData(ctx context.Context, db *gorm.DB, shortSlug string) (model.UrlData, error) {
+	var urlData model.UrlData
+	err := withContext(ctx, db).Where("short_slug = ?", shortSlug).First(&urlData).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model.UrlData{}, ErrNotFound
+	}
+	if err != nil {
+		return model.UrlData{}, unavailable(err)
+	}
+
+	if isExpired(urlData) {
+		return model.UrlData{}, ErrExpired
+	}
+
+	return urlData, nil
+}
+
+// Exists checks whether the short slug is present in the database and has not expired.
+func (gormPersistence *gormPersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	return existsByGetUrlData(gormPersistence.GetUrlData(ctx, shortSlug))
+}
+
+// DeleteExpiredUrlData deletes at most limit url data which has expired before the provided time,
+// moving it to the archive if archiving is enabled.
+// LIMIT in a DELETE statement is not portable, so the short slugs of the batch are selected first.
+func (gormPersistence *gormPersistence) DeleteExpiredUrlData(ctx context.Context, expiredBefore time.Time,
+	limit int) (int, error) {
+	expiredBefore = expiredBefore.UTC()
+
+	var shortSlugs []string
+	err := gormPersistence.withContext(ctx).Model(&model.UrlData{}).Where("expires <= ?", expiredBefore).
+		Limit(limit).Pluck("short_slug", &shortSlugs).Error
+	if err != nil {
+		return 0, unavailable(err)
+	}
+	if len(shortSlugs) == 0 {
+		return 0, nil
+	}
+
+	return gormPersistence.removeExpiredUrlData(ctx, shortSlugs, expiredBefore)
+}
+
+// GetArchivedUrlData retrieves the archived url data of the short slug, newest first.
+func (gormPersistence *gormPersistence) GetArchivedUrlData(ctx context.Context,
+	shortSlug string) ([]model.ArchivedUrlData, error) {
+	archivedUrlData := []model.ArchivedUrlData{}
+	err := gormPersistence.withContext(ctx).Where("short_slug = ?", shortSlug).Order("archived_at desc, id desc").
+		Find(&archivedUrlData).Error
+	if err != nil {
+		return nil, unavailable(err)
+	}
+
+	return archivedUrlData, nil
+}
+
+// SaveSlugKeys adds the short slugs which are not taken by an url data, even an expired one, to the slug key pool.
+// Every chunk is added with a single INSERT statement, which skips the short slugs that are already in the pool.
+func (gormPersistence *gormPersistence) SaveSlugKeys(ctx context.Context, shortSlugs []string) (int, error) {
+	saved := 0
+	for _, chunk := range chunkShortSlugs(shortSlugs, slugKeysChunkSize) {
+		taken, err := gormPersistence.takenShortSlugs(ctx, chunk)
+		if err != nil {
+			return saved, err
+		}
+
+		rows := make([]string, 0, len(chunk))
+		values := make([]interface{}, 0, len(chunk))
+		for _, shortSlug := range chunk {
+			if !taken[shortSlug] {
+				rows = append(rows, "(?)")
+				values = append(values, shortSlug)
+			}
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		result := gormPersistence.withContext(ctx).Exec(gormPersistence.ignoringDuplicates(
+			"INSERT INTO slug_keys (short_slug) VALUES "+strings.Join(rows, ", ")), values...)
+		if result.Error != nil {
+			return saved, unavailable(result.Error)
+		}
+		saved += int(result.RowsAffected)
+	}
+
+	return saved, nil
+}
+
+// ClaimSlugKeys takes at most limit short slugs out of the slug key pool.
+// Postgres deletes the rows and returns them in a single statement. MySQL locks the selected rows until they are
+// deleted and skips the rows locked by the other claimers, which needs MySQL 8. SQLite serializes the transactions,
+// as it is opened with a single connection. Either way the instances claiming at the same time never get
+// the same short slug and do not wait for each other.
+func (gormPersistence *gormPersistence) ClaimSlugKeys(ctx context.Context, limit int) ([]string, error) {
+	var claimed []slugKey
+	if gormPersistence.db.Dialect().GetName() == "postgres" {
+		err := gormPersistence.withContext(ctx).Raw("DELETE FROM slug_keys WHERE short_slug IN "+
+			"(SELECT short_slug FROM slug_keys LIMIT ? FOR UPDATE SKIP LOCKED) RETURNING short_slug", limit).
+			Scan(&claimed).Error
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		return slugKeysToShortSlugs(claimed), nil
+	}
+
+	tx := gormPersistence.withContext(ctx).Begin()
+	if tx.Error != nil {
+		return nil, unavailable(tx.Error)
+	}
+	query := tx.Limit(limit)
+	if gormPersistence.db.Dialect().GetName() == "mysql" {
+		query = query.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED")
+	}
+	if err := query.Find(&claimed).Error; err != nil {
+		tx.Rollback()
+		return nil, unavailable(err)
+	}
+
+	shortSlugs := slugKeysToShortSlugs(claimed)
+	if len(shortSlugs) > 0 {
+		if err := tx.Where("short_slug IN (?)", shortSlugs).Delete(slugKey{}).Error; err != nil {
+			tx.Rollback()
+			return nil, unavailable(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, unavailable(err)
+	}
+
+	return shortSlugs, nil
+}
+
+// CountSlugKeys returns how many short slugs are left in the slug key pool.
+func (gormPersistence *gormPersistence) CountSlugKeys(ctx context.Context) (int, error) {
+	count := 0
+	if err := gormPersistence.withContext(ctx).Model(&slugKey{}).Count(&count).Error; err != nil {
+		return 0, unavailable(err)
+	}
+
+	return count, nil
+}
+
+// CountShortSlugs returns how many url data, even expired ones, have a short slug of the length.
+// The short slugs are ASCII, so their length in bytes is their length in symbols. It scans the url data,
+// as there is no index on the length.
+func (gormPersistence *gormPersistence) CountShortSlugs(ctx context.Context, length int) (int, error) {
+	count := 0
+	err := gormPersistence.withContext(ctx).Model(&model.UrlData{}).Where("LENGTH(short_slug) = ?", length).
+		Count(&count).Error
+	if err != nil {
+		return 0, unavailable(err)
+	}
+
+	return count, nil
+}
+
+// takenShortSlugs returns which of the short slugs are taken by an url data, even an expired one.
+// The short slugs are looked up in chunks of at most slugKeysChunkSize.
+func (gormPersistence *gormPersistence) takenShortSlugs(ctx context.Context,
+	shortSlugs []string) (map[string]bool, error) {
+	taken := make(map[string]bool, len(shortSlugs))
+	for _, chunk := range chunkShortSlugs(shortSlugs, slugKeysChunkSize) {
+		var takenChunk []string
+		err := gormPersistence.withContext(ctx).Model(&model.UrlData{}).Where("short_slug IN (?)", chunk).
+			Pluck("short_slug", &takenChunk).Error
+		if err != nil {
+			return nil, unavailable(err)
+		}
+		for _, shortSlug := range takenChunk {
+			taken[shortSlug] = true
+		}
+	}
+
+	return taken, nil
+}
+
+// ignoringDuplicates makes the INSERT statement skip the rows whose short slug is already taken
+// instead of failing. The other errors, like a too long value, still fail the statement.
+func (gormPersistence *gormPersistence) ignoringDuplicates(insert string) string {
+	if gormPersistence.db.Dialect().GetName() == "mysql" {
+		return insert + " ON DUPLICATE KEY UPDATE short_slug = short_slug"
+	}
+
+	// Postgres and SQLite since 3.24
+	return insert + " ON CONFLICT DO NOTHING"
+}
+
+// chunkShortSlugs splits the short slugs into chunks of at most size short slugs.
+func chunkShortSlugs(shortSlugs []string, size int) [][]string {
+	var chunks [][]string
+	for start := 0; start < len(shortSlugs); start += size {
+		end := start + size
+		if end > len(shortSlugs) {
+			end = len(shortSlugs)
+		}
+		chunks = append(chunks, shortSlugs[start:end])
+	}
+
+	return chunks
+}
+
+func slugKeysToShortSlugs(slugKeys []slugKey) []string {
+	shortSlugs := make([]string, 0, len(slugKeys))
+	for _, slugKey := range slugKeys {
+		shortSlugs = append(shortSlugs, slugKey.ShortSlug)
+	}
+
+	return shortSlugs
+}
+
+// GetUrlDataFromPrimary retrieves the url data given a short slug from the primary, which has every change.
+func (gormPersistence *gormPersistence) GetUrlDataFromPrimary(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	return getUrlData(ctx, gormPersistence.db, shortSlug)
+}
+
+// UpdateUrlData replaces the real url, the expire time and the tags of the short slug on the primary,
+// the owner and the creation time are kept.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+// If archiving is enabled, the replaced url data is archived in the same transaction, which locks its row
+// until then, so that a concurrent update does not archive the same url data.
+func (gormPersistence *gormPersistence) UpdateUrlData(ctx context.Context, urlData model.UrlData) error {
+	fields := map[string]interface{}{"real_url": urlData.RealUrl, "host": model.UrlHost(urlData.RealUrl),
+		"expires": urlData.Expires.UTC(), "tags": urlData.Tags}
+	if !gormPersistence.archive {
+		return gormPersistence.changeUrlData(ctx, gormPersistence.withContext(ctx), urlData.ShortSlug, fields)
+	}
+
+	tx := gormPersistence.withContext(ctx).BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return unavailable(tx.Error)
+	}
+
+	// SQLite does not lock rows, but it is opened with a single connection, so its transactions are serialized
+	query := tx.Where("short_slug = ?", urlData.ShortSlug).Where("expires > ?", time.Now().UTC())
+	if gormPersistence.db.Dialect().GetName() != "sqlite3" {
+		query = query.Set("gorm:query_option", "FOR UPDATE")
+	}
+	var replacedUrlData model.UrlData
+	if err := query.First(&replacedUrlData).Error; err != nil {
+		tx.Rollback()
+		if gorm.IsRecordNotFoundError(err) {
+			_, err = getUrlData(ctx, gormPersistence.db, urlData.ShortSlug)
+			if err == nil {
+				// The short slug has been saved again since it was selected
+				err = ErrNotFound
+			}
+			return err
+		}
+		return unavailable(err)
+	}
+
+	if err := gormPersistence.changeUrlData(ctx, tx, urlData.ShortSlug, fields); err != nil {
+		tx.Rollback()
+		return err
+	}
+	archivedUrlData := model.NewArchivedUrlData(replacedUrlData, time.Now().UTC())
+	if err := tx.Create(&archivedUrlData).Error; err != nil {
+		tx.Rollback()
+		return unavailable(err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return unavailable(err)
+	}
+	return nil
+}
+
+// DeleteUrlData makes the url data of the short slug expire now on the primary, so that it stops redirecting,
+// but its short slug is not reused before the reuse cooldown and it is archived when it is removed.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+func (gormPersistence *gormPersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	return gormPersistence.changeUrlData(ctx, gormPersistence.withContext(ctx), shortSlug,
+		map[string]interface{}{"expires": time.Now().UTC()})
+}
+
+// changeUrlData sets the fields of the url data of the short slug, if it has not expired.
+// Some databases report no affected rows when the values do not change, so the short slug is looked up
+// on the primary before it is reported as missing or expired.
+func (gormPersistence *gormPersistence) changeUrlData(ctx context.Context, db *gorm.DB, shortSlug string,
+	fields map[string]interface{}) error {
+	result := db.Model(&model.UrlData{}).Where("short_slug = ?", shortSlug).Where("expires > ?", time.Now().UTC()).
+		Updates(fields)
+	if result.Error != nil {
+		return unavailable(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	_, err := getUrlData(ctx, gormPersistence.db, shortSlug)
+	return err
+}
+
+// ListUrlData returns the url data matching the query, even the expired one, newest first,
+// from a read replica if there is a healthy one. A failing replica is taken out of rotation
+// and the primary is used instead.
+func (gormPersistence *gormPersistence) ListUrlData(ctx context.Context, query UrlDataQuery) ([]model.UrlData, error) {
+	if replica := gormPersistence.replicaPool.Next(); replica != nil {
+		urlData, err := listUrlData(ctx, replica, query)
+		if err == nil || ctx.Err() != nil {
+			return urlData, err
+		}
+		gormPersistence.replicaPool.MarkUnhealthy(replica)
+	}
+
+	return listUrlData(ctx, gormPersistence.db, query)
+}
+
+func listUrlData(ctx context.Context, db *gorm.DB, query UrlDataQuery) ([]model.UrlData, error) {
+	statement := withContext(ctx, db)
+	if query.Owner != "" {
+		statement = statement.Where("owner = ?", query.Owner)
+	}
+	if !query.CreatedFrom.IsZero() {
+		statement = statement.Where("created_at >= ?", query.CreatedFrom.UTC())
+	}
+	if !query.CreatedTo.IsZero() {
+		statement = statement.Where("created_at < ?", query.CreatedTo.UTC())
+	}
+	if !query.ExpiresFrom.IsZero() {
+		statement = statement.Where("expires >= ?", query.ExpiresFrom.UTC())
+	}
+	if !query.ExpiresTo.IsZero() {
+		statement = statement.Where("expires < ?", query.ExpiresTo.UTC())
+	}
+	if query.Host != "" {
+		statement = statement.Where("host = ?", strings.ToLower(query.Host))
+	}
+	if query.Tag != "" {
+		statement = statement.Where("tags LIKE ? ESCAPE '!'", "%,"+escapeLike(query.Tag)+",%")
+	}
+	if query.Search != "" {
+		search := "%" + escapeLike(strings.ToLower(query.Search)) + "%"
+		statement = statement.Where("LOWER(short_slug) LIKE ? ESCAPE '!' OR LOWER(real_url) LIKE ? ESCAPE '!'",
+			search, search)
+	}
+	if query.AfterShortSlug != "" {
+		afterCreatedAt := query.AfterCreatedAt.UTC()
+		statement = statement.Where("created_at < ? OR (created_at = ? AND short_slug < ?)",
+			afterCreatedAt, afterCreatedAt, query.AfterShortSlug)
+	}
+	if query.Limit > 0 {
+		statement = statement.Limit(query.Limit)
+	}
+
+	urlData := []model.UrlData{}
+	if err := statement.Order("created_at desc, short_slug desc").Find(&urlData).Error; err != nil {
+		return nil, unavailable(err)
+	}
+
+	return urlData, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern with '!', which is portable unlike the backslash.
+func escapeLike(pattern string) string {
+	return likeEscaper.Replace(pattern)
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// SaveApiKey saves the api key. Returns ErrDuplicate if there is an api key with the same hash.
+func (gormPersistence *gormPersistence) SaveApiKey(ctx context.Context, apiKey model.ApiKey) error {
+	apiKey.CreatedAt = apiKey.CreatedAt.UTC()
+	err := gormPersistence.withContext(ctx).Create(&apiKey).Error
+	if err != nil {
+		if gormPersistence.isDuplicateKeyError(err) {
+			return ErrDuplicate
+		}
+		return unavailable(err)
+	}
+
+	return nil
+}
+
+// GetApiKey retrieves the api key given its hash from the primary, so that a revoked key
+// is not accepted by a lagging replica. Returns ErrNotFound if there is no such api key.
+func (gormPersistence *gormPersistence) GetApiKey(ctx context.Context, keyHash string) (model.ApiKey, error) {
+	var apiKey model.ApiKey
+	err := gormPersistence.withContext(ctx).Where("key_hash = ?", keyHash).First(&apiKey).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model.ApiKey{}, ErrNotFound
+	}
+	if err != nil {
+		return model.ApiKey{}, unavailable(err)
+	}
+
+	return apiKey, nil
+}
+
+// DeleteApiKey revokes the api key given its hash. Returns ErrNotFound if there is no such api key.
+func (gormPersistence *gormPersistence) DeleteApiKey(ctx context.Context, keyHash string) error {
+	result := gormPersistence.withContext(ctx).Where("key_hash = ?", keyHash).Delete(model.ApiKey{})
+	if result.Error != nil {
+		return unavailable(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Close closes the database client and the read replicas.
+func (gormPersistence *gormPersistence) Close() error {
+	replicaPoolErr := gormPersistence.replicaPool.Close()
+	if err := gormPersistence.db.Close(); err != nil {
+		return err
+	}
+
+	return replicaPoolErr
+}
+
+// withContext returns a gorm handle to the primary whose statements are executed with the provided context.
+func (gormPersistence *gormPersistence) withContext(ctx context.Context) *gorm.DB {
+	return withContext(ctx, gormPersistence.db)
+}
+
+// withContext returns a gorm handle to the database whose statements are executed with the provided context.
+// gorm v1 cannot run a copy of a handle over another connection, so the handle is opened anew over the
+// connection pool of db. Only the dialect and the global update setting are carried over - the log mode,
+// the logger, the singular table names and the registered callbacks are not supported, so they must not be
+// set on db. If the handle cannot be opened, a copy of db carrying the error is returned, so the statement
+// fails with it.
+func withContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	contextDb, err := gorm.Open(db.Dialect().GetName(), &contextSQLCommon{ctx, db.DB()})
+	if err != nil {
+		failedDb := db.New()
+		failedDb.AddError(err)
+		return failedDb
+	}
+
+	return contextDb.BlockGlobalUpdate(db.HasBlockGlobalUpdate())
+}
+
+// removeExpiredUrlData deletes the url data of the short slugs which has expired before the provided time
+// and returns how many url data has been deleted.
+// The expire time is checked again on delete, in case a short slug has been saved anew in the meantime.
+func (gormPersistence *gormPersistence) removeExpiredUrlData(ctx context.Context, shortSlugs []string,
+	expiredBefore time.Time) (int, error) {
+	if gormPersistence.archive {
+		return gormPersistence.archiveExpiredUrlData(ctx, shortSlugs, expiredBefore)
+	}
+
+	result := gormPersistence.withContext(ctx).Where("short_slug IN (?)", shortSlugs).
+		Where("expires <= ?", expiredBefore).Delete(model.UrlData{})
+	if result.Error != nil {
+		return 0, unavailable(result.Error)
+	}
+
+	return int(result.RowsAffected), nil
+}
+
+// archiveExpiredUrlData moves the expired url data of the short slugs to the archive in a single transaction.
+// An url data is archived only by the transaction which has deleted it, so it is archived once
+// even if several instances remove it at the same time.
+func (gormPersistence *gormPersistence) archiveExpiredUrlData(ctx context.Context, shortSlugs []string,
+	expiredBefore time.Time) (int, error) {
+	tx := gormPersistence.withContext(ctx).BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return 0, unavailable(tx.Error)
+	}
+
+	var expiredUrlData []model.UrlData
+	err := tx.Where("short_slug IN (?)", shortSlugs).Where("expires <= ?", expiredBefore).Find(&expiredUrlData).Error
+	if err != nil {
+		tx.Rollback()
+		return 0, unavailable(err)
+	}
+
+	archivedAt := time.Now().UTC()
+	archived := 0
+	for _, urlData := range expiredUrlData {
+		result := tx.Where("short_slug = ?", urlData.ShortSlug).Where("expires <= ?", expiredBefore).
+			Delete(model.UrlData{})
+		if result.Error != nil {
+			tx.Rollback()
+			return 0, unavailable(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+
+		archivedUrlData := model.NewArchivedUrlData(urlData, archivedAt)
+		if err := tx.Create(&archivedUrlData).Error; err != nil {
+			tx.Rollback()
+			return 0, unavailable(err)
+		}
+		archived++
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, unavailable(err)
+	}
+
+	return archived, nil
+}
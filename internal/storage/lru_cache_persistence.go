@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"sync"
+	"time"
+)
+
+// LruCachePersistence is a CachePersistence decorator which keeps the most recently used url data in process memory,
+// so the hot short slugs are served without a round trip to the wrapped cache.
+// It holds at most Size entries and evicts the least recently used one when full. An entry lives for TtlMillis,
+// but never past the expire time of its url data, so a link does not outlive its expiry in any instance.
+// Writes go to the wrapped cache as well, the local copy is only a read-through shortcut.
+// If the wrapped cache tells about the deleted url data, the local copies are dropped in every instance sharing it.
+type LruCachePersistence struct {
+	cachePersistence CachePersistence
+	size             int
+	ttl              time.Duration
+	mutex            sync.Mutex
+	entries          map[string]*list.Element
+	recency          *list.List
+	hits             int
+	misses           int
+	evictions        int
+}
+
+type lruCacheEntry struct {
+	urlData   model.UrlData
+	expiresAt time.Time
+}
+
+func NewLruCachePersistence(configuration util.Configuration, cachePersistence CachePersistence) *LruCachePersistence {
+	lruCachePersistence := new(LruCachePersistence)
+
+	lruCachePersistence.cachePersistence = cachePersistence
+	lruCachePersistence.size = configuration.LocalCache.Size
+	lruCachePersistence.ttl = time.Duration(configuration.LocalCache.TtlMillis) * time.Millisecond
+	lruCachePersistence.entries = make(map[string]*list.Element)
+	lruCachePersistence.recency = list.New()
+	onDeleteUrlData(cachePersistence, lruCachePersistence.forget)
+
+	return lruCachePersistence
+}
+
+// SaveUrlData saves the url data in the wrapped cache and keeps a local copy of it.
+func (lruCachePersistence *LruCachePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	lruCachePersistence.put(urlData)
+
+	return lruCachePersistence.cachePersistence.SaveUrlData(ctx, urlData)
+}
+
+// SaveUrlDataBatch saves the url data in the wrapped cache and keeps a local copy of each of them.
+func (lruCachePersistence *LruCachePersistence) SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData) error {
+	for _, batchUrlData := range urlData {
+		lruCachePersistence.put(batchUrlData)
+	}
+
+	return lruCachePersistence.cachePersistence.SaveUrlDataBatch(ctx, urlData)
+}
+
+// SaveUnknownSlug remembers the unknown short slug in the wrapped cache only.
+// The local copies are never negative, so saving the short slug in another instance cannot leave a stale one behind.
+func (lruCachePersistence *LruCachePersistence) SaveUnknownSlug(ctx context.Context, shortSlug string,
+	expires time.Time) error {
+	return lruCachePersistence.cachePersistence.SaveUnknownSlug(ctx, shortSlug, expires)
+}
+
+// GetUrlData retrieves the url data from the local copy or, on a local miss, from the wrapped cache.
+// Returns ErrNotFound on a cache miss.
+func (lruCachePersistence *LruCachePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	if urlData, found := lruCachePersistence.get(shortSlug); found {
+		return urlData, nil
+	}
+
+	urlData, err := lruCachePersistence.cachePersistence.GetUrlData(ctx, shortSlug)
+	if err != nil {
+		return model.UrlData{}, err
+	}
+
+	lruCachePersistence.put(urlData)
+	return urlData, nil
+}
+
+// Exists checks whether the short slug is present locally or in the wrapped cache.
+func (lruCachePersistence *LruCachePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	if _, found := lruCachePersistence.get(shortSlug); found {
+		return true, nil
+	}
+
+	return lruCachePersistence.cachePersistence.Exists(ctx, shortSlug)
+}
+
+// DeleteUrlData drops the local copy and removes the url data from the wrapped cache.
+func (lruCachePersistence *LruCachePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	lruCachePersistence.forget(shortSlug)
+
+	return lruCachePersistence.cachePersistence.DeleteUrlData(ctx, shortSlug)
+}
+
+// OnDeleteUrlData registers the handler with the wrapped cache if it tells about the deleted url data.
+func (lruCachePersistence *LruCachePersistence) OnDeleteUrlData(handler func(shortSlug string)) {
+	onDeleteUrlData(lruCachePersistence.cachePersistence, handler)
+}
+
+// Close drops the local copies and closes the wrapped cache.
+func (lruCachePersistence *LruCachePersistence) Close() error {
+	lruCachePersistence.mutex.Lock()
+	lruCachePersistence.entries = make(map[string]*list.Element)
+	lruCachePersistence.recency.Init()
+	lruCachePersistence.mutex.Unlock()
+
+	return lruCachePersistence.cachePersistence.Close()
+}
+
+// Stats returns the local hit, miss and eviction counts, the number of local entries
+// and the stats of the wrapped cache.
+func (lruCachePersistence *LruCachePersistence) Stats() Stats {
+	lruCachePersistence.mutex.Lock()
+	stats := Stats{
+		"cache.local.hits":      lruCachePersistence.hits,
+		"cache.local.misses":    lruCachePersistence.misses,
+		"cache.local.evictions": lruCachePersistence.evictions,
+		"cache.local.size":      lruCachePersistence.recency.Len(),
+	}
+	lruCachePersistence.mutex.Unlock()
+
+	return collectStats(stats, lruCachePersistence.cachePersistence)
+}
+
+// get returns the local copy of the url data, dropping it if it has expired.
+func (lruCachePersistence *LruCachePersistence) get(shortSlug string) (model.UrlData, bool) {
+	lruCachePersistence.mutex.Lock()
+	defer lruCachePersistence.mutex.Unlock()
+
+	element, found := lruCachePersistence.entries[shortSlug]
+	if !found {
+		lruCachePersistence.misses++
+		return model.UrlData{}, false
+	}
+
+	entry := element.Value.(*lruCacheEntry)
+	if !entry.expiresAt.After(time.Now()) {
+		lruCachePersistence.remove(element)
+		lruCachePersistence.misses++
+		return model.UrlData{}, false
+	}
+
+	lruCachePersistence.recency.MoveToFront(element)
+	lruCachePersistence.hits++
+	return entry.urlData, true
+}
+
+// put stores a local copy of the url data, evicting the least recently used entry if the cache is full.
+func (lruCachePersistence *LruCachePersistence) put(urlData model.UrlData) {
+	if lruCachePersistence.size <= 0 {
+		return
+	}
+
+	expiresAt := urlData.Expires.Time
+	if lruCachePersistence.ttl > 0 {
+		if ttlExpiresAt := time.Now().Add(lruCachePersistence.ttl); ttlExpiresAt.Before(expiresAt) {
+			expiresAt = ttlExpiresAt
+		}
+	}
+	if !expiresAt.After(time.Now()) {
+		return
+	}
+
+	lruCachePersistence.mutex.Lock()
+	defer lruCachePersistence.mutex.Unlock()
+
+	if element, found := lruCachePersistence.entries[urlData.ShortSlug]; found {
+		element.Value = &lruCacheEntry{urlData: urlData, expiresAt: expiresAt}
+		lruCachePersistence.recency.MoveToFront(element)
+		return
+	}
+
+	for lruCachePersistence.recency.Len() >= lruCachePersistence.size {
+		lruCachePersistence.remove(lruCachePersistence.recency.Back())
+		lruCachePersistence.evictions++
+	}
+
+	entry := &lruCacheEntry{urlData: urlData, expiresAt: expiresAt}
+	lruCachePersistence.entries[urlData.ShortSlug] = lruCachePersistence.recency.PushFront(entry)
+}
+
+// forget drops the local copy of the url data if there is one.
+func (lruCachePersistence *LruCachePersistence) forget(shortSlug string) {
+	lruCachePersistence.mutex.Lock()
+	defer lruCachePersistence.mutex.Unlock()
+
+	if element, found := lruCachePersistence.entries[shortSlug]; found {
+		lruCachePersistence.remove(element)
+	}
+}
+
+func (lruCachePersistence *LruCachePersistence) remove(element *list.Element) {
+	entry := lruCachePersistence.recency.Remove(element).(*lruCacheEntry)
+	delete(lruCachePersistence.entries, entry.urlData.ShortSlug)
+}
@@ -0,0 +1,94 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"testing"
+	"time"
+)
+
+func newTestLruCache(size int, ttlMillis int) (*storage.LruCachePersistence, *storage.MemoryCachePersistence) {
+	var configuration util.Configuration
+	configuration.LocalCache.Size = size
+	configuration.LocalCache.TtlMillis = ttlMillis
+
+	memoryCachePersistence := storage.NewMemoryCachePersistence()
+	return storage.NewLruCachePersistence(configuration, memoryCachePersistence), memoryCachePersistence
+}
+
+func TestLruCacheServesHitsLocally(t *testing.T) {
+	lruCache, memoryCachePersistence := newTestLruCache(10, 60000)
+	lruCache.SaveUrlData(context.Background(), testUrlData)
+
+	// The wrapped cache has lost the data, so it can only come from the local copy
+	memoryCachePersistence.Flush()
+
+	foundUrlData, err := lruCache.GetUrlData(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundUrlData.RealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s from the local cache, got: %s, error: %v.",
+			testUrlData.RealUrl, foundUrlData.RealUrl, err)
+	}
+
+	if _, err := lruCache.GetUrlData(context.Background(), "missing-short-slug"); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a cache miss, got: %v.", err)
+	}
+
+	stats := lruCache.Stats()
+	if stats["cache.local.hits"] != 1 || stats["cache.local.misses"] != 1 {
+		t.Errorf("Unexpected local cache stats: %v.", stats)
+	}
+}
+
+func TestLruCachePopulatesFromWrappedCache(t *testing.T) {
+	lruCache, memoryCachePersistence := newTestLruCache(10, 60000)
+	memoryCachePersistence.SaveUrlData(context.Background(), testUrlData)
+
+	lruCache.GetUrlData(context.Background(), testUrlData.ShortSlug)
+	memoryCachePersistence.Flush()
+
+	if _, err := lruCache.GetUrlData(context.Background(), testUrlData.ShortSlug); err != nil {
+		t.Errorf("The url data read from the wrapped cache was not kept locally: %v.", err)
+	}
+}
+
+func TestLruCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	lruCache, memoryCachePersistence := newTestLruCache(2, 60000)
+	expires := time.Now().Add(time.Hour)
+
+	for _, shortSlug := range []string{"first", "second", "third"} {
+		lruCache.SaveUrlData(context.Background(), model.UrlData{ShortSlug: shortSlug, RealUrl: testUrlData.RealUrl,
+			Expires: model.CustomTime{Time: expires}})
+		if shortSlug == "second" {
+			// Touch the first one, so the second one is the least recently used
+			lruCache.GetUrlData(context.Background(), "first")
+		}
+	}
+	memoryCachePersistence.Flush()
+
+	for shortSlug, expectedFound := range map[string]bool{"first": true, "second": false, "third": true} {
+		if found, _ := lruCache.Exists(context.Background(), shortSlug); found != expectedFound {
+			t.Errorf("Expected short slug: %s to be found locally: %t, got: %t.", shortSlug, expectedFound, found)
+		}
+	}
+
+	stats := lruCache.Stats()
+	if stats["cache.local.size"] != 2 || stats["cache.local.evictions"] != 1 {
+		t.Errorf("Unexpected local cache stats: %v.", stats)
+	}
+}
+
+func TestLruCacheExpiryIsBoundedByUrlDataExpires(t *testing.T) {
+	lruCache, memoryCachePersistence := newTestLruCache(10, 60000)
+	shortLivedUrlData := model.UrlData{ShortSlug: "short-lived", RealUrl: testUrlData.RealUrl,
+		Expires: model.CustomTime{Time: time.Now().Add(20 * time.Millisecond)}}
+
+	lruCache.SaveUrlData(context.Background(), shortLivedUrlData)
+	memoryCachePersistence.Flush()
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := lruCache.GetUrlData(context.Background(), shortLivedUrlData.ShortSlug); err != storage.ErrNotFound {
+		t.Errorf("Expected the local copy to expire with the url data, got: %v.", err)
+	}
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterCachePersistence(MemoryBackend, func(configuration util.Configuration) CachePersistence {
+		return NewMemoryCachePersistence()
+	})
+}
+
+// MemoryCachePersistence is an in-memory implementation of the CachePersistence.
+// Entries are evicted lazily once their expire time has passed, mirroring the redis ExpireAt behaviour.
+// The contexts are not used, as none of the operations blocks. The instances sharing a MemoryCachePersistence
+// are told about the deleted url data, like the ones sharing a redis server.
+type MemoryCachePersistence struct {
+	urlData          map[string]model.UrlData
+	unknownSlugs     map[string]time.Time
+	deletionHandlers []func(shortSlug string)
+	mutex            sync.Mutex
+}
+
+func NewMemoryCachePersistence() *MemoryCachePersistence {
+	memoryCachePersistence := new(MemoryCachePersistence)
+	memoryCachePersistence.urlData = make(map[string]model.UrlData)
+	memoryCachePersistence.unknownSlugs = make(map[string]time.Time)
+
+	return memoryCachePersistence
+}
+
+// SaveUrlData saves the url data in the cache and forgets that the short slug was unknown.
+func (memoryCachePersistence *MemoryCachePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	memoryCachePersistence.urlData[urlData.ShortSlug] = urlData
+	delete(memoryCachePersistence.unknownSlugs, urlData.ShortSlug)
+	return nil
+}
+
+// SaveUrlDataBatch saves the url data in the cache and forgets that their short slugs were unknown.
+func (memoryCachePersistence *MemoryCachePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData) error {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	for _, batchUrlData := range urlData {
+		memoryCachePersistence.urlData[batchUrlData.ShortSlug] = batchUrlData
+		delete(memoryCachePersistence.unknownSlugs, batchUrlData.ShortSlug)
+	}
+	return nil
+}
+
+// SaveUnknownSlug remembers that the short slug does not exist until expires.
+func (memoryCachePersistence *MemoryCachePersistence) SaveUnknownSlug(ctx context.Context, shortSlug string,
+	expires time.Time) error {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	memoryCachePersistence.unknownSlugs[shortSlug] = expires
+	return nil
+}
+
+// GetUrlData retrieves the url data from the cache given a short slug.
+// Returns ErrNotFound on a cache miss and ErrUnknownSlug if the short slug is known not to exist.
+func (memoryCachePersistence *MemoryCachePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	urlData, found := memoryCachePersistence.get(shortSlug)
+	if !found {
+		if memoryCachePersistence.isUnknown(shortSlug) {
+			return model.UrlData{}, ErrUnknownSlug
+		}
+		return model.UrlData{}, ErrNotFound
+	}
+
+	return urlData, nil
+}
+
+// Exists checks whether the short slug is present in the cache.
+func (memoryCachePersistence *MemoryCachePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	_, found := memoryCachePersistence.get(shortSlug)
+	return found, nil
+}
+
+// DeleteUrlData removes the url data from the cache, forgets that the short slug was unknown and calls the handlers registered with OnDeleteUrlData.
+func (memoryCachePersistence *MemoryCachePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	memoryCachePersistence.mutex.Lock()
+	delete(memoryCachePersistence.urlData, shortSlug)
+	delete(memoryCachePersistence.unknownSlugs, shortSlug)
+	deletionHandlers := memoryCachePersistence.deletionHandlers
+	memoryCachePersistence.mutex.Unlock()
+
+	for _, handler := range deletionHandlers {
+		handler(shortSlug)
+	}
+
+	return nil
+}
+
+// OnDeleteUrlData calls the handler with every short slug removed by DeleteUrlData.
+func (memoryCachePersistence *MemoryCachePersistence) OnDeleteUrlData(handler func(shortSlug string)) {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	memoryCachePersistence.deletionHandlers = append(memoryCachePersistence.deletionHandlers, handler)
+}
+
+// Flush removes all the cached url data.
+func (memoryCachePersistence *MemoryCachePersistence) Flush() {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	memoryCachePersistence.urlData = make(map[string]model.UrlData)
+	memoryCachePersistence.unknownSlugs = make(map[string]time.Time)
+}
+
+// Close is a no-op as there is nothing to release.
+func (memoryCachePersistence *MemoryCachePersistence) Close() error {
+	return nil
+}
+
+func (memoryCachePersistence *MemoryCachePersistence) get(shortSlug string) (model.UrlData, bool) {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	urlData, found := memoryCachePersistence.urlData[shortSlug]
+	if !found {
+		return model.UrlData{}, false
+	}
+
+	if isExpired(urlData) {
+		delete(memoryCachePersistence.urlData, shortSlug)
+		return model.UrlData{}, false
+	}
+
+	return urlData, true
+}
+
+func (memoryCachePersistence *MemoryCachePersistence) isUnknown(shortSlug string) bool {
+	memoryCachePersistence.mutex.Lock()
+	defer memoryCachePersistence.mutex.Unlock()
+
+	expires, found := memoryCachePersistence.unknownSlugs[shortSlug]
+	if !found {
+		return false
+	}
+
+	if !expires.After(time.Now()) {
+		delete(memoryCachePersistence.unknownSlugs, shortSlug)
+		return false
+	}
+
+	return true
+}
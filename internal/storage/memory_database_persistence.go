@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterDatabasePersistence(MemoryBackend, func(configuration util.Configuration) DatabasePersistence {
+		memoryDatabasePersistence := NewMemoryDatabasePersistence()
+		memoryDatabasePersistence.expiredUrlDataPolicy = newExpiredUrlDataPolicy(configuration)
+
+		return memoryDatabasePersistence
+	})
+}
+
+// MemoryDatabasePersistence is an in-memory implementation of the DatabasePersistence.
+// It is meant for tests and local development where no database server is available.
+// Expired url data is treated as missing and is overwritten on the next save once the reuse cooldown has passed.
+// The contexts are not used, as none of the operations blocks.
+type MemoryDatabasePersistence struct {
+	urlData         map[string]model.UrlData
+	archivedUrlData map[string][]model.ArchivedUrlData
+	slugKeys        map[string]bool
+	apiKeys         map[string]model.ApiKey
+	mutex           sync.RWMutex
+	expiredUrlDataPolicy
+}
+
+func NewMemoryDatabasePersistence() *MemoryDatabasePersistence {
+	memoryDatabasePersistence := new(MemoryDatabasePersistence)
+	memoryDatabasePersistence.urlData = make(map[string]model.UrlData)
+	memoryDatabasePersistence.archivedUrlData = make(map[string][]model.ArchivedUrlData)
+	memoryDatabasePersistence.slugKeys = make(map[string]bool)
+	memoryDatabasePersistence.apiKeys = make(map[string]model.ApiKey)
+
+	return memoryDatabasePersistence
+}
+
+// SaveUrlData saves the url data in memory.
+// Returns ErrDuplicate if the url short slug already exists or has expired less than the reuse cooldown ago.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	if memoryDatabasePersistence.isTaken(urlData.ShortSlug) {
+		return ErrDuplicate
+	}
+
+	memoryDatabasePersistence.save(urlData)
+	return nil
+}
+
+// SaveUrlDataBatch saves the url data whose short slugs are not taken, also by an earlier url data of the batch,
+// and returns ErrDuplicate for the others. With allOrNothing nothing is saved if any short slug is taken.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData, allOrNothing bool) []error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	errs := make([]error, len(urlData))
+	inBatch := make(map[string]bool, len(urlData))
+	failed := false
+	for i, batchUrlData := range urlData {
+		if inBatch[batchUrlData.ShortSlug] || memoryDatabasePersistence.isTaken(batchUrlData.ShortSlug) {
+			errs[i] = ErrDuplicate
+			failed = true
+			continue
+		}
+		inBatch[batchUrlData.ShortSlug] = true
+	}
+	if failed && allOrNothing {
+		return abortBatch(errs)
+	}
+
+	for i, batchUrlData := range urlData {
+		if errs[i] == nil {
+			memoryDatabasePersistence.save(batchUrlData)
+		}
+	}
+
+	return errs
+}
+
+// GetUrlData retrieves the url data given a short slug.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	return memoryDatabasePersistence.getValid(shortSlug)
+}
+
+// Exists checks whether the short slug is present and has not expired.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	return existsByGetUrlData(memoryDatabasePersistence.GetUrlData(ctx, shortSlug))
+}
+
+// DeleteExpiredUrlData deletes at most limit url data which has expired before the provided time,
+// moving it to the archive if archiving is enabled.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) DeleteExpiredUrlData(ctx context.Context,
+	expiredBefore time.Time, limit int) (int, error) {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	deleted := 0
+	for _, urlData := range memoryDatabasePersistence.urlData {
+		if deleted == limit {
+			break
+		}
+		if urlData.Expires.After(expiredBefore) {
+			continue
+		}
+
+		memoryDatabasePersistence.remove(urlData)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// GetArchivedUrlData retrieves the archived url data of the short slug, newest first.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) GetArchivedUrlData(ctx context.Context,
+	shortSlug string) ([]model.ArchivedUrlData, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	archivedUrlData := memoryDatabasePersistence.archivedUrlData[shortSlug]
+	newestFirst := make([]model.ArchivedUrlData, 0, len(archivedUrlData))
+	for i := len(archivedUrlData) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, archivedUrlData[i])
+	}
+
+	return newestFirst, nil
+}
+
+// SaveSlugKeys adds the short slugs which are not taken by an url data, even an expired one, to the slug key pool.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) SaveSlugKeys(ctx context.Context,
+	shortSlugs []string) (int, error) {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	saved := 0
+	for _, shortSlug := range shortSlugs {
+		if _, taken := memoryDatabasePersistence.urlData[shortSlug]; taken || memoryDatabasePersistence.slugKeys[shortSlug] {
+			continue
+		}
+		memoryDatabasePersistence.slugKeys[shortSlug] = true
+		saved++
+	}
+
+	return saved, nil
+}
+
+// ClaimSlugKeys takes at most limit short slugs out of the slug key pool.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) ClaimSlugKeys(ctx context.Context,
+	limit int) ([]string, error) {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	claimed := make([]string, 0, limit)
+	for shortSlug := range memoryDatabasePersistence.slugKeys {
+		if len(claimed) == limit {
+			break
+		}
+		delete(memoryDatabasePersistence.slugKeys, shortSlug)
+		claimed = append(claimed, shortSlug)
+	}
+
+	return claimed, nil
+}
+
+// CountSlugKeys returns how many short slugs are left in the slug key pool.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) CountSlugKeys(ctx context.Context) (int, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	return len(memoryDatabasePersistence.slugKeys), nil
+}
+
+// CountShortSlugs returns how many url data, even expired ones, have a short slug of the length.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) CountShortSlugs(ctx context.Context,
+	length int) (int, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	count := 0
+	for shortSlug := range memoryDatabasePersistence.urlData {
+		if len(shortSlug) == length {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// GetUrlDataFromPrimary retrieves the url data given a short slug, as there are no read replicas.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) GetUrlDataFromPrimary(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	return memoryDatabasePersistence.GetUrlData(ctx, shortSlug)
+}
+
+// UpdateUrlData replaces the real url, the expire time and the tags of the short slug,
+// the owner and the creation time are kept.
+// The replaced url data is archived if archiving is enabled.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) UpdateUrlData(ctx context.Context,
+	urlData model.UrlData) error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	existing, err := memoryDatabasePersistence.getValid(urlData.ShortSlug)
+	if err != nil {
+		return err
+	}
+
+	memoryDatabasePersistence.remove(existing)
+	updated := existing
+	updated.RealUrl = urlData.RealUrl
+	updated.Host = model.UrlHost(urlData.RealUrl)
+	updated.Expires = urlData.Expires
+	updated.Tags = urlData.Tags
+	memoryDatabasePersistence.urlData[urlData.ShortSlug] = updated
+	return nil
+}
+
+// DeleteUrlData makes the url data of the short slug expire now, so that it is archived when it is removed.
+// Returns ErrNotFound if there is no such short slug and ErrExpired if it has expired.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	urlData, err := memoryDatabasePersistence.getValid(shortSlug)
+	if err != nil {
+		return err
+	}
+
+	urlData.Expires.Time = time.Now()
+	memoryDatabasePersistence.urlData[shortSlug] = urlData
+	return nil
+}
+
+// getValid returns the url data of the short slug, ErrNotFound if there is none and ErrExpired if it has expired.
+// The caller must hold the lock.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) getValid(shortSlug string) (model.UrlData, error) {
+	urlData, found := memoryDatabasePersistence.urlData[shortSlug]
+	if !found {
+		return model.UrlData{}, ErrNotFound
+	}
+	if isExpired(urlData) {
+		return model.UrlData{}, ErrExpired
+	}
+
+	return urlData, nil
+}
+
+// SaveApiKey saves the api key. Returns ErrDuplicate if there is an api key with the same hash.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) SaveApiKey(ctx context.Context, apiKey model.ApiKey) error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	if _, found := memoryDatabasePersistence.apiKeys[apiKey.KeyHash]; found {
+		return ErrDuplicate
+	}
+
+	memoryDatabasePersistence.apiKeys[apiKey.KeyHash] = apiKey
+	return nil
+}
+
+// GetApiKey retrieves the api key given its hash. Returns ErrNotFound if there is no such api key.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) GetApiKey(ctx context.Context,
+	keyHash string) (model.ApiKey, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	apiKey, found := memoryDatabasePersistence.apiKeys[keyHash]
+	if !found {
+		return model.ApiKey{}, ErrNotFound
+	}
+
+	return apiKey, nil
+}
+
+// DeleteApiKey revokes the api key given its hash. Returns ErrNotFound if there is no such api key.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) DeleteApiKey(ctx context.Context, keyHash string) error {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	if _, found := memoryDatabasePersistence.apiKeys[keyHash]; !found {
+		return ErrNotFound
+	}
+
+	delete(memoryDatabasePersistence.apiKeys, keyHash)
+	return nil
+}
+
+// ListUrlData returns the url data matching the query, even the expired one, newest first.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) ListUrlData(ctx context.Context,
+	query UrlDataQuery) ([]model.UrlData, error) {
+	memoryDatabasePersistence.mutex.RLock()
+	defer memoryDatabasePersistence.mutex.RUnlock()
+
+	listed := []model.UrlData{}
+	for _, urlData := range memoryDatabasePersistence.urlData {
+		if query.matches(urlData) {
+			listed = append(listed, urlData)
+		}
+	}
+
+	sort.Slice(listed, func(i, j int) bool {
+		return isListedAfter(listed[i].CreatedAt, listed[i].ShortSlug, listed[j])
+	})
+	if query.Limit > 0 && len(listed) > query.Limit {
+		listed = listed[:query.Limit]
+	}
+
+	return listed, nil
+}
+
+// Flush removes all the stored url data.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) Flush() {
+	memoryDatabasePersistence.mutex.Lock()
+	defer memoryDatabasePersistence.mutex.Unlock()
+
+	memoryDatabasePersistence.urlData = make(map[string]model.UrlData)
+	memoryDatabasePersistence.archivedUrlData = make(map[string][]model.ArchivedUrlData)
+	memoryDatabasePersistence.slugKeys = make(map[string]bool)
+	memoryDatabasePersistence.apiKeys = make(map[string]model.ApiKey)
+}
+
+// Close is a no-op as there is nothing to release.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) Close() error {
+	return nil
+}
+
+// isTaken reports whether the short slug is taken by an url data which has not expired
+// or has expired less than the reuse cooldown ago. The caller must hold the lock.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) isTaken(shortSlug string) bool {
+	existing, found := memoryDatabasePersistence.urlData[shortSlug]
+	return found && existing.Expires.After(memoryDatabasePersistence.reusableExpiredBefore())
+}
+
+// save stores the url data, removing the expired url data of its short slug. The caller must hold the write lock.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) save(urlData model.UrlData) {
+	if existing, found := memoryDatabasePersistence.urlData[urlData.ShortSlug]; found {
+		memoryDatabasePersistence.remove(existing)
+	}
+
+	memoryDatabasePersistence.urlData[urlData.ShortSlug] = prepareUrlDataForSave(urlData)
+}
+
+// remove deletes the url data, moving it to the archive if archiving is enabled.
+// The caller must hold the write lock.
+func (memoryDatabasePersistence *MemoryDatabasePersistence) remove(urlData model.UrlData) {
+	delete(memoryDatabasePersistence.urlData, urlData.ShortSlug)
+
+	if memoryDatabasePersistence.archive {
+		memoryDatabasePersistence.archivedUrlData[urlData.ShortSlug] = append(
+			memoryDatabasePersistence.archivedUrlData[urlData.ShortSlug], model.NewArchivedUrlData(urlData, time.Now()))
+	}
+}
+
+func isExpired(urlData model.UrlData) bool {
+	return !urlData.Expires.After(time.Now())
+}
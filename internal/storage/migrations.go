@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Migration is a single versioned change of the database schema.
+// Up applies the change and Down reverts it. Both are executed in the transaction which records
+// the version in the schema_version table, so a failed migration leaves no trace on the databases
+// with transactional DDL (PostgreSQL and SQLite). MySQL commits every DDL statement on its own,
+// so a failed migration there has to be fixed by hand before it is retried.
+// Backfill, if set, fills the existing rows after Up, outside of its transaction, and the version is recorded
+// only once it is done. It should update the rows in chunks which are committed on their own, so that it does
+// not lock a large table for long. A failed Backfill is run again with its Up, so both must be idempotent.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(db *gorm.DB) error
+	Backfill    func(db *gorm.DB) error
+	Down        func(db *gorm.DB) error
+}
+
+// The migrations use their own copies of the models, so that a later change of a model
+// does not change what an already released migration does.
+
+type urlDataV1 struct {
+	ShortSlug string    `gorm:"column:short_slug; type:varchar(50); primary_key"`
+	RealUrl   string    `gorm:"column:real_url; type:text"`
+	Expires   time.Time `gorm:"column:expires"`
+}
+
+func (urlDataV1) TableName() string {
+	return "url_data"
+}
+
+type archivedUrlDataV2 struct {
+	ID         uint      `gorm:"primary_key"`
+	ShortSlug  string    `gorm:"column:short_slug; type:varchar(50); index"`
+	RealUrl    string    `gorm:"column:real_url; type:text"`
+	Expires    time.Time `gorm:"column:expires"`
+	ArchivedAt time.Time `gorm:"column:archived_at"`
+}
+
+func (archivedUrlDataV2) TableName() string {
+	return "archived_url_data"
+}
+
+type slugKeyV4 struct {
+	ShortSlug string `gorm:"column:short_slug; type:varchar(50); primary_key"`
+}
+
+func (slugKeyV4) TableName() string {
+	return "slug_keys"
+}
+
+type apiKeyV5 struct {
+	KeyHash   string    `gorm:"column:key_hash; type:varchar(64); primary_key"`
+	Owner     string    `gorm:"column:owner; type:varchar(64)"`
+	Scopes    string    `gorm:"column:scopes; type:varchar(255)"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (apiKeyV5) TableName() string {
+	return "api_keys"
+}
+
+// urlDataV7BackfillChunkSize bounds the url data updated in a single transaction by the backfill of migration 7.
+const urlDataV7BackfillChunkSize = 500
+
+// urlDataV7 holds the columns added to url_data by migration 7 and the ones read by its backfill.
+type urlDataV7 struct {
+	ShortSlug string    `gorm:"column:short_slug; type:varchar(50); primary_key"`
+	RealUrl   string    `gorm:"column:real_url; type:text"`
+	Tags      string    `gorm:"column:tags; type:varchar(255)"`
+	Host      string    `gorm:"column:host; type:varchar(255)"`
+	CreatedAt time.Time `gorm:"column:created_at"`
+}
+
+func (urlDataV7) TableName() string {
+	return "url_data"
+}
+
+// migrations lists every schema change in the order of the versions. Released migrations must not be changed,
+// a new change of the schema is a new migration at the end of the list.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create url_data",
+		// The databases created before the migrations already have the table from AutoMigrate
+		Up: func(db *gorm.DB) error {
+			return createTableIfNotExists(db, &urlDataV1{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTable(&urlDataV1{}).Error
+		},
+	},
+	{
+		Version:     2,
+		Description: "create archived_url_data",
+		Up: func(db *gorm.DB) error {
+			return createTableIfNotExists(db, &archivedUrlDataV2{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTable(&archivedUrlDataV2{}).Error
+		},
+	},
+	{
+		Version:     3,
+		Description: "add an index on url_data.expires for the expiry sweeper",
+		Up: func(db *gorm.DB) error {
+			return db.Model(&urlDataV1{}).AddIndex("idx_url_data_expires", "expires").Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Model(&urlDataV1{}).RemoveIndex("idx_url_data_expires").Error
+		},
+	},
+	{
+		Version:     4,
+		Description: "create slug_keys for the pre-generated short slugs",
+		Up: func(db *gorm.DB) error {
+			return createTableIfNotExists(db, &slugKeyV4{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTable(&slugKeyV4{}).Error
+		},
+	},
+	{
+		Version:     5,
+		Description: "create api_keys",
+		Up: func(db *gorm.DB) error {
+			return createTableIfNotExists(db, &apiKeyV5{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTable(&apiKeyV5{}).Error
+		},
+	},
+	{
+		Version:     6,
+		Description: "add url_data.owner for the owner of the api key which has created it",
+		// The databases created by AutoMigrate from the current model already have the column
+		Up: func(db *gorm.DB) error {
+			if db.Dialect().HasColumn("url_data", "owner") {
+				return nil
+			}
+			return db.Exec("ALTER TABLE url_data ADD COLUMN owner varchar(64) NOT NULL DEFAULT ''").Error
+		},
+		Down: func(db *gorm.DB) error {
+			return dropUrlDataColumn(db, "owner")
+		},
+	},
+	{
+		Version:     7,
+		Description: "add url_data.tags, host and created_at with the indexes for listing the url data",
+		// The databases created by AutoMigrate from the current model already have the columns
+		Up: func(db *gorm.DB) error {
+			createdAtType := "datetime"
+			if db.Dialect().GetName() == "postgres" {
+				createdAtType = "timestamp with time zone"
+			}
+			columns := [][2]string{{"tags", "varchar(255)"}, {"host", "varchar(255)"}, {"created_at", createdAtType}}
+			for _, column := range columns {
+				if db.Dialect().HasColumn("url_data", column[0]) {
+					continue
+				}
+				err := db.Exec("ALTER TABLE url_data ADD COLUMN " + column[0] + " " + column[1] + " NULL").Error
+				if err != nil {
+					return err
+				}
+			}
+
+			urlData := db.Model(&urlDataV7{})
+			if err := urlData.AddIndex("idx_url_data_created_at", "created_at", "short_slug").Error; err != nil {
+				return err
+			}
+			err := urlData.AddIndex("idx_url_data_owner_created_at", "owner", "created_at", "short_slug").Error
+			if err != nil {
+				return err
+			}
+			return urlData.AddIndex("idx_url_data_host", "host").Error
+		},
+		Backfill: backfillUrlDataV7,
+		Down: func(db *gorm.DB) error {
+			indexes := []string{"idx_url_data_created_at", "idx_url_data_owner_created_at", "idx_url_data_host"}
+			for _, index := range indexes {
+				if err := db.Model(&urlDataV7{}).RemoveIndex(index).Error; err != nil {
+					return err
+				}
+			}
+			return dropUrlDataColumns(db, "tags", "host", "created_at")
+		},
+	},
+}
+
+// backfillUrlDataV7 sets the host of the existing url data, which is parsed from the real url in Go,
+// and the time of the migration as their creation time, which has not been recorded before.
+// The url data is read and updated in chunks of urlDataV7BackfillChunkSize, in the order of the short slugs.
+func backfillUrlDataV7(db *gorm.DB) error {
+	migratedAt := time.Now().UTC().Truncate(time.Second)
+
+	afterShortSlug := ""
+	for {
+		var chunk []urlDataV7
+		err := db.Select("short_slug, real_url").Where("short_slug > ?", afterShortSlug).
+			Where("host IS NULL OR created_at IS NULL").Order("short_slug").Limit(urlDataV7BackfillChunkSize).
+			Find(&chunk).Error
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, urlData := range chunk {
+				err := tx.Model(&urlDataV7{}).Where("short_slug = ?", urlData.ShortSlug).
+					Updates(map[string]interface{}{"host": model.UrlHost(urlData.RealUrl), "tags": "",
+						"created_at": migratedAt}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		afterShortSlug = chunk[len(chunk)-1].ShortSlug
+	}
+}
+
+// dropUrlDataColumn drops a column added to url_data after migration 3. The SQLite versions before 3.35
+// cannot drop a column, so there the table is copied to a new one of the version 3 schema.
+func dropUrlDataColumn(db *gorm.DB, column string) error {
+	if db.Dialect().GetName() != "sqlite3" {
+		return db.Model(&urlDataV1{}).DropColumn(column).Error
+	}
+
+	statements := []string{
+		"ALTER TABLE url_data RENAME TO url_data_old",
+		"CREATE TABLE url_data (short_slug varchar(50) NOT NULL, real_url text, expires datetime, " +
+			"PRIMARY KEY (short_slug))",
+		"INSERT INTO url_data (short_slug, real_url, expires) SELECT short_slug, real_url, expires FROM url_data_old",
+		"DROP TABLE url_data_old",
+		"CREATE INDEX idx_url_data_expires ON url_data(expires)",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropUrlDataColumns drops the columns added to url_data by migration 7 and the later ones. The SQLite versions
+// before 3.35 cannot drop a column, so there the table is copied to a new one without the columns
+// and its remaining indexes are created again.
+func dropUrlDataColumns(db *gorm.DB, columns ...string) error {
+	if db.Dialect().GetName() != "sqlite3" {
+		for _, column := range columns {
+			if err := db.Model(&urlDataV1{}).DropColumn(column).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dropped := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		dropped[column] = true
+	}
+
+	var tableColumns []struct {
+		Name    string  `gorm:"column:name"`
+		Type    string  `gorm:"column:type"`
+		NotNull bool    `gorm:"column:notnull"`
+		Default *string `gorm:"column:dflt_value"`
+		PK      int     `gorm:"column:pk"`
+	}
+	if err := db.Raw("PRAGMA table_info(url_data)").Scan(&tableColumns).Error; err != nil {
+		return err
+	}
+	var indexes []struct {
+		Sql string `gorm:"column:sql"`
+	}
+	err := db.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = 'url_data' AND sql IS NOT NULL").
+		Scan(&indexes).Error
+	if err != nil {
+		return err
+	}
+
+	var definitions, keptColumns, primaryKey []string
+	for _, column := range tableColumns {
+		if dropped[column.Name] {
+			continue
+		}
+
+		definition := column.Name + " " + column.Type
+		if column.NotNull {
+			definition += " NOT NULL"
+		}
+		if column.Default != nil {
+			definition += " DEFAULT " + *column.Default
+		}
+		definitions = append(definitions, definition)
+		keptColumns = append(keptColumns, column.Name)
+		if column.PK > 0 {
+			primaryKey = append(primaryKey, column.Name)
+		}
+	}
+	if len(primaryKey) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+strings.Join(primaryKey, ", ")+")")
+	}
+
+	statements := []string{
+		"ALTER TABLE url_data RENAME TO url_data_old",
+		"CREATE TABLE url_data (" + strings.Join(definitions, ", ") + ")",
+		"INSERT INTO url_data (" + strings.Join(keptColumns, ", ") + ") SELECT " + strings.Join(keptColumns, ", ") +
+			" FROM url_data_old",
+		"DROP TABLE url_data_old",
+	}
+	for _, index := range indexes {
+		statements = append(statements, index.Sql)
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createTableIfNotExists(db *gorm.DB, model interface{}) error {
+	if db.HasTable(model) {
+		return nil
+	}
+
+	return db.CreateTable(model).Error
+}
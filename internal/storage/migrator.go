@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	"log"
+	"time"
+)
+
+// databaseOpeners holds how to connect to each of the SQL database backends, so that the Migrator can work
+// on a database without creating its DatabasePersistence, which would apply the pending migrations right away.
+var databaseOpeners = make(map[string]func(configuration util.Configuration) (*gorm.DB, error))
+
+// The lock held while the migrations are applied or reverted, by name on MySQL and by key on Postgres.
+const (
+	migrationLockName       = "urlshortener_schema_migrations"
+	migrationLockKey  int64 = 7274520136
+)
+
+// schemaVersion is a row of the schema_version table - one row for every applied migration.
+type schemaVersion struct {
+	Version     int       `gorm:"primary_key; auto_increment:false"`
+	Description string    `gorm:"type:varchar(255)"`
+	AppliedAt   time.Time `gorm:"column:applied_at"`
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// Migrator applies and reverts the versioned schema migrations of a SQL database.
+// The applied versions are recorded in the schema_version table.
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+	// closeDb is set when the Migrator has opened the connection itself.
+	closeDb bool
+}
+
+// NewMigrator connects to the database backend named in Configuration.Storage.
+// It fails for the backends which have no schema, such as the in-memory one.
+func NewMigrator(configuration util.Configuration) (*Migrator, error) {
+	openDatabase, found := databaseOpeners[databaseBackendName(configuration)]
+	if !found {
+		return nil, fmt.Errorf("storage: database backend %q has no schema migrations",
+			databaseBackendName(configuration))
+	}
+
+	db, err := openDatabase(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator := newMigrator(db)
+	migrator.closeDb = true
+
+	return migrator, nil
+}
+
+func newMigrator(db *gorm.DB) *Migrator {
+	migrator := new(Migrator)
+
+	migrator.db = db
+	migrator.migrations = migrations
+
+	return migrator
+}
+
+// Version returns the latest applied migration version, 0 for an empty database.
+func (migrator *Migrator) Version() (int, error) {
+	if err := migrator.db.AutoMigrate(&schemaVersion{}).Error; err != nil {
+		return 0, err
+	}
+
+	var versions []int
+	err := migrator.db.Model(&schemaVersion{}).Order("version desc").Limit(1).Pluck("version", &versions).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+
+	return versions[0], nil
+}
+
+// LatestVersion returns the version of the last known migration.
+func (migrator *Migrator) LatestVersion() int {
+	if len(migrator.migrations) == 0 {
+		return 0
+	}
+
+	return migrator.migrations[len(migrator.migrations)-1].Version
+}
+
+// Up applies all the pending migrations and returns how many have been applied.
+// The version is read under the migration lock, so that the instances starting at the same time
+// wait for each other instead of applying the same migrations.
+func (migrator *Migrator) Up() (int, error) {
+	unlock, err := migrator.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	version, err := migrator.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range migrator.migrations {
+		if migration.Version <= version {
+			continue
+		}
+
+		err := migrator.apply(migration)
+		if err != nil {
+			return applied, fmt.Errorf("storage: migration %d (%s) failed: %w", migration.Version,
+				migration.Description, err)
+		}
+
+		log.Printf("Applied migration %d: %s.\n", migration.Version, migration.Description)
+		applied++
+	}
+
+	return applied, nil
+}
+
+// Down reverts the last steps applied migrations and returns how many have been reverted.
+func (migrator *Migrator) Down(steps int) (int, error) {
+	unlock, err := migrator.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	version, err := migrator.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(migrator.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		migration := migrator.migrations[i]
+		if migration.Version > version {
+			continue
+		}
+
+		err := migrator.inTransaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Where("version = ?", migration.Version).Delete(&schemaVersion{}).Error
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("storage: reverting migration %d (%s) failed: %w", migration.Version,
+				migration.Description, err)
+		}
+
+		log.Printf("Reverted migration %d: %s.\n", migration.Version, migration.Description)
+		reverted++
+	}
+
+	return reverted, nil
+}
+
+// Close closes the database connection if the Migrator has opened it.
+func (migrator *Migrator) Close() error {
+	if !migrator.closeDb {
+		return nil
+	}
+
+	return migrator.db.Close()
+}
+
+// lock takes the migration lock and returns the function which releases it. MySQL and Postgres hold the lock
+// for a connection, so a connection is kept out of the pool until then. SQLite needs no lock, as it is opened
+// with a single connection and its transactions are serialized, see openSqliteDatabase.
+func (migrator *Migrator) lock() (func(), error) {
+	var lockQuery, unlockQuery string
+	var lockKey interface{}
+	switch migrator.db.Dialect().GetName() {
+	case "mysql":
+		lockQuery, unlockQuery, lockKey = "SELECT GET_LOCK(?, -1)", "SELECT RELEASE_LOCK(?)", migrationLockName
+	case "postgres":
+		lockQuery, unlockQuery, lockKey = "SELECT pg_advisory_lock(?)", "SELECT pg_advisory_unlock(?)", migrationLockKey
+	default:
+		return func() {}, nil
+	}
+
+	ctx := context.Background()
+	conn, err := migrator.db.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, lockQuery, lockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("storage: taking the migration lock failed: %w", err)
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, unlockQuery, lockKey); err != nil {
+			log.Printf("Error in Migrator.lock() - releasing the lock: %v.\n", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+// apply applies the migration and records its version. Without a backfill it is done in a single transaction,
+// otherwise the version is recorded in a transaction of its own once the backfill is done.
+func (migrator *Migrator) apply(migration Migration) error {
+	recordVersion := func(tx *gorm.DB) error {
+		return tx.Create(&schemaVersion{Version: migration.Version, Description: migration.Description,
+			AppliedAt: time.Now().UTC()}).Error
+	}
+
+	err := migrator.inTransaction(func(tx *gorm.DB) error {
+		if err := migration.Up(tx); err != nil {
+			return err
+		}
+		if migration.Backfill != nil {
+			return nil
+		}
+		return recordVersion(tx)
+	})
+	if err != nil || migration.Backfill == nil {
+		return err
+	}
+
+	if err := migration.Backfill(migrator.db); err != nil {
+		return err
+	}
+
+	return migrator.inTransaction(recordVersion)
+}
+
+func (migrator *Migrator) inTransaction(migrate func(tx *gorm.DB) error) error {
+	tx := migrator.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := migrate(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// migrateUp applies the pending migrations of a database which is being opened by a DatabasePersistence.
+func migrateUp(db *gorm.DB) {
+	if _, err := newMigrator(db).Up(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSqliteMigrationConfiguration(t *testing.T) (util.Configuration, func()) {
+	directory, err := ioutil.TempDir("", "urlshortener")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configuration util.Configuration
+	configuration.Storage.Database = storage.SqliteBackend
+	configuration.Sqlite.Path = filepath.Join(directory, "urlshortener.db")
+
+	return configuration, func() { os.RemoveAll(directory) }
+}
+
+func newTestMigrator(t *testing.T, configuration util.Configuration) *storage.Migrator {
+	migrator, err := storage.NewMigrator(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return migrator
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	configuration, removeDirectory := newSqliteMigrationConfiguration(t)
+	defer removeDirectory()
+	migrator := newTestMigrator(t, configuration)
+	defer migrator.Close()
+
+	applied, err := migrator.Up()
+	if err != nil || applied != migrator.LatestVersion() {
+		t.Fatalf("Expected all %d migrations to be applied, got: %d, error: %v.", migrator.LatestVersion(), applied, err)
+	}
+	if version, _ := migrator.Version(); version != migrator.LatestVersion() {
+		t.Errorf("Expected schema version: %d, got: %d.", migrator.LatestVersion(), version)
+	}
+
+	if applied, err := migrator.Up(); err != nil || applied != 0 {
+		t.Errorf("Expected no pending migrations, got: %d, error: %v.", applied, err)
+	}
+
+	if reverted, err := migrator.Down(1); err != nil || reverted != 1 {
+		t.Fatalf("Expected a single migration to be reverted, got: %d, error: %v.", reverted, err)
+	}
+	if version, _ := migrator.Version(); version != migrator.LatestVersion()-1 {
+		t.Errorf("Expected schema version: %d after down, got: %d.", migrator.LatestVersion()-1, version)
+	}
+
+	if reverted, err := migrator.Down(migrator.LatestVersion()); err != nil || reverted != migrator.LatestVersion()-1 {
+		t.Fatalf("Expected the remaining migrations to be reverted, got: %d, error: %v.", reverted, err)
+	}
+	if version, _ := migrator.Version(); version != 0 {
+		t.Errorf("Expected an empty schema, got version: %d.", version)
+	}
+}
+
+func TestMigratorKeepsDataOfAutoMigratedDatabase(t *testing.T) {
+	configuration, removeDirectory := newSqliteMigrationConfiguration(t)
+	defer removeDirectory()
+
+	// A database created before the migrations, by AutoMigrate
+	db, err := gorm.Open("sqlite3", configuration.Sqlite.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlData := model.UrlData{ShortSlug: "migrated-short-slug", RealUrl: "http://migrated-real-url.com",
+		Expires: model.CustomTime{Time: time.Now().Add(time.Hour).UTC()}}
+	db.AutoMigrate(model.UrlData{})
+	db.Create(&urlData)
+	db.Close()
+
+	databasePersistence := storage.NewDatabasePersistence(configuration)
+	defer databasePersistence.Close()
+
+	if _, err := databasePersistence.GetUrlData(context.Background(), urlData.ShortSlug); err != nil {
+		t.Errorf("The url data was lost while migrating: %v.", err)
+	}
+
+	migrator := newTestMigrator(t, configuration)
+	defer migrator.Close()
+	if version, _ := migrator.Version(); version != migrator.LatestVersion() {
+		t.Errorf("Expected the database persistence to apply the migrations, got version: %d.", version)
+	}
+}
+
+func TestMigratorBackfillsUrlDataInChunks(t *testing.T) {
+	configuration, removeDirectory := newSqliteMigrationConfiguration(t)
+	defer removeDirectory()
+
+	migrator := newTestMigrator(t, configuration)
+	defer migrator.Close()
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Down(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// More url data than a single chunk of the backfill, saved before the listing columns have been added
+	db, err := gorm.Open("sqlite3", configuration.Sqlite.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx := db.Begin()
+	for i := 0; i < 1234; i++ {
+		err := tx.Exec("INSERT INTO url_data (short_slug, real_url, expires) VALUES (?, ?, ?)",
+			fmt.Sprintf("backfill-%04d", i), fmt.Sprintf("https://backfill-%d.example.com/path", i%3),
+			time.Now().Add(time.Hour).UTC()).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if applied, err := migrator.Up(); err != nil || applied != 1 {
+		t.Fatalf("Expected the last migration to be applied, got: %d, error: %v.", applied, err)
+	}
+
+	var notBackfilled int
+	db.Table("url_data").Where("host IS NULL OR created_at IS NULL").Count(&notBackfilled)
+	var hosts []string
+	db.Table("url_data").Where("short_slug = ?", "backfill-1000").Pluck("host", &hosts)
+	if notBackfilled != 0 || len(hosts) != 1 || hosts[0] != "backfill-1.example.com" {
+		t.Errorf("Expected every url data to be backfilled, got: %d not backfilled, hosts: %v.", notBackfilled, hosts)
+	}
+}
+
+func TestNewMigratorForBackendWithoutSchema(t *testing.T) {
+	var configuration util.Configuration
+	configuration.Storage.Database = storage.MemoryBackend
+
+	if _, err := storage.NewMigrator(configuration); err == nil {
+		t.Errorf("Expected an error for a database backend without a schema.")
+	}
+}
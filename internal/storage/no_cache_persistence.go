@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"time"
+)
+
+func init() {
+	RegisterCachePersistence(NoCacheBackend, func(configuration util.Configuration) CachePersistence {
+		return NewNoCachePersistence()
+	})
+}
+
+// NoCachePersistence is a CachePersistence which stores nothing, so every lookup goes to the database.
+type NoCachePersistence struct{}
+
+func NewNoCachePersistence() *NoCachePersistence {
+	return new(NoCachePersistence)
+}
+
+// SaveUrlData discards the url data.
+func (noCachePersistence *NoCachePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	return nil
+}
+
+// SaveUrlDataBatch discards the url data.
+func (noCachePersistence *NoCachePersistence) SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData) error {
+	return nil
+}
+
+// SaveUnknownSlug discards the unknown short slug.
+func (noCachePersistence *NoCachePersistence) SaveUnknownSlug(ctx context.Context, shortSlug string,
+	expires time.Time) error {
+	return nil
+}
+
+// GetUrlData always reports a cache miss.
+func (noCachePersistence *NoCachePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	return model.UrlData{}, ErrNotFound
+}
+
+// Exists always reports a cache miss.
+func (noCachePersistence *NoCachePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	return false, nil
+}
+
+// DeleteUrlData is a no-op as there is nothing to remove.
+func (noCachePersistence *NoCachePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	return nil
+}
+
+// Close is a no-op as there is nothing to release.
+func (noCachePersistence *NoCachePersistence) Close() error {
+	return nil
+}
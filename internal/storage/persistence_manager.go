@@ -2,76 +2,571 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"github.com/gdgenchev/urlshortener/internal/model"
 	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"sync"
+	"time"
 )
 
 // PersistenceManager manages a long term database persistence and a short term
 // cache persistence and provides thread safe methods for saving and retrieving data.
+// Every backend call gets its own deadline, derived from the context of the incoming request.
+// The concurrent database lookups of the same short slug are coalesced into a single query.
+// Unless ExpirySweeper.IntervalMillis is negative, the expired url data is removed in the background until Close.
+// An updated or deleted short slug is removed from the cache after the database, so it stops redirecting
+// to its old real url right away. For a while after the change it is read from the primary database,
+// as the read replicas may still have the old url data, see markChanged.
 type PersistenceManager struct {
 	databasePersistence DatabasePersistence
 	cachePersistence    CachePersistence
+	databaseTimeout     time.Duration
+	cacheTimeout        time.Duration
+	unknownSlugTtl      time.Duration
+	expirySweeper       *ExpirySweeper
+	lookupsMutex        sync.Mutex
+	lookups             map[string]*urlDataLookup
+	// changedSlugs keeps until when the recently changed short slugs are read from the primary database.
+	changedSlugs      map[string]time.Time
+	changedSlugWindow time.Duration
 }
 
+// urlDataLookup is a database lookup of a short slug, shared by all the GetRealUrl calls waiting for it.
+type urlDataLookup struct {
+	done    chan struct{}
+	urlData model.UrlData
+	err     error
+	// changed is set if the short slug is saved, updated or deleted while it is looked up, see runLookup.
+	changed bool
+}
+
+// NewPersistenceManager creates a PersistenceManager with the registered backends named in Configuration.Storage.
 func NewPersistenceManager(configuration util.Configuration) *PersistenceManager {
+	return NewPersistenceManagerWithBackends(configuration,
+		NewDatabasePersistence(configuration), newCachePersistenceChain(configuration))
+}
+
+// newCachePersistenceChain creates the registered cache backend and wraps it with the configured decorators.
+func newCachePersistenceChain(configuration util.Configuration) CachePersistence {
+	cachePersistence := NewCachePersistence(configuration)
+
+	if configuration.CacheCircuitBreaker.FailureThreshold > 0 {
+		cachePersistence = NewCircuitBreakerCachePersistence(configuration, cachePersistence)
+	}
+
+	// The local tier goes outermost, so the hot short slugs are served even while the circuit is open
+	if configuration.LocalCache.Size > 0 {
+		cachePersistence = NewLruCachePersistence(configuration, cachePersistence)
+	}
+
+	return cachePersistence
+}
+
+// NewPersistenceManagerWithBackends creates a PersistenceManager on top of already created backends.
+func NewPersistenceManagerWithBackends(configuration util.Configuration, databasePersistence DatabasePersistence,
+	cachePersistence CachePersistence) *PersistenceManager {
 	persistenceManager := new(PersistenceManager)
 
-	mysqlPersistence := NewMysqlPersistence(configuration)
-	redisCachePersistence := NewRedisCachePersistence(configuration)
+	persistenceManager.databasePersistence = databasePersistence
+	persistenceManager.cachePersistence = cachePersistence
+	persistenceManager.databaseTimeout = time.Duration(configuration.Storage.DatabaseTimeoutMillis) * time.Millisecond
+	persistenceManager.cacheTimeout = time.Duration(configuration.Storage.CacheTimeoutMillis) * time.Millisecond
+	persistenceManager.unknownSlugTtl =
+		time.Duration(configuration.Storage.UnknownSlugTtlMillis) * time.Millisecond
+	persistenceManager.lookups = make(map[string]*urlDataLookup)
+	persistenceManager.changedSlugs = make(map[string]time.Time)
+	persistenceManager.changedSlugWindow = maxReplicaStaleness(configuration)
+	// The short slugs changed by the other instances are read from the primary database as well
+	onDeleteUrlData(cachePersistence, persistenceManager.markChanged)
 
-	persistenceManager.databasePersistence = mysqlPersistence
-	persistenceManager.cachePersistence = redisCachePersistence
+	if configuration.ExpirySweeper.IntervalMillis >= 0 {
+		persistenceManager.expirySweeper = NewExpirySweeper(configuration, databasePersistence)
+		persistenceManager.expirySweeper.Start()
+	}
 
 	return persistenceManager
 }
 
-// SaveUrlData persists the url data and returns false if the data already exists.
-func (persistenceManager *PersistenceManager) SaveUrlData(urlData model.UrlData) bool {
+// SaveUrlData persists the url data and returns ErrDuplicate if the short slug is already taken.
+// The database reserves the short slug atomically, so it is safe to call concurrently from many instances.
+// Cache failures are only logged, as the database is the source of truth.
+func (persistenceManager *PersistenceManager) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
 	// If the data is present in the cache, we are sure that this is a duplicate
-	if persistenceManager.cachePersistence.Exists(urlData.ShortSlug) {
-		return false
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	existsInCache, err := persistenceManager.cachePersistence.Exists(cacheCtx, urlData.ShortSlug)
+	cancel()
+	logCacheError("SaveUrlData() - cache Exists", err)
+	if existsInCache {
+		return ErrDuplicate
 	}
 
 	// If the data has not been found in the cache, there is a chance that it is in the database
 	// (if the cache memory limit has been reached and its eviction policy has been applied)
-	if ok := persistenceManager.databasePersistence.SaveUrlData(urlData); !ok {
-		return false
+	return persistenceManager.SaveUrlDataWithSlugKey(ctx, urlData)
+}
+
+// SaveUrlDataWithSlugKey persists the url data whose short slug has been claimed from the slug key pool.
+// The short slug is known to be unused, so the cache is not checked first. The database still returns
+// ErrDuplicate if a desired short slug has taken it after it has been added to the pool.
+func (persistenceManager *PersistenceManager) SaveUrlDataWithSlugKey(ctx context.Context, urlData model.UrlData) error {
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	err := persistenceManager.databasePersistence.SaveUrlData(databaseCtx, urlData)
+	cancel()
+	if err != nil {
+		return err
 	}
+	persistenceManager.markChanged(urlData.ShortSlug)
 
 	// The data has been inserted in the database, so we add it to the cache as well
 	// Recently stored data = higher chance for url access
-	persistenceManager.cachePersistence.SaveUrlData(urlData)
-	return true
+	persistenceManager.saveUrlDataInCache(ctx, urlData)
+	return nil
+}
+
+// SaveUrlDataBatch persists several url data at once and returns the error of each of them, nil for the saved ones.
+// With allOrNothing either every url data is saved or none, see LinkBatchSaver.
+// The cache is not checked first, as a single database call finds the taken short slugs of the whole batch.
+// The saved url data is added to the cache in a single call as well.
+func (persistenceManager *PersistenceManager) SaveUrlDataBatch(ctx context.Context, urlData []model.UrlData,
+	allOrNothing bool) []error {
+	linkBatchSaver, supported := persistenceManager.databasePersistence.(LinkBatchSaver)
+	if !supported {
+		return batchErrors(len(urlData), ErrUnsupported)
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	errs := linkBatchSaver.SaveUrlDataBatch(databaseCtx, urlData, allOrNothing)
+	cancel()
+
+	saved := make([]model.UrlData, 0, len(urlData))
+	for i, batchUrlData := range urlData {
+		if errs[i] == nil {
+			persistenceManager.markChanged(batchUrlData.ShortSlug)
+			saved = append(saved, batchUrlData)
+		}
+	}
+	if len(saved) > 0 {
+		cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+		err := persistenceManager.cachePersistence.SaveUrlDataBatch(cacheCtx, saved)
+		cancel()
+		logCacheError("SaveUrlDataBatch() - cache SaveUrlDataBatch", err)
+	}
+
+	return errs
 }
 
 // GetRealUrl returns the real url given a short slug.
-func (persistenceManager *PersistenceManager) GetRealUrl(shortSlug string) (string, bool) {
+// Returns ErrNotFound or ErrExpired if there is no valid url data and ErrUnavailable if the database fails.
+func (persistenceManager *PersistenceManager) GetRealUrl(ctx context.Context, shortSlug string) (string, error) {
 	// If the url data exists in the cache, we are sure that it is valid and return the real url
-	realUrl, found := persistenceManager.cachePersistence.GetRealUrl(shortSlug)
-	if found {
-		return realUrl, true
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	urlData, err := persistenceManager.cachePersistence.GetUrlData(cacheCtx, shortSlug)
+	cancel()
+	if err == nil {
+		return urlData.RealUrl, nil
+	}
+	// The short slug has recently been looked up in the database and not found
+	if errors.Is(err, ErrUnknownSlug) {
+		return "", ErrNotFound
+	}
+	if !errors.Is(err, ErrNotFound) {
+		logCacheError("GetRealUrl() - cache GetUrlData", err)
 	}
 
 	// If the url data has not been found in the cache, it might be in the database, so we check.
-	// If it is found in the database, we put it back in the cache as there is a high chance
-	// that the url will be used in the near future.
-	urlData, found := persistenceManager.databasePersistence.GetUrlData(shortSlug)
-	if found {
-		persistenceManager.cachePersistence.SaveUrlData(urlData)
-		return urlData.RealUrl, true
+	// A popular short slug which has dropped out of the cache is requested by many callers at once,
+	// so they all share the result of a single database query.
+	urlData, err = persistenceManager.lookupUrlData(ctx, shortSlug)
+	if err != nil {
+		return "", err
+	}
+
+	return urlData.RealUrl, nil
+}
+
+// lookupUrlData joins the database lookup of the short slug which is in flight or starts a new one.
+// The lookup is not bound to the context of the caller which has started it, so a cancelled request
+// does not fail the others waiting for the same short slug - each caller stops waiting when its own context is done.
+func (persistenceManager *PersistenceManager) lookupUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	persistenceManager.lookupsMutex.Lock()
+	lookup, inFlight := persistenceManager.lookups[shortSlug]
+	if !inFlight {
+		lookup = &urlDataLookup{done: make(chan struct{})}
+		persistenceManager.lookups[shortSlug] = lookup
+		go persistenceManager.runLookup(shortSlug, lookup)
 	}
+	persistenceManager.lookupsMutex.Unlock()
 
-	return "", false
+	select {
+	case <-lookup.done:
+		return lookup.urlData, lookup.err
+	case <-ctx.Done():
+		return model.UrlData{}, unavailable(ctx.Err())
+	}
+}
+
+// runLookup queries the database for the short slug and shares the result with the waiting callers.
+// If the url data is found, we put it back in the cache as there is a high chance
+// that the url will be used in the near future. If it is not found, the short slug is cached as unknown
+// for a short while, so that the scanners requesting random short slugs do not reach the database.
+// If the short slug has been changed while it was looked up, what has been cached may be out of date,
+// so it is removed again and the next caller looks the short slug up in the primary database.
+func (persistenceManager *PersistenceManager) runLookup(shortSlug string, lookup *urlDataLookup) {
+	databaseCtx, cancel := persistenceManager.databaseContext(context.Background())
+	lookup.urlData, lookup.err = persistenceManager.getUrlDataFromDatabase(databaseCtx, shortSlug)
+	cancel()
+
+	cached := false
+	if lookup.err == nil {
+		persistenceManager.saveUrlDataInCache(context.Background(), lookup.urlData)
+		cached = true
+	} else if lookup.err == ErrNotFound && persistenceManager.unknownSlugTtl > 0 {
+		persistenceManager.saveUnknownSlugInCache(context.Background(), shortSlug)
+		cached = true
+	}
+
+	// The url data is already in the cache, so the callers coming after this point do not need a new lookup.
+	// The lookup may have been replaced by a newer one if the short slug has been changed in the meantime.
+	persistenceManager.lookupsMutex.Lock()
+	if persistenceManager.lookups[shortSlug] == lookup {
+		delete(persistenceManager.lookups, shortSlug)
+	}
+	changed := lookup.changed
+	persistenceManager.lookupsMutex.Unlock()
+
+	if cached && changed {
+		persistenceManager.deleteUrlDataFromCache(context.Background(), shortSlug)
+	}
+
+	close(lookup.done)
+}
+
+// getUrlDataFromDatabase reads the url data of the short slug from the primary database if it has been changed
+// recently and from any database otherwise.
+func (persistenceManager *PersistenceManager) getUrlDataFromDatabase(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	if linkStore, supported := persistenceManager.databasePersistence.(LinkStore); supported &&
+		persistenceManager.changedRecently(shortSlug) {
+		return linkStore.GetUrlDataFromPrimary(ctx, shortSlug)
+	}
+
+	return persistenceManager.databasePersistence.GetUrlData(ctx, shortSlug)
+}
+
+// markChanged is called after the short slug is saved, updated or deleted in the database and before
+// the cache is changed. The lookup in flight may have read the old url data, so it is marked as changed
+// and the callers coming after this point start a new one, which reads from the primary database
+// until the read replicas catch up.
+func (persistenceManager *PersistenceManager) markChanged(shortSlug string) {
+	persistenceManager.lookupsMutex.Lock()
+	defer persistenceManager.lookupsMutex.Unlock()
+
+	if lookup, inFlight := persistenceManager.lookups[shortSlug]; inFlight {
+		lookup.changed = true
+		delete(persistenceManager.lookups, shortSlug)
+	}
+
+	now := time.Now()
+	for changedSlug, until := range persistenceManager.changedSlugs {
+		if now.After(until) {
+			delete(persistenceManager.changedSlugs, changedSlug)
+		}
+	}
+	persistenceManager.changedSlugs[shortSlug] = now.Add(persistenceManager.changedSlugWindow)
+}
+
+// changedRecently reports whether the read replicas may still have the old url data of the short slug.
+func (persistenceManager *PersistenceManager) changedRecently(shortSlug string) bool {
+	persistenceManager.lookupsMutex.Lock()
+	defer persistenceManager.lookupsMutex.Unlock()
+
+	until, changed := persistenceManager.changedSlugs[shortSlug]
+	return changed && time.Now().Before(until)
 }
 
 // Exists returns true if the short slug is already persisted in the cache or in the database.
-func (persistenceManager *PersistenceManager) Exists(shortSlug string) bool {
-	return persistenceManager.cachePersistence.Exists(shortSlug) ||
-		persistenceManager.databasePersistence.Exists(shortSlug)
+func (persistenceManager *PersistenceManager) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	existsInCache, err := persistenceManager.cachePersistence.Exists(cacheCtx, shortSlug)
+	cancel()
+	logCacheError("Exists() - cache Exists", err)
+	if existsInCache {
+		return true, nil
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return persistenceManager.databasePersistence.Exists(databaseCtx, shortSlug)
+}
+
+// GetUrlData returns the url data of the short slug from the primary database, as the cached copy
+// and the read replicas may not have caught up with an update yet.
+// Returns ErrNotFound or ErrExpired if there is no valid url data.
+func (persistenceManager *PersistenceManager) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	linkStore, supported := persistenceManager.databasePersistence.(LinkStore)
+	if !supported {
+		return model.UrlData{}, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return linkStore.GetUrlDataFromPrimary(databaseCtx, shortSlug)
+}
+
+// UpdateUrlData replaces the real url, the expire time and the tags of the short slug and removes it from the cache,
+// so that the next redirect reads the new url data from the database.
+// Returns ErrNotFound or ErrExpired if there is no valid url data.
+func (persistenceManager *PersistenceManager) UpdateUrlData(ctx context.Context, urlData model.UrlData) error {
+	linkStore, supported := persistenceManager.databasePersistence.(LinkStore)
+	if !supported {
+		return ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	err := linkStore.UpdateUrlData(databaseCtx, urlData)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	persistenceManager.invalidate(urlData.ShortSlug)
+	return nil
+}
+
+// DeleteUrlData expires the url data of the short slug in the database and removes it from the cache.
+// The short slug is not reused until the reuse cooldown passes. Returns ErrNotFound or ErrExpired
+// if there is no valid url data.
+func (persistenceManager *PersistenceManager) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	linkStore, supported := persistenceManager.databasePersistence.(LinkStore)
+	if !supported {
+		return ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	err := linkStore.DeleteUrlData(databaseCtx, shortSlug)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	persistenceManager.invalidate(shortSlug)
+	return nil
+}
+
+// invalidate removes the url data which has been changed in the database from the cache.
+// The cache is cleared even if the caller gives up, as the database has already been changed.
+func (persistenceManager *PersistenceManager) invalidate(shortSlug string) {
+	persistenceManager.markChanged(shortSlug)
+	persistenceManager.deleteUrlDataFromCache(context.Background(), shortSlug)
 }
 
-// Close closes the database persistence and the cache persistence.
-func (persistenceManager *PersistenceManager) Close() {
-	persistenceManager.databasePersistence.Close()
-	persistenceManager.cachePersistence.Close()
+// SaveApiKey saves the api key. The api keys are kept in the database only.
+func (persistenceManager *PersistenceManager) SaveApiKey(ctx context.Context, apiKey model.ApiKey) error {
+	apiKeyStore, supported := persistenceManager.databasePersistence.(ApiKeyStore)
+	if !supported {
+		return ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return apiKeyStore.SaveApiKey(databaseCtx, apiKey)
+}
+
+// GetApiKey returns the api key given its hash or ErrNotFound if there is no such api key.
+// It is read from the database on every call, so a revoked key is rejected right away.
+func (persistenceManager *PersistenceManager) GetApiKey(ctx context.Context, keyHash string) (model.ApiKey, error) {
+	apiKeyStore, supported := persistenceManager.databasePersistence.(ApiKeyStore)
+	if !supported {
+		return model.ApiKey{}, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return apiKeyStore.GetApiKey(databaseCtx, keyHash)
+}
+
+// DeleteApiKey revokes the api key given its hash or returns ErrNotFound if there is no such api key.
+func (persistenceManager *PersistenceManager) DeleteApiKey(ctx context.Context, keyHash string) error {
+	apiKeyStore, supported := persistenceManager.databasePersistence.(ApiKeyStore)
+	if !supported {
+		return ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return apiKeyStore.DeleteApiKey(databaseCtx, keyHash)
+}
+
+// ListUrlData returns the url data matching the query, newest first. The listing is read from the database only.
+func (persistenceManager *PersistenceManager) ListUrlData(ctx context.Context,
+	query UrlDataQuery) ([]model.UrlData, error) {
+	linkLister, supported := persistenceManager.databasePersistence.(LinkLister)
+	if !supported {
+		return nil, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return linkLister.ListUrlData(databaseCtx, query)
+}
+
+// GetArchivedUrlData returns the history of the short slug - the expired url data which has been archived
+// for it, newest first. The archive is read from the database only, as it is not used for the redirects.
+func (persistenceManager *PersistenceManager) GetArchivedUrlData(ctx context.Context,
+	shortSlug string) ([]model.ArchivedUrlData, error) {
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return persistenceManager.databasePersistence.GetArchivedUrlData(databaseCtx, shortSlug)
+}
+
+// SupportsSlugKeys reports whether the database persistence can keep the slug key pool, see SlugKeyStore.
+func (persistenceManager *PersistenceManager) SupportsSlugKeys() bool {
+	_, supported := persistenceManager.databasePersistence.(SlugKeyStore)
+	return supported
+}
+
+// SaveSlugKeys adds the short slugs which are not taken to the slug key pool and returns how many have been added.
+func (persistenceManager *PersistenceManager) SaveSlugKeys(ctx context.Context, shortSlugs []string) (int, error) {
+	slugKeyStore, supported := persistenceManager.databasePersistence.(SlugKeyStore)
+	if !supported {
+		return 0, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return slugKeyStore.SaveSlugKeys(databaseCtx, shortSlugs)
+}
+
+// ClaimSlugKeys takes at most limit short slugs out of the slug key pool for the exclusive use of the caller.
+func (persistenceManager *PersistenceManager) ClaimSlugKeys(ctx context.Context, limit int) ([]string, error) {
+	slugKeyStore, supported := persistenceManager.databasePersistence.(SlugKeyStore)
+	if !supported {
+		return nil, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return slugKeyStore.ClaimSlugKeys(databaseCtx, limit)
+}
+
+// CountSlugKeys returns how many short slugs are left in the slug key pool.
+func (persistenceManager *PersistenceManager) CountSlugKeys(ctx context.Context) (int, error) {
+	slugKeyStore, supported := persistenceManager.databasePersistence.(SlugKeyStore)
+	if !supported {
+		return 0, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return slugKeyStore.CountSlugKeys(databaseCtx)
+}
+
+// CountShortSlugs returns how many url data, even expired ones, have a short slug of the length.
+func (persistenceManager *PersistenceManager) CountShortSlugs(ctx context.Context, length int) (int, error) {
+	shortSlugCounter, supported := persistenceManager.databasePersistence.(ShortSlugCounter)
+	if !supported {
+		return 0, ErrUnsupported
+	}
+
+	databaseCtx, cancel := persistenceManager.databaseContext(ctx)
+	defer cancel()
+
+	return shortSlugCounter.CountShortSlugs(databaseCtx, length)
+}
+
+// Close stops the expiry sweeper and closes the database persistence and the cache persistence.
+// Both are closed even if one of them fails and the first error is returned.
+func (persistenceManager *PersistenceManager) Close() error {
+	if persistenceManager.expirySweeper != nil {
+		persistenceManager.expirySweeper.Stop()
+	}
+
+	databaseErr := persistenceManager.databasePersistence.Close()
+	cacheErr := persistenceManager.cachePersistence.Close()
+
+	if databaseErr != nil {
+		return databaseErr
+	}
+	return cacheErr
+}
+
+func (persistenceManager *PersistenceManager) saveUrlDataInCache(ctx context.Context, urlData model.UrlData) {
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	defer cancel()
+
+	err := persistenceManager.cachePersistence.SaveUrlData(cacheCtx, urlData)
+	logCacheError("saveUrlDataInCache", err)
+}
+
+// deleteUrlDataFromCache removes the url data from the cache. The failure is only logged, as the database
+// has already been changed, so the old url data may be served until it expires from the cache.
+func (persistenceManager *PersistenceManager) deleteUrlDataFromCache(ctx context.Context, shortSlug string) {
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	defer cancel()
+
+	err := persistenceManager.cachePersistence.DeleteUrlData(cacheCtx, shortSlug)
+	logCacheError("deleteUrlDataFromCache", err)
+}
+
+// saveUnknownSlugInCache caches the short slug as unknown.
+// SaveUrlData saves the url data in the cache after it is stored in the database, which forgets the unknown short slug.
+// If that cache call fails, the short slug stays unknown for at most unknownSlugTtl, which is why it is kept short.
+func (persistenceManager *PersistenceManager) saveUnknownSlugInCache(ctx context.Context, shortSlug string) {
+	cacheCtx, cancel := persistenceManager.cacheContext(ctx)
+	defer cancel()
+
+	err := persistenceManager.cachePersistence.SaveUnknownSlug(cacheCtx, shortSlug,
+		time.Now().Add(persistenceManager.unknownSlugTtl))
+	logCacheError("saveUnknownSlugInCache", err)
+}
+
+// Stats returns the monitoring values reported by the database and the cache.
+func (persistenceManager *PersistenceManager) Stats() Stats {
+	stats := make(Stats)
+	collectStats(stats, persistenceManager.databasePersistence)
+	collectStats(stats, persistenceManager.cachePersistence)
+	if persistenceManager.expirySweeper != nil {
+		collectStats(stats, persistenceManager.expirySweeper)
+	}
+
+	return stats
+}
+
+// logCacheError logs a failed cache operation.
+// The failures while the cache circuit breaker is open are expected, so they are not logged.
+func logCacheError(operation string, err error) {
+	if err != nil && !errors.Is(err, ErrCircuitOpen) {
+		log.Printf("Error in PersistenceManager.%s(): %v.\n", operation, err)
+	}
+}
+
+// databaseContext derives the context of a single database operation.
+func (persistenceManager *PersistenceManager) databaseContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, persistenceManager.databaseTimeout)
+}
+
+// cacheContext derives the context of a single cache operation.
+func (persistenceManager *PersistenceManager) cacheContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, persistenceManager.cacheTimeout)
+}
+
+// withTimeout adds the timeout to the context. A zero timeout keeps only the deadline of the parent context.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
 }
@@ -1,10 +1,13 @@
 package storage_test
 
 import (
+	"context"
+	"errors"
 	"github.com/gdgenchev/urlshortener/internal/model"
 	"github.com/gdgenchev/urlshortener/internal/storage"
 	testing_utils "github.com/gdgenchev/urlshortener/internal/testing"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,7 +25,7 @@ func TestMain(m *testing.M) {
 
 func setUp() {
 	testPersistence = testing_utils.NewTestPersistence()
-	persistenceManager = storage.NewPersistenceManager(testPersistence.GetTestConfiguration())
+	persistenceManager = testPersistence.NewPersistenceManager()
 
 	testShortSlug := "test-short-slug"
 	testRealUrl := "http://very-long-real-url.com"
@@ -39,47 +42,47 @@ func cleanUp() {
 func TestCreateNewShortUrlWhenUnique(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	ok := persistenceManager.SaveUrlData(testUrlData)
+	err := persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	if !ok {
-		t.Errorf("Could not save url data - short slug already exists.")
+	if err != nil {
+		t.Errorf("Could not save url data: %v.", err)
 	}
 }
 
 func TestCreateNewShortUrlWhenPresentInCache(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	ok := persistenceManager.SaveUrlData(testUrlData)
+	err := persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	if ok {
-		t.Errorf("Saved duplicate url data.")
+	if err != storage.ErrDuplicate {
+		t.Errorf("Expected ErrDuplicate for duplicate url data, got: %v.", err)
 	}
 }
 
 func TestCreateNewShortUrlWhenNotPresentInCacheButPresentInDatabase(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
 	testPersistence.FlushTestCache()
 
-	ok := persistenceManager.SaveUrlData(testUrlData)
+	err := persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	if ok {
-		t.Errorf("Saved duplicate url data.")
+	if err != storage.ErrDuplicate {
+		t.Errorf("Expected ErrDuplicate for duplicate url data, got: %v.", err)
 	}
 }
 
 func TestGetRealUrlWhenPresentInCache(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	foundRealUrl, found := persistenceManager.GetRealUrl(testUrlData.ShortSlug)
-	if !found {
-		t.Errorf("Real url: %s for short slug: %s was not found.", testUrlData.RealUrl, testUrlData.ShortSlug)
+	foundRealUrl, err := persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil {
+		t.Errorf("Real url: %s for short slug: %s was not found: %v.", testUrlData.RealUrl, testUrlData.ShortSlug, err)
 	} else {
 		if foundRealUrl != testUrlData.RealUrl {
 			t.Errorf("Expected real url: %s, got: %s.", testUrlData.RealUrl, foundRealUrl)
@@ -90,13 +93,13 @@ func TestGetRealUrlWhenPresentInCache(t *testing.T) {
 func TestGetRealUrlWhenNotPresentInCacheButPresentInDatabase(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
 	testPersistence.FlushTestCache()
 
-	foundRealUrl, found := persistenceManager.GetRealUrl(testUrlData.ShortSlug)
-	if !found {
-		t.Errorf("Real url: %s for short slug: %s  was not found.", testUrlData.RealUrl, testUrlData.ShortSlug)
+	foundRealUrl, err := persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil {
+		t.Errorf("Real url: %s for short slug: %s  was not found: %v.", testUrlData.RealUrl, testUrlData.ShortSlug, err)
 	} else {
 		if foundRealUrl != testUrlData.RealUrl {
 			t.Errorf("Expected real url: %s, got: %s.", testUrlData.RealUrl, foundRealUrl)
@@ -113,19 +116,20 @@ func TestGetRealUrlWhenNotPresentInCacheButPresentInDatabase(t *testing.T) {
 func TestGetRealUrlWhenNotPresentAnywhere(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	realUrl, found := persistenceManager.GetRealUrl(testUrlData.ShortSlug)
-	if found {
-		t.Errorf("GetRealUrl found inexistent real url: %s for short slug: %s", realUrl, testUrlData.ShortSlug)
+	realUrl, err := persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != storage.ErrNotFound {
+		t.Errorf("GetRealUrl found inexistent real url: %s for short slug: %s, error: %v", realUrl,
+			testUrlData.ShortSlug, err)
 	}
 }
 
 func TestExistsWhenPresentInCache(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
-	exists := persistenceManager.Exists(testUrlData.ShortSlug)
-	if !exists {
+	exists, err := persistenceManager.Exists(context.Background(), testUrlData.ShortSlug)
+	if !exists || err != nil {
 		t.Errorf("The url data for short slug: %s was not found.", testUrlData.ShortSlug)
 	}
 }
@@ -133,12 +137,467 @@ func TestExistsWhenPresentInCache(t *testing.T) {
 func TestExistsWhenNotPresentInCacheButPresentInDatabase(t *testing.T) {
 	testPersistence.FlushTestPersistence()
 
-	persistenceManager.SaveUrlData(testUrlData)
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
 
 	testPersistence.FlushTestCache()
 
-	exists := persistenceManager.Exists(testUrlData.ShortSlug)
-	if !exists {
+	exists, err := persistenceManager.Exists(context.Background(), testUrlData.ShortSlug)
+	if !exists || err != nil {
 		t.Errorf("The url data for short slug: %s was not found.", testUrlData.ShortSlug)
 	}
 }
+
+func TestGetRealUrlWhenExpired(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	expiredUrlData := testUrlData
+	expiredUrlData.Expires = model.CustomTime{Time: time.Now().Add(-time.Minute)}
+	persistenceManager.SaveUrlData(context.Background(), expiredUrlData)
+
+	realUrl, err := persistenceManager.GetRealUrl(context.Background(), expiredUrlData.ShortSlug)
+	if err != storage.ErrExpired {
+		t.Errorf("GetRealUrl found expired real url: %s for short slug: %s, error: %v", realUrl,
+			expiredUrlData.ShortSlug, err)
+	}
+}
+
+func TestCreateNewShortUrlWhenPreviousHasExpired(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	expiredUrlData := testUrlData
+	expiredUrlData.Expires = model.CustomTime{Time: time.Now().Add(-time.Minute)}
+	persistenceManager.SaveUrlData(context.Background(), expiredUrlData)
+
+	err := persistenceManager.SaveUrlData(context.Background(), testUrlData)
+
+	if err != nil {
+		t.Errorf("Could not save url data over an expired short slug: %v.", err)
+	}
+}
+
+func TestGetRealUrlWhenCacheIsUnavailable(t *testing.T) {
+	databasePersistence := storage.NewMemoryDatabasePersistence()
+	cachePersistence := testing_utils.NewFaultyCachePersistence(storage.NewMemoryCachePersistence())
+	faultyPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, cachePersistence)
+
+	cachePersistence.SetDown(true)
+
+	if err := faultyPersistenceManager.SaveUrlData(context.Background(), testUrlData); err != nil {
+		t.Fatalf("Could not save url data while the cache is unavailable: %v.", err)
+	}
+
+	foundRealUrl, err := faultyPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil {
+		t.Errorf("GetRealUrl did not fall back to the database: %v.", err)
+	} else if foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s, got: %s.", testUrlData.RealUrl, foundRealUrl)
+	}
+}
+
+func TestGetRealUrlWhenDatabaseIsUnavailable(t *testing.T) {
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	faultyPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewMemoryCachePersistence())
+
+	databasePersistence.SetDown(true)
+
+	_, err := faultyPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable while the database is unavailable, got: %v.", err)
+	}
+}
+
+func TestGetRealUrlWhenCacheIsSlower(t *testing.T) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.Storage.CacheTimeoutMillis = 10
+
+	databasePersistence := storage.NewMemoryDatabasePersistence()
+	cachePersistence := testing_utils.NewFaultyCachePersistence(storage.NewMemoryCachePersistence())
+	slowPersistenceManager := storage.NewPersistenceManagerWithBackends(configuration,
+		databasePersistence, cachePersistence)
+
+	if err := slowPersistenceManager.SaveUrlData(context.Background(), testUrlData); err != nil {
+		t.Fatalf("Could not save url data: %v.", err)
+	}
+
+	cachePersistence.SetDelay(time.Minute)
+
+	start := time.Now()
+	foundRealUrl, err := slowPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s from the database, got: %s, error: %v.", testUrlData.RealUrl, foundRealUrl, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetRealUrl waited for the slow cache: %v.", elapsed)
+	}
+}
+
+func TestGetRealUrlWhenRequestContextIsDone(t *testing.T) {
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	slowPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewNoCachePersistence())
+
+	databasePersistence.SetDelay(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := slowPersistenceManager.GetRealUrl(ctx, testUrlData.ShortSlug)
+	if !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable after the request context is done, got: %v.", err)
+	}
+}
+
+// getRealUrlConcurrently calls GetRealUrl for the short slug from many goroutines at once and returns their errors.
+func getRealUrlConcurrently(persistenceManager *storage.PersistenceManager, shortSlug string, callers int) []error {
+	errs := make([]error, callers)
+	start := make(chan struct{})
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			<-start
+			_, errs[i] = persistenceManager.GetRealUrl(context.Background(), shortSlug)
+		}(i)
+	}
+
+	close(start)
+	waitGroup.Wait()
+
+	return errs
+}
+
+func TestGetRealUrlCoalescesConcurrentCacheMisses(t *testing.T) {
+	memoryDatabasePersistence := storage.NewMemoryDatabasePersistence()
+	memoryDatabasePersistence.SaveUrlData(context.Background(), testUrlData)
+
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(memoryDatabasePersistence)
+	cachePersistence := testing_utils.NewFaultyCachePersistence(storage.NewMemoryCachePersistence())
+	coalescingPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, cachePersistence)
+
+	// The slow database keeps the lookup in flight while all the callers miss the cache
+	databasePersistence.SetDelay(100 * time.Millisecond)
+
+	const callers = 50
+	for _, err := range getRealUrlConcurrently(coalescingPersistenceManager, testUrlData.ShortSlug, callers) {
+		if err != nil {
+			t.Fatalf("Real url for short slug: %s was not found: %v.", testUrlData.ShortSlug, err)
+		}
+	}
+
+	if calls := databasePersistence.Calls(); calls != 1 {
+		t.Errorf("Expected a single database lookup for %d concurrent cache misses, got: %d.", callers, calls)
+	}
+	// Every caller reads the cache once and the shared lookup saves the url data in it once
+	if calls := cachePersistence.Calls(); calls != callers+1 {
+		t.Errorf("Expected %d cache calls, got: %d.", callers+1, calls)
+	}
+
+	// The lookup is over, so the next caller is served by the cache
+	coalescingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if calls := databasePersistence.Calls(); calls != 1 {
+		t.Errorf("Expected no database lookup after the url data is cached, got: %d.", calls-1)
+	}
+}
+
+func TestGetRealUrlSharesLookupErrors(t *testing.T) {
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	coalescingPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewNoCachePersistence())
+
+	databasePersistence.SetDelay(100 * time.Millisecond)
+
+	for _, err := range getRealUrlConcurrently(coalescingPersistenceManager, "missing-short-slug", 20) {
+		if err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for an inexistent short slug, got: %v.", err)
+		}
+	}
+
+	if calls := databasePersistence.Calls(); calls != 1 {
+		t.Errorf("Expected a single database lookup, got: %d.", calls)
+	}
+}
+
+func TestGetRealUrlWaiterContextDoesNotCancelSharedLookup(t *testing.T) {
+	memoryDatabasePersistence := storage.NewMemoryDatabasePersistence()
+	memoryDatabasePersistence.SaveUrlData(context.Background(), testUrlData)
+
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(memoryDatabasePersistence)
+	coalescingPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewNoCachePersistence())
+
+	databasePersistence.SetDelay(100 * time.Millisecond)
+
+	// The first caller starts the lookup and gives up before it completes
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go coalescingPersistenceManager.GetRealUrl(ctx, testUrlData.ShortSlug)
+	time.Sleep(5 * time.Millisecond)
+
+	foundRealUrl, err := coalescingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s, got: %s, error: %v.", testUrlData.RealUrl, foundRealUrl, err)
+	}
+	if calls := databasePersistence.Calls(); calls != 1 {
+		t.Errorf("Expected the second caller to join the lookup of the first one, got: %d lookups.", calls)
+	}
+}
+
+func newUnknownSlugPersistenceManager(unknownSlugTtlMillis int) (*storage.PersistenceManager,
+	*testing_utils.FaultyDatabasePersistence) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.Storage.UnknownSlugTtlMillis = unknownSlugTtlMillis
+
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	return storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+		storage.NewMemoryCachePersistence()), databasePersistence
+}
+
+func TestGetRealUrlCachesUnknownSlug(t *testing.T) {
+	unknownSlugPersistenceManager, databasePersistence := newUnknownSlugPersistenceManager(60000)
+
+	for i := 0; i < 3; i++ {
+		_, err := unknownSlugPersistenceManager.GetRealUrl(context.Background(), "missing-short-slug")
+		if err != storage.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for an inexistent short slug, got: %v.", err)
+		}
+	}
+
+	if calls := databasePersistence.Calls(); calls != 1 {
+		t.Errorf("Expected a single database lookup of the unknown short slug, got: %d.", calls)
+	}
+}
+
+func TestSaveUrlDataForgetsUnknownSlug(t *testing.T) {
+	unknownSlugPersistenceManager, _ := newUnknownSlugPersistenceManager(60000)
+
+	unknownSlugPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+
+	if err := unknownSlugPersistenceManager.SaveUrlData(context.Background(), testUrlData); err != nil {
+		t.Fatalf("Could not save url data for an unknown short slug: %v.", err)
+	}
+
+	foundRealUrl, err := unknownSlugPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s after saving it, got: %s, error: %v.", testUrlData.RealUrl, foundRealUrl, err)
+	}
+}
+
+func TestSaveUrlDataBatchSavesInCache(t *testing.T) {
+	unknownSlugPersistenceManager, databasePersistence := newUnknownSlugPersistenceManager(60000)
+	unknownSlugPersistenceManager.SaveUrlData(context.Background(), testUrlData)
+	unknownSlugPersistenceManager.GetRealUrl(context.Background(), "batch-short-slug")
+
+	batchUrlData := testUrlData
+	batchUrlData.ShortSlug = "batch-short-slug"
+	errs := unknownSlugPersistenceManager.SaveUrlDataBatch(context.Background(),
+		[]model.UrlData{batchUrlData, testUrlData}, false)
+	if errs[0] != nil || errs[1] != storage.ErrDuplicate {
+		t.Fatalf("Expected the first url data to be saved and the second to be a duplicate, got: %v.", errs)
+	}
+
+	// The saved url data is served by the cache, which has forgotten that its short slug was unknown
+	databasePersistence.SetDown(true)
+	foundRealUrl, err := unknownSlugPersistenceManager.GetRealUrl(context.Background(), batchUrlData.ShortSlug)
+	if err != nil || foundRealUrl != batchUrlData.RealUrl {
+		t.Errorf("Expected real url: %s from the cache, got: %s, error: %v.", batchUrlData.RealUrl, foundRealUrl, err)
+	}
+}
+
+func TestGetRealUrlWhenUnknownSlugHasExpired(t *testing.T) {
+	unknownSlugPersistenceManager, databasePersistence := newUnknownSlugPersistenceManager(10)
+
+	unknownSlugPersistenceManager.GetRealUrl(context.Background(), "missing-short-slug")
+	time.Sleep(20 * time.Millisecond)
+	unknownSlugPersistenceManager.GetRealUrl(context.Background(), "missing-short-slug")
+
+	if calls := databasePersistence.Calls(); calls != 2 {
+		t.Errorf("Expected a new database lookup after the unknown short slug has expired, got: %d lookups.", calls)
+	}
+}
+
+func TestUpdateUrlDataStopsRedirectingToOldRealUrl(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
+	persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+
+	updatedUrlData := testUrlData
+	updatedUrlData.RealUrl = "http://updated-real-url.com"
+	if err := persistenceManager.UpdateUrlData(context.Background(), updatedUrlData); err != nil {
+		t.Fatalf("Could not update url data: %v.", err)
+	}
+
+	foundRealUrl, err := persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != updatedUrlData.RealUrl {
+		t.Errorf("Expected real url: %s after the update, got: %s, error: %v.", updatedUrlData.RealUrl, foundRealUrl, err)
+	}
+}
+
+func TestDeleteUrlDataStopsRedirecting(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	persistenceManager.SaveUrlData(context.Background(), testUrlData)
+	persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+
+	if err := persistenceManager.DeleteUrlData(context.Background(), testUrlData.ShortSlug); err != nil {
+		t.Fatalf("Could not delete url data: %v.", err)
+	}
+
+	if _, err := persistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug); err != storage.ErrExpired {
+		t.Errorf("Expected ErrExpired for a deleted short slug, got: %v.", err)
+	}
+	if err := persistenceManager.DeleteUrlData(context.Background(), testUrlData.ShortSlug); err != storage.ErrExpired {
+		t.Errorf("Expected ErrExpired when deleting a deleted short slug, got: %v.", err)
+	}
+}
+
+// Two instances keep local copies on top of a shared cache, like two servers on top of a redis server.
+func TestDeleteUrlDataDropsLocalCopiesOfOtherInstances(t *testing.T) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.LocalCache.Size = 10
+	configuration.LocalCache.TtlMillis = 60000
+
+	databasePersistence := storage.NewMemoryDatabasePersistence()
+	sharedCachePersistence := storage.NewMemoryCachePersistence()
+	firstPersistenceManager := storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+		storage.NewLruCachePersistence(configuration, sharedCachePersistence))
+	secondPersistenceManager := storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+		storage.NewLruCachePersistence(configuration, sharedCachePersistence))
+
+	firstPersistenceManager.SaveUrlData(context.Background(), testUrlData)
+	if _, err := secondPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug); err != nil {
+		t.Fatalf("Real url for short slug: %s was not found: %v.", testUrlData.ShortSlug, err)
+	}
+
+	if err := firstPersistenceManager.DeleteUrlData(context.Background(), testUrlData.ShortSlug); err != nil {
+		t.Fatalf("Could not delete url data: %v.", err)
+	}
+
+	if _, err := secondPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug); err != storage.ErrExpired {
+		t.Errorf("Expected the other instance to stop redirecting a deleted short slug, got: %v.", err)
+	}
+}
+
+// staleReplicaDatabasePersistence reads the url data from a replica which has not caught up with the primary.
+type staleReplicaDatabasePersistence struct {
+	*storage.MemoryDatabasePersistence
+	staleUrlData model.UrlData
+}
+
+func (staleReplicaDatabasePersistence *staleReplicaDatabasePersistence) GetUrlData(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	return staleReplicaDatabasePersistence.staleUrlData, nil
+}
+
+func TestUpdateUrlDataIsNotHiddenByStaleReplica(t *testing.T) {
+	databasePersistence := &staleReplicaDatabasePersistence{
+		MemoryDatabasePersistence: storage.NewMemoryDatabasePersistence(), staleUrlData: testUrlData}
+	databasePersistence.SaveUrlData(context.Background(), testUrlData)
+	stalePersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewMemoryCachePersistence())
+
+	updatedUrlData := testUrlData
+	updatedUrlData.RealUrl = "http://updated-real-url.com"
+	if err := stalePersistenceManager.UpdateUrlData(context.Background(), updatedUrlData); err != nil {
+		t.Fatalf("Could not update url data: %v.", err)
+	}
+
+	foundRealUrl, err := stalePersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != updatedUrlData.RealUrl {
+		t.Errorf("Expected real url: %s after the update, got: %s, error: %v.", updatedUrlData.RealUrl, foundRealUrl, err)
+	}
+	foundUrlData, err := stalePersistenceManager.GetUrlData(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundUrlData.RealUrl != updatedUrlData.RealUrl {
+		t.Errorf("Expected url data with real url: %s, got: %v, error: %v.", updatedUrlData.RealUrl, foundUrlData, err)
+	}
+}
+
+// blockingDatabasePersistence returns the result of the first GetUrlData only once it is released,
+// which lets a test change the url data while it is looked up.
+type blockingDatabasePersistence struct {
+	*storage.MemoryDatabasePersistence
+	once     sync.Once
+	lookedUp chan struct{}
+	release  chan struct{}
+}
+
+func newBlockingDatabasePersistence() *blockingDatabasePersistence {
+	return &blockingDatabasePersistence{MemoryDatabasePersistence: storage.NewMemoryDatabasePersistence(),
+		lookedUp: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (blockingDatabasePersistence *blockingDatabasePersistence) GetUrlData(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	urlData, err := blockingDatabasePersistence.MemoryDatabasePersistence.GetUrlData(ctx, shortSlug)
+	blockingDatabasePersistence.once.Do(func() {
+		close(blockingDatabasePersistence.lookedUp)
+		<-blockingDatabasePersistence.release
+	})
+
+	return urlData, err
+}
+
+func TestGetRealUrlAfterSaveDuringUnknownSlugLookup(t *testing.T) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.Storage.UnknownSlugTtlMillis = 60000
+	databasePersistence := newBlockingDatabasePersistence()
+	cachePersistence := testing_utils.NewFaultyCachePersistence(storage.NewMemoryCachePersistence())
+	blockingPersistenceManager := storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+		cachePersistence)
+
+	lookupDone := make(chan struct{})
+	go func() {
+		blockingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+		close(lookupDone)
+	}()
+
+	// The url data is saved after the lookup has not found it, but before the short slug is cached as unknown.
+	// It does not reach the cache, so only the lookup can keep the unknown short slug from hiding it.
+	<-databasePersistence.lookedUp
+	cachePersistence.SetDown(true)
+	if err := blockingPersistenceManager.SaveUrlData(context.Background(), testUrlData); err != nil {
+		t.Fatalf("Could not save url data during its lookup: %v.", err)
+	}
+	cachePersistence.SetDown(false)
+	close(databasePersistence.release)
+	<-lookupDone
+
+	foundRealUrl, err := blockingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != testUrlData.RealUrl {
+		t.Errorf("Expected real url: %s after saving it during its lookup, got: %s, error: %v.",
+			testUrlData.RealUrl, foundRealUrl, err)
+	}
+}
+
+func TestUpdateUrlDataDuringLookupDoesNotCacheOldRealUrl(t *testing.T) {
+	databasePersistence := newBlockingDatabasePersistence()
+	databasePersistence.SaveUrlData(context.Background(), testUrlData)
+	invalidatingPersistenceManager := storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+		databasePersistence, storage.NewMemoryCachePersistence())
+
+	// The lookup has read the old url data, but has not cached it yet when the update completes
+	lookupDone := make(chan struct{})
+	go func() {
+		invalidatingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+		close(lookupDone)
+	}()
+	<-databasePersistence.lookedUp
+
+	updatedUrlData := testUrlData
+	updatedUrlData.RealUrl = "http://updated-real-url.com"
+	if err := invalidatingPersistenceManager.UpdateUrlData(context.Background(), updatedUrlData); err != nil {
+		t.Fatalf("Could not update url data: %v.", err)
+	}
+	close(databasePersistence.release)
+	<-lookupDone
+
+	foundRealUrl, err := invalidatingPersistenceManager.GetRealUrl(context.Background(), testUrlData.ShortSlug)
+	if err != nil || foundRealUrl != updatedUrlData.RealUrl {
+		t.Errorf("Expected real url: %s after the update, got: %s, error: %v.", updatedUrlData.RealUrl, foundRealUrl, err)
+	}
+}
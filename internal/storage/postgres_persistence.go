@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
+)
+
+// postgresUniqueViolation is the SQLSTATE code for a unique or primary key constraint violation.
+const postgresUniqueViolation = "23505"
+
+func init() {
+	RegisterDatabasePersistence(PostgresBackend, func(configuration util.Configuration) DatabasePersistence {
+		return NewPostgresPersistence(configuration)
+	})
+	databaseOpeners[PostgresBackend] = openPostgresDatabase
+}
+
+// PostgresPersistence is a DatabasePersistence backed by a PostgreSQL server.
+type PostgresPersistence struct {
+	*gormPersistence
+}
+
+func NewPostgresPersistence(configuration util.Configuration) *PostgresPersistence {
+	db, err := openPostgresDatabase(configuration)
+	if err != nil {
+		panic(err)
+	}
+
+	postgresPersistence := new(PostgresPersistence)
+	postgresPersistence.gormPersistence = &gormPersistence{db: db, isDuplicateKeyError: isPostgresDuplicateKeyError,
+		expiredUrlDataPolicy: newExpiredUrlDataPolicy(configuration)}
+
+	postgresPersistence.init()
+
+	return postgresPersistence
+}
+
+func openPostgresDatabase(configuration util.Configuration) (*gorm.DB, error) {
+	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		configuration.Postgres.Host, configuration.Postgres.Port, configuration.Postgres.User,
+		configuration.Postgres.Password, configuration.Postgres.Database, configuration.Postgres.SSLMode)
+	return gorm.Open("postgres", connectionString)
+}
+
+func (postgresPersistence *PostgresPersistence) init() {
+	migrateUp(postgresPersistence.db)
+}
+
+func isPostgresDuplicateKeyError(err error) bool {
+	postgresError, ok := err.(*pq.Error)
+	return ok && postgresError.Code == postgresUniqueViolation
+}
@@ -0,0 +1,186 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unreachableRedisConfiguration points every Redis mode to an address where nothing listens.
+func unreachableRedisConfiguration(mode string) util.Configuration {
+	var configuration util.Configuration
+	configuration.Redis.Mode = mode
+	configuration.Redis.Addrs = []string{"127.0.0.1:1"}
+	configuration.Redis.MasterName = "urlshortener"
+	configuration.Redis.PoolSize = 2
+	configuration.Redis.DialTimeoutMillis = 100
+	configuration.Redis.ReadTimeoutMillis = 100
+	configuration.Redis.WriteTimeoutMillis = 100
+
+	return configuration
+}
+
+func TestRedisCachePersistenceIsUnavailableInEveryMode(t *testing.T) {
+	for _, mode := range []string{storage.RedisStandalone, storage.RedisSentinel, storage.RedisCluster} {
+		t.Run(mode, func(t *testing.T) {
+			redisCachePersistence := storage.NewRedisCachePersistence(unreachableRedisConfiguration(mode))
+			defer redisCachePersistence.Close()
+
+			if err := redisCachePersistence.SaveUrlData(context.Background(), testUrlData); !errors.Is(err, storage.ErrUnavailable) {
+				t.Errorf("Expected ErrUnavailable from SaveUrlData, got: %v.", err)
+			}
+			if _, err := redisCachePersistence.GetUrlData(context.Background(), testUrlData.ShortSlug); !errors.Is(err, storage.ErrUnavailable) {
+				t.Errorf("Expected ErrUnavailable from GetUrlData, got: %v.", err)
+			}
+			if _, err := redisCachePersistence.Exists(context.Background(), testUrlData.ShortSlug); !errors.Is(err, storage.ErrUnavailable) {
+				t.Errorf("Expected ErrUnavailable from Exists, got: %v.", err)
+			}
+		})
+	}
+}
+
+func TestNewRedisCachePersistenceWithInvalidConfiguration(t *testing.T) {
+	unknownMode := unreachableRedisConfiguration("replicated")
+
+	sentinelWithoutMaster := unreachableRedisConfiguration(storage.RedisSentinel)
+	sentinelWithoutMaster.Redis.MasterName = ""
+
+	missingCAFile := unreachableRedisConfiguration(storage.RedisStandalone)
+	missingCAFile.Redis.TLS.Enabled = true
+	missingCAFile.Redis.TLS.CAFile = "testdata/missing-ca.pem"
+
+	configurations := map[string]util.Configuration{
+		"unknown mode":            unknownMode,
+		"sentinel without master": sentinelWithoutMaster,
+		"missing tls ca file":     missingCAFile,
+	}
+	for name, configuration := range configurations {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected NewRedisCachePersistence to panic.")
+				}
+			}()
+			storage.NewRedisCachePersistence(configuration)
+		})
+	}
+}
+
+// redisDeploymentConfiguration returns the configuration of a real Redis deployment of the mode, whose addresses
+// are taken from the environment variable, or skips the test if it is not set.
+func redisDeploymentConfiguration(t *testing.T, mode string, addrsVariable string) util.Configuration {
+	addrs := os.Getenv(addrsVariable)
+	if addrs == "" {
+		t.Skipf("Set %s to run the test against a Redis deployment in the %s mode.", addrsVariable, mode)
+	}
+
+	var configuration util.Configuration
+	configuration.Redis.Mode = mode
+	configuration.Redis.Addrs = strings.Split(addrs, ",")
+	configuration.Redis.MasterName = os.Getenv("REDIS_SENTINEL_MASTER")
+	configuration.Redis.Password = os.Getenv("REDIS_PASSWORD")
+
+	return configuration
+}
+
+// TestRedisCachePersistenceContract runs the CachePersistence contract in every Redis mode - against an embedded
+// server in the standalone mode and against the deployments named by REDIS_SENTINEL_ADDRS and REDIS_CLUSTER_ADDRS.
+func TestRedisCachePersistenceContract(t *testing.T) {
+	t.Run(storage.RedisStandalone, func(t *testing.T) {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("Could not start an embedded redis server: %v.", err)
+		}
+		defer server.Close()
+
+		var configuration util.Configuration
+		configuration.Redis.Addrs = []string{server.Addr()}
+		testCachePersistenceContract(t, storage.NewRedisCachePersistence(configuration))
+	})
+	t.Run(storage.RedisSentinel, func(t *testing.T) {
+		configuration := redisDeploymentConfiguration(t, storage.RedisSentinel, "REDIS_SENTINEL_ADDRS")
+		testCachePersistenceContract(t, storage.NewRedisCachePersistence(configuration))
+	})
+	t.Run(storage.RedisCluster, func(t *testing.T) {
+		configuration := redisDeploymentConfiguration(t, storage.RedisCluster, "REDIS_CLUSTER_ADDRS")
+		testCachePersistenceContract(t, storage.NewRedisCachePersistence(configuration))
+	})
+}
+
+// testCachePersistenceContract checks what the PersistenceManager expects from a CachePersistence.
+// In a cluster, it also checks that the url data key and the unknown short slug key are in the same hash slot,
+// as they are read with a single MGET and written in a single transaction.
+func testCachePersistenceContract(t *testing.T, cachePersistence storage.CachePersistence) {
+	defer cachePersistence.Close()
+
+	ctx := context.Background()
+	urlData := testUrlData
+	urlData.ShortSlug = "contract-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	if _, err := cachePersistence.GetUrlData(ctx, urlData.ShortSlug); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound on a cache miss, got: %v.", err)
+	}
+
+	if err := cachePersistence.SaveUnknownSlug(ctx, urlData.ShortSlug, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Could not save the unknown short slug: %v.", err)
+	}
+	if _, err := cachePersistence.GetUrlData(ctx, urlData.ShortSlug); err != storage.ErrUnknownSlug {
+		t.Errorf("Expected ErrUnknownSlug for an unknown short slug, got: %v.", err)
+	}
+	if exists, err := cachePersistence.Exists(ctx, urlData.ShortSlug); exists || err != nil {
+		t.Errorf("Expected an unknown short slug not to exist, got: %t, error: %v.", exists, err)
+	}
+
+	if err := cachePersistence.SaveUrlData(ctx, urlData); err != nil {
+		t.Fatalf("Could not save the url data: %v.", err)
+	}
+	foundUrlData, err := cachePersistence.GetUrlData(ctx, urlData.ShortSlug)
+	if err != nil || foundUrlData.RealUrl != urlData.RealUrl {
+		t.Errorf("Expected real url: %s, got: %s, error: %v.", urlData.RealUrl, foundUrlData.RealUrl, err)
+	}
+	if exists, err := cachePersistence.Exists(ctx, urlData.ShortSlug); !exists || err != nil {
+		t.Errorf("Expected the saved short slug to exist, got: %t, error: %v.", exists, err)
+	}
+
+	// The deletions are published to every instance sharing the cache
+	deleted := make(chan string, 100)
+	cachePersistence.(interface {
+		OnDeleteUrlData(handler func(shortSlug string))
+	}).OnDeleteUrlData(func(shortSlug string) { deleted <- shortSlug })
+
+	cachePersistence.SaveUnknownSlug(ctx, urlData.ShortSlug, time.Now().Add(time.Minute))
+	if err := cachePersistence.DeleteUrlData(ctx, urlData.ShortSlug); err != nil {
+		t.Fatalf("Could not delete the url data: %v.", err)
+	}
+	if _, err := cachePersistence.GetUrlData(ctx, urlData.ShortSlug); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted url data, got: %v.", err)
+	}
+	if !deletionPublished(ctx, cachePersistence, urlData.ShortSlug, deleted) {
+		t.Errorf("Expected the deletion of %s to be published.", urlData.ShortSlug)
+	}
+}
+
+// deletionPublished deletes the short slug until the deletion is received, as the subscription
+// may not be active yet when the first one is published.
+func deletionPublished(ctx context.Context, cachePersistence storage.CachePersistence, shortSlug string,
+	deleted <-chan string) bool {
+	for i := 0; i < 20; i++ {
+		select {
+		case deletedSlug := <-deleted:
+			if deletedSlug == shortSlug {
+				return true
+			}
+		case <-time.After(100 * time.Millisecond):
+			cachePersistence.DeleteUrlData(ctx, shortSlug)
+		}
+	}
+
+	return false
+}
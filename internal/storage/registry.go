@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"sort"
+	"sync"
+)
+
+// Names of the built-in backends, used in Configuration.Storage.Database and Configuration.Storage.Cache.
+// An empty value falls back to the MySQL database and the Redis cache.
+const (
+	MysqlBackend    = "mysql"
+	PostgresBackend = "postgres"
+	SqliteBackend   = "sqlite"
+	RedisBackend    = "redis"
+	MemoryBackend   = "memory"
+	NoCacheBackend  = "none"
+)
+
+// DatabasePersistenceFactory creates a DatabasePersistence from the configuration.
+type DatabasePersistenceFactory func(configuration util.Configuration) DatabasePersistence
+
+// CachePersistenceFactory creates a CachePersistence from the configuration.
+type CachePersistenceFactory func(configuration util.Configuration) CachePersistence
+
+var (
+	registryMutex                sync.RWMutex
+	databasePersistenceFactories = make(map[string]DatabasePersistenceFactory)
+	cachePersistenceFactories    = make(map[string]CachePersistenceFactory)
+)
+
+// RegisterDatabasePersistence makes a database backend available by the provided name.
+// It panics if the name is already registered, so it should be called from an init function.
+func RegisterDatabasePersistence(name string, factory DatabasePersistenceFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, registered := databasePersistenceFactories[name]; registered {
+		panic("database backend is already registered: " + name)
+	}
+	databasePersistenceFactories[name] = factory
+}
+
+// RegisterCachePersistence makes a cache backend available by the provided name.
+// It panics if the name is already registered, so it should be called from an init function.
+func RegisterCachePersistence(name string, factory CachePersistenceFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, registered := cachePersistenceFactories[name]; registered {
+		panic("cache backend is already registered: " + name)
+	}
+	cachePersistenceFactories[name] = factory
+}
+
+// DatabasePersistenceBackends returns the sorted names of the registered database backends.
+func DatabasePersistenceBackends() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(databasePersistenceFactories))
+	for name := range databasePersistenceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// CachePersistenceBackends returns the sorted names of the registered cache backends.
+func CachePersistenceBackends() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(cachePersistenceFactories))
+	for name := range cachePersistenceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewDatabasePersistence creates the database backend registered as Configuration.Storage.Database.
+func NewDatabasePersistence(configuration util.Configuration) DatabasePersistence {
+	name := databaseBackendName(configuration)
+
+	registryMutex.RLock()
+	factory, registered := databasePersistenceFactories[name]
+	registryMutex.RUnlock()
+
+	if !registered {
+		panic("unknown database backend: " + name)
+	}
+
+	return factory(configuration)
+}
+
+// databaseBackendName returns the configured database backend name, falling back to MySQL.
+func databaseBackendName(configuration util.Configuration) string {
+	if configuration.Storage.Database == "" {
+		return MysqlBackend
+	}
+
+	return configuration.Storage.Database
+}
+
+// NewCachePersistence creates the cache backend registered as Configuration.Storage.Cache.
+func NewCachePersistence(configuration util.Configuration) CachePersistence {
+	name := configuration.Storage.Cache
+	if name == "" {
+		name = RedisBackend
+	}
+
+	registryMutex.RLock()
+	factory, registered := cachePersistenceFactories[name]
+	registryMutex.RUnlock()
+
+	if !registered {
+		panic("unknown cache backend: " + name)
+	}
+
+	return factory(configuration)
+}
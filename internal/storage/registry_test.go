@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"testing"
+	"time"
+)
+
+var registeredDatabasePersistence = storage.NewMemoryDatabasePersistence()
+
+func init() {
+	storage.RegisterDatabasePersistence("test-database", func(configuration util.Configuration) storage.DatabasePersistence {
+		return registeredDatabasePersistence
+	})
+}
+
+func TestNewPersistenceManagerWithRegisteredBackends(t *testing.T) {
+	registeredDatabasePersistence.Flush()
+
+	var configuration util.Configuration
+	configuration.Storage.Database = "test-database"
+	configuration.Storage.Cache = storage.NoCacheBackend
+
+	registryPersistenceManager := storage.NewPersistenceManager(configuration)
+	defer registryPersistenceManager.Close()
+
+	urlData := model.UrlData{ShortSlug: "registry-short-slug", RealUrl: "http://registry-real-url.com",
+		Expires: model.CustomTime{Time: time.Now().Add(time.Hour)}}
+	if err := registryPersistenceManager.SaveUrlData(context.Background(), urlData); err != nil {
+		t.Fatalf("Could not save url data through the registered backends: %v.", err)
+	}
+
+	if exists, _ := registeredDatabasePersistence.Exists(context.Background(), urlData.ShortSlug); !exists {
+		t.Errorf("The url data was not saved in the registered database backend.")
+	}
+}
+
+func TestRegisterDatabasePersistenceTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering an already registered database backend did not panic.")
+		}
+	}()
+
+	storage.RegisterDatabasePersistence(storage.MemoryBackend, func(configuration util.Configuration) storage.DatabasePersistence {
+		return storage.NewMemoryDatabasePersistence()
+	})
+}
+
+func TestNewPersistenceManagerWithUnknownBackendPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Creating a persistence manager with an unknown cache backend did not panic.")
+		}
+	}()
+
+	var configuration util.Configuration
+	configuration.Storage.Database = storage.MemoryBackend
+	configuration.Storage.Cache = "unknown-cache"
+
+	storage.NewPersistenceManager(configuration)
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Used when the fields of ReplicaHealthCheck are not configured.
+const (
+	defaultReplicaHealthCheckInterval = 5 * time.Second
+	defaultReplicaHealthCheckTimeout  = time.Second
+	defaultReplicaMaxLag              = 10 * time.Second
+)
+
+// ReplicaPool spreads the lookups over the read replicas of a database in a round robin.
+// The replicas are pinged on every health check interval and, with a lag check, their replication lag is compared
+// to the configured maximum. A replica which fails the health check or a lookup is taken out of rotation
+// until it passes a health check again. Without a healthy replica Next returns nil,
+// so the lookups fall back to the primary.
+type ReplicaPool struct {
+	replicas            []*replica
+	next                uint32
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	maxLag              time.Duration
+	replicationLag      func(ctx context.Context, db *gorm.DB) (time.Duration, error)
+	stop                chan struct{}
+	stopped             chan struct{}
+	stopOnce            sync.Once
+	mutex               sync.Mutex
+	started             bool
+}
+
+type replica struct {
+	name    string
+	db      *gorm.DB
+	healthy int32
+}
+
+// maxReplicaStaleness returns for how long a replica in rotation may still serve the data replaced on the primary:
+// it may lag by up to ReplicaHealthCheck.MaxLagMillis and be noticed only by the next health check.
+func maxReplicaStaleness(configuration util.Configuration) time.Duration {
+	interval := time.Duration(configuration.ReplicaHealthCheck.IntervalMillis) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultReplicaHealthCheckInterval
+	}
+	maxLag := time.Duration(configuration.ReplicaHealthCheck.MaxLagMillis) * time.Millisecond
+	if maxLag <= 0 {
+		maxLag = defaultReplicaMaxLag
+	}
+
+	return maxLag + interval
+}
+
+func NewReplicaPool(configuration util.Configuration) *ReplicaPool {
+	replicaPool := new(ReplicaPool)
+
+	replicaPool.healthCheckInterval =
+		time.Duration(configuration.ReplicaHealthCheck.IntervalMillis) * time.Millisecond
+	if replicaPool.healthCheckInterval <= 0 {
+		replicaPool.healthCheckInterval = defaultReplicaHealthCheckInterval
+	}
+	replicaPool.healthCheckTimeout = time.Duration(configuration.ReplicaHealthCheck.TimeoutMillis) * time.Millisecond
+	if replicaPool.healthCheckTimeout <= 0 {
+		replicaPool.healthCheckTimeout = defaultReplicaHealthCheckTimeout
+	}
+	replicaPool.maxLag = time.Duration(configuration.ReplicaHealthCheck.MaxLagMillis) * time.Millisecond
+	if replicaPool.maxLag <= 0 {
+		replicaPool.maxLag = defaultReplicaMaxLag
+	}
+	replicaPool.stop = make(chan struct{})
+	replicaPool.stopped = make(chan struct{})
+
+	return replicaPool
+}
+
+// Add puts a replica in rotation. It must be called before Start.
+func (replicaPool *ReplicaPool) Add(name string, db *gorm.DB) {
+	replicaPool.replicas = append(replicaPool.replicas, &replica{name: name, db: db, healthy: 1})
+}
+
+// SetLagCheck makes the health check take the replicas which lag behind the primary by more than
+// ReplicaHealthCheck.MaxLagMillis out of rotation, as well as the ones whose lag cannot be read.
+// It must be called before Start.
+func (replicaPool *ReplicaPool) SetLagCheck(
+	replicationLag func(ctx context.Context, db *gorm.DB) (time.Duration, error)) {
+	replicaPool.replicationLag = replicationLag
+}
+
+// Next returns the next healthy replica or nil if there is none. It is safe to call on a nil ReplicaPool.
+func (replicaPool *ReplicaPool) Next() *gorm.DB {
+	if replicaPool == nil {
+		return nil
+	}
+
+	count := uint32(len(replicaPool.replicas))
+	for i := uint32(0); i < count; i++ {
+		replica := replicaPool.replicas[atomic.AddUint32(&replicaPool.next, 1)%count]
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			return replica.db
+		}
+	}
+
+	return nil
+}
+
+// MarkUnhealthy takes the replica out of rotation until it passes the next health check.
+func (replicaPool *ReplicaPool) MarkUnhealthy(db *gorm.DB) {
+	for _, replica := range replicaPool.replicas {
+		if replica.db == db && atomic.SwapInt32(&replica.healthy, 0) == 1 {
+			log.Printf("Replica %s is taken out of rotation after a failed lookup.\n", replica.name)
+		}
+	}
+}
+
+// CheckHealth pings every replica and puts in rotation only the ones which have answered
+// and, with a lag check, do not lag behind the primary too much.
+func (replicaPool *ReplicaPool) CheckHealth(ctx context.Context) {
+	for _, replica := range replicaPool.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, replicaPool.healthCheckTimeout)
+		err := replicaPool.checkReplica(checkCtx, replica)
+		cancel()
+
+		if err != nil {
+			if atomic.SwapInt32(&replica.healthy, 0) == 1 {
+				log.Printf("Replica %s is taken out of rotation: %v.\n", replica.name, err)
+			}
+			continue
+		}
+		if atomic.SwapInt32(&replica.healthy, 1) == 0 {
+			log.Printf("Replica %s is back in rotation.\n", replica.name)
+		}
+	}
+}
+
+func (replicaPool *ReplicaPool) checkReplica(ctx context.Context, replica *replica) error {
+	if err := replica.db.DB().PingContext(ctx); err != nil {
+		return err
+	}
+	if replicaPool.replicationLag == nil {
+		return nil
+	}
+
+	lag, err := replicaPool.replicationLag(ctx, replica.db)
+	if err != nil {
+		return err
+	}
+	if lag > replicaPool.maxLag {
+		return fmt.Errorf("replication lag of %v exceeds %v", lag, replicaPool.maxLag)
+	}
+
+	return nil
+}
+
+// Start checks the health of the replicas on every interval until Stop is called.
+func (replicaPool *ReplicaPool) Start() {
+	if len(replicaPool.replicas) == 0 {
+		return
+	}
+
+	replicaPool.mutex.Lock()
+	replicaPool.started = true
+	replicaPool.mutex.Unlock()
+
+	go replicaPool.run()
+}
+
+// Stop stops the health checks. It is safe to call more than once.
+func (replicaPool *ReplicaPool) Stop() {
+	replicaPool.stopOnce.Do(func() {
+		close(replicaPool.stop)
+	})
+
+	replicaPool.mutex.Lock()
+	started := replicaPool.started
+	replicaPool.mutex.Unlock()
+
+	if started {
+		<-replicaPool.stopped
+	}
+}
+
+// Close stops the health checks and closes the replica connections. It is safe to call on a nil ReplicaPool.
+func (replicaPool *ReplicaPool) Close() error {
+	if replicaPool == nil {
+		return nil
+	}
+
+	replicaPool.Stop()
+
+	var closeErr error
+	for _, replica := range replicaPool.replicas {
+		if err := replica.db.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
+
+// Stats returns how many of the replicas are in rotation.
+func (replicaPool *ReplicaPool) Stats() Stats {
+	healthy := 0
+	for _, replica := range replicaPool.replicas {
+		if atomic.LoadInt32(&replica.healthy) == 1 {
+			healthy++
+		}
+	}
+
+	return Stats{
+		"database.replicas.healthy": healthy,
+		"database.replicas.total":   len(replicaPool.replicas),
+	}
+}
+
+func (replicaPool *ReplicaPool) run() {
+	defer close(replicaPool.stopped)
+
+	ticker := time.NewTicker(replicaPool.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			replicaPool.CheckHealth(context.Background())
+		case <-replicaPool.stop:
+			return
+		}
+	}
+}
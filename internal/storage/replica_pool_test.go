@@ -0,0 +1,131 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+func newTestReplicaPool(t *testing.T, count int) (*storage.ReplicaPool, []*gorm.DB) {
+	var configuration util.Configuration
+	configuration.ReplicaHealthCheck.IntervalMillis = 10
+	configuration.ReplicaHealthCheck.TimeoutMillis = 100
+	configuration.ReplicaHealthCheck.MaxLagMillis = 10000
+
+	replicaPool := storage.NewReplicaPool(configuration)
+	replicas := make([]*gorm.DB, count)
+	for i := range replicas {
+		db, err := gorm.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("Could not open a replica: %v.", err)
+		}
+		replicas[i] = db
+		replicaPool.Add("replica-"+string(rune('a'+i)), db)
+	}
+
+	return replicaPool, replicas
+}
+
+func TestReplicaPoolRotatesOverReplicas(t *testing.T) {
+	replicaPool, replicas := newTestReplicaPool(t, 3)
+	defer replicaPool.Close()
+
+	served := make(map[*gorm.DB]int)
+	for i := 0; i < 9; i++ {
+		served[replicaPool.Next()]++
+	}
+
+	for i, replica := range replicas {
+		if served[replica] != 3 {
+			t.Errorf("Expected replica %d to serve 3 lookups, got: %d.", i, served[replica])
+		}
+	}
+}
+
+func TestReplicaPoolTakesFailingReplicasOutOfRotation(t *testing.T) {
+	replicaPool, replicas := newTestReplicaPool(t, 2)
+	defer replicaPool.Close()
+
+	replicas[0].Close()
+	replicaPool.CheckHealth(context.Background())
+
+	for i := 0; i < 4; i++ {
+		if replicaPool.Next() != replicas[1] {
+			t.Fatalf("Expected only the healthy replica to be in rotation.")
+		}
+	}
+	if healthy := replicaPool.Stats()["database.replicas.healthy"]; healthy != 1 {
+		t.Errorf("Expected 1 healthy replica, got: %v.", healthy)
+	}
+
+	replicaPool.MarkUnhealthy(replicas[1])
+	if replicaPool.Next() != nil {
+		t.Errorf("Expected no replica without a healthy one, so that the primary is used.")
+	}
+
+	// The replica which has only failed a lookup is put back by the next health check
+	replicaPool.CheckHealth(context.Background())
+	if replicaPool.Next() != replicas[1] {
+		t.Errorf("Expected the replica to be back in rotation after a passed health check.")
+	}
+}
+
+func TestReplicaPoolChecksHealthPeriodically(t *testing.T) {
+	replicaPool, replicas := newTestReplicaPool(t, 2)
+	defer replicaPool.Close()
+
+	replicaPool.MarkUnhealthy(replicas[0])
+	replicas[1].Close()
+	replicaPool.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for replicaPool.Next() != replicas[0] && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		if replicaPool.Next() != replicas[0] {
+			t.Fatalf("Expected the health checks to swap the replicas in rotation.")
+		}
+	}
+}
+
+func TestNilReplicaPoolHasNoReplica(t *testing.T) {
+	var replicaPool *storage.ReplicaPool
+
+	if replicaPool.Next() != nil {
+		t.Errorf("Expected no replica from a nil pool.")
+	}
+	if err := replicaPool.Close(); err != nil {
+		t.Errorf("Expected no error when closing a nil pool, got: %v.", err)
+	}
+}
+
+func TestReplicaPoolTakesLaggingReplicasOutOfRotation(t *testing.T) {
+	replicaPool, replicas := newTestReplicaPool(t, 3)
+	defer replicaPool.Close()
+
+	// The first replica is up to date, the second one lags too much and the replication of the third one is stopped
+	replicationLags := map[*gorm.DB]time.Duration{replicas[0]: time.Second, replicas[1]: time.Minute}
+	replicaPool.SetLagCheck(func(ctx context.Context, db *gorm.DB) (time.Duration, error) {
+		lag, replicating := replicationLags[db]
+		if !replicating {
+			return 0, errors.New("the replication is stopped")
+		}
+		return lag, nil
+	})
+	replicaPool.CheckHealth(context.Background())
+
+	for i := 0; i < 4; i++ {
+		if replicaPool.Next() != replicas[0] {
+			t.Fatalf("Expected only the replica within the maximum lag to be in rotation.")
+		}
+	}
+	if healthy := replicaPool.Stats()["database.replicas.healthy"]; healthy != 1 {
+		t.Errorf("Expected 1 healthy replica, got: %v.", healthy)
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	RegisterDatabasePersistence(SqliteBackend, func(configuration util.Configuration) DatabasePersistence {
+		return NewSqlitePersistence(configuration)
+	})
+	databaseOpeners[SqliteBackend] = openSqliteDatabase
+}
+
+// SqlitePersistence is a DatabasePersistence backed by a local SQLite file.
+// It allows running the url shortener as a single binary without a database server.
+type SqlitePersistence struct {
+	*gormPersistence
+}
+
+func NewSqlitePersistence(configuration util.Configuration) *SqlitePersistence {
+	db, err := openSqliteDatabase(configuration)
+	if err != nil {
+		panic(err)
+	}
+
+	sqlitePersistence := new(SqlitePersistence)
+	sqlitePersistence.gormPersistence = &gormPersistence{db: db, isDuplicateKeyError: isSqliteDuplicateKeyError,
+		expiredUrlDataPolicy: newExpiredUrlDataPolicy(configuration)}
+
+	sqlitePersistence.init()
+
+	return sqlitePersistence
+}
+
+func openSqliteDatabase(configuration util.Configuration) (*gorm.DB, error) {
+	db, err := gorm.Open("sqlite3", configuration.Sqlite.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows only a single writer, so the connections are serialized instead of failing with SQLITE_BUSY.
+	db.DB().SetMaxOpenConns(1)
+
+	return db, nil
+}
+
+func (sqlitePersistence *SqlitePersistence) init() {
+	migrateUp(sqlitePersistence.db)
+}
+
+func isSqliteDuplicateKeyError(err error) bool {
+	sqliteError, ok := err.(sqlite3.Error)
+	return ok && (sqliteError.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+		sqliteError.ExtendedCode == sqlite3.ErrConstraintUnique)
+}
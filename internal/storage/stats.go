@@ -0,0 +1,21 @@
+package storage
+
+// Stats holds monitoring values of the storage components, keyed by a dotted name such as "cache.hits".
+type Stats map[string]interface{}
+
+// StatsReporter is implemented by the storage components which expose values for monitoring.
+// The decorators include the stats of the components they wrap.
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// collectStats adds the stats of the component, if it reports any, to the provided stats.
+func collectStats(stats Stats, component interface{}) Stats {
+	if statsReporter, ok := component.(StatsReporter); ok {
+		for name, value := range statsReporter.Stats() {
+			stats[name] = value
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,313 @@
+package testing_utils
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"sync/atomic"
+	"time"
+)
+
+// fault holds the simulated failure of a backend and counts the calls to it. It is safe for concurrent use.
+type fault struct {
+	down  int32
+	delay int64
+	calls int64
+}
+
+// SetDown starts or stops the simulated outage.
+func (fault *fault) SetDown(down bool) {
+	var value int32
+	if down {
+		value = 1
+	}
+	atomic.StoreInt32(&fault.down, value)
+}
+
+// SetDelay makes every call wait for the delay or until its context is done, which simulates a slow backend.
+func (fault *fault) SetDelay(delay time.Duration) {
+	atomic.StoreInt64(&fault.delay, int64(delay))
+}
+
+// Calls returns how many calls have reached the backend.
+func (fault *fault) Calls() int {
+	return int(atomic.LoadInt64(&fault.calls))
+}
+
+// check counts a single call and returns its simulated failure.
+func (fault *fault) check(ctx context.Context) error {
+	atomic.AddInt64(&fault.calls, 1)
+
+	if delay := time.Duration(atomic.LoadInt64(&fault.delay)); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return storage.ErrUnavailable
+		}
+	}
+
+	if atomic.LoadInt32(&fault.down) == 1 {
+		return storage.ErrUnavailable
+	}
+
+	return nil
+}
+
+// FaultyDatabasePersistence wraps a DatabasePersistence and fails every call with storage.ErrUnavailable
+// while it is down, which simulates a database outage.
+type FaultyDatabasePersistence struct {
+	storage.DatabasePersistence
+	fault
+}
+
+func NewFaultyDatabasePersistence(databasePersistence storage.DatabasePersistence) *FaultyDatabasePersistence {
+	return &FaultyDatabasePersistence{DatabasePersistence: databasePersistence}
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return err
+	}
+	return faultyDatabasePersistence.DatabasePersistence.SaveUrlData(ctx, urlData)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData, allOrNothing bool) []error {
+	err := faultyDatabasePersistence.check(ctx)
+	linkBatchSaver, supported := faultyDatabasePersistence.DatabasePersistence.(storage.LinkBatchSaver)
+	if err == nil && !supported {
+		err = storage.ErrUnsupported
+	}
+	if err != nil {
+		errs := make([]error, len(urlData))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	return linkBatchSaver.SaveUrlDataBatch(ctx, urlData, allOrNothing)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return model.UrlData{}, err
+	}
+	return faultyDatabasePersistence.DatabasePersistence.GetUrlData(ctx, shortSlug)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return false, err
+	}
+	return faultyDatabasePersistence.DatabasePersistence.Exists(ctx, shortSlug)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) DeleteExpiredUrlData(ctx context.Context,
+	expiredBefore time.Time, limit int) (int, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return 0, err
+	}
+	return faultyDatabasePersistence.DatabasePersistence.DeleteExpiredUrlData(ctx, expiredBefore, limit)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) GetArchivedUrlData(ctx context.Context,
+	shortSlug string) ([]model.ArchivedUrlData, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return nil, err
+	}
+	return faultyDatabasePersistence.DatabasePersistence.GetArchivedUrlData(ctx, shortSlug)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) SaveSlugKeys(ctx context.Context,
+	shortSlugs []string) (int, error) {
+	slugKeyStore, err := faultyDatabasePersistence.slugKeyStore(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return slugKeyStore.SaveSlugKeys(ctx, shortSlugs)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) ClaimSlugKeys(ctx context.Context,
+	limit int) ([]string, error) {
+	slugKeyStore, err := faultyDatabasePersistence.slugKeyStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slugKeyStore.ClaimSlugKeys(ctx, limit)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) CountSlugKeys(ctx context.Context) (int, error) {
+	slugKeyStore, err := faultyDatabasePersistence.slugKeyStore(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return slugKeyStore.CountSlugKeys(ctx)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) CountShortSlugs(ctx context.Context,
+	length int) (int, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return 0, err
+	}
+	shortSlugCounter, supported := faultyDatabasePersistence.DatabasePersistence.(storage.ShortSlugCounter)
+	if !supported {
+		return 0, storage.ErrUnsupported
+	}
+	return shortSlugCounter.CountShortSlugs(ctx, length)
+}
+
+// slugKeyStore checks the simulated failure and returns the wrapped storage.SlugKeyStore.
+func (faultyDatabasePersistence *FaultyDatabasePersistence) slugKeyStore(ctx context.Context) (storage.SlugKeyStore,
+	error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return nil, err
+	}
+	slugKeyStore, supported := faultyDatabasePersistence.DatabasePersistence.(storage.SlugKeyStore)
+	if !supported {
+		return nil, storage.ErrUnsupported
+	}
+	return slugKeyStore, nil
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) GetUrlDataFromPrimary(ctx context.Context,
+	shortSlug string) (model.UrlData, error) {
+	linkStore, err := faultyDatabasePersistence.linkStore(ctx)
+	if err != nil {
+		return model.UrlData{}, err
+	}
+	return linkStore.GetUrlDataFromPrimary(ctx, shortSlug)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) UpdateUrlData(ctx context.Context,
+	urlData model.UrlData) error {
+	linkStore, err := faultyDatabasePersistence.linkStore(ctx)
+	if err != nil {
+		return err
+	}
+	return linkStore.UpdateUrlData(ctx, urlData)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	linkStore, err := faultyDatabasePersistence.linkStore(ctx)
+	if err != nil {
+		return err
+	}
+	return linkStore.DeleteUrlData(ctx, shortSlug)
+}
+
+// linkStore checks the simulated failure and returns the wrapped storage.LinkStore.
+func (faultyDatabasePersistence *FaultyDatabasePersistence) linkStore(ctx context.Context) (storage.LinkStore, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return nil, err
+	}
+	linkStore, supported := faultyDatabasePersistence.DatabasePersistence.(storage.LinkStore)
+	if !supported {
+		return nil, storage.ErrUnsupported
+	}
+	return linkStore, nil
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) SaveApiKey(ctx context.Context, apiKey model.ApiKey) error {
+	apiKeyStore, err := faultyDatabasePersistence.apiKeyStore(ctx)
+	if err != nil {
+		return err
+	}
+	return apiKeyStore.SaveApiKey(ctx, apiKey)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) GetApiKey(ctx context.Context,
+	keyHash string) (model.ApiKey, error) {
+	apiKeyStore, err := faultyDatabasePersistence.apiKeyStore(ctx)
+	if err != nil {
+		return model.ApiKey{}, err
+	}
+	return apiKeyStore.GetApiKey(ctx, keyHash)
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) DeleteApiKey(ctx context.Context, keyHash string) error {
+	apiKeyStore, err := faultyDatabasePersistence.apiKeyStore(ctx)
+	if err != nil {
+		return err
+	}
+	return apiKeyStore.DeleteApiKey(ctx, keyHash)
+}
+
+// apiKeyStore checks the simulated failure and returns the wrapped storage.ApiKeyStore.
+func (faultyDatabasePersistence *FaultyDatabasePersistence) apiKeyStore(ctx context.Context) (storage.ApiKeyStore,
+	error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return nil, err
+	}
+	apiKeyStore, supported := faultyDatabasePersistence.DatabasePersistence.(storage.ApiKeyStore)
+	if !supported {
+		return nil, storage.ErrUnsupported
+	}
+	return apiKeyStore, nil
+}
+
+func (faultyDatabasePersistence *FaultyDatabasePersistence) ListUrlData(ctx context.Context,
+	query storage.UrlDataQuery) ([]model.UrlData, error) {
+	if err := faultyDatabasePersistence.check(ctx); err != nil {
+		return nil, err
+	}
+	linkLister, supported := faultyDatabasePersistence.DatabasePersistence.(storage.LinkLister)
+	if !supported {
+		return nil, storage.ErrUnsupported
+	}
+	return linkLister.ListUrlData(ctx, query)
+}
+
+// FaultyCachePersistence wraps a CachePersistence and fails every call with storage.ErrUnavailable
+// while it is down, which simulates a cache outage.
+type FaultyCachePersistence struct {
+	storage.CachePersistence
+	fault
+}
+
+func NewFaultyCachePersistence(cachePersistence storage.CachePersistence) *FaultyCachePersistence {
+	return &FaultyCachePersistence{CachePersistence: cachePersistence}
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) SaveUrlData(ctx context.Context, urlData model.UrlData) error {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return err
+	}
+	return faultyCachePersistence.CachePersistence.SaveUrlData(ctx, urlData)
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) SaveUrlDataBatch(ctx context.Context,
+	urlData []model.UrlData) error {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return err
+	}
+	return faultyCachePersistence.CachePersistence.SaveUrlDataBatch(ctx, urlData)
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) SaveUnknownSlug(ctx context.Context, shortSlug string,
+	expires time.Time) error {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return err
+	}
+	return faultyCachePersistence.CachePersistence.SaveUnknownSlug(ctx, shortSlug, expires)
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) GetUrlData(ctx context.Context, shortSlug string) (model.UrlData, error) {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return model.UrlData{}, err
+	}
+	return faultyCachePersistence.CachePersistence.GetUrlData(ctx, shortSlug)
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) Exists(ctx context.Context, shortSlug string) (bool, error) {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return false, err
+	}
+	return faultyCachePersistence.CachePersistence.Exists(ctx, shortSlug)
+}
+
+func (faultyCachePersistence *FaultyCachePersistence) DeleteUrlData(ctx context.Context, shortSlug string) error {
+	if err := faultyCachePersistence.check(ctx); err != nil {
+		return err
+	}
+	return faultyCachePersistence.CachePersistence.DeleteUrlData(ctx, shortSlug)
+}
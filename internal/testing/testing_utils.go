@@ -4,18 +4,28 @@ import (
 	"context"
 	"fmt"
 	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
 	"github.com/gdgenchev/urlshortener/internal/util"
 	"github.com/go-redis/redis/v8"
 	"github.com/jinzhu/gorm"
+	"os"
 	"strconv"
 )
 
 const testingConfigFilePath = "../../config/config.testing.json"
 
+// schemaTables are the tables created by the schema migrations, dropped to start each test from an empty database.
+var schemaTables = []interface{}{model.UrlData{}, model.ArchivedUrlData{}, "slug_keys", model.ApiKey{}, "schema_version"}
+
+// TestPersistence prepares and flushes the backends selected in the testing configuration.
+// The in-memory backends are shared with the PersistenceManager returned by NewPersistenceManager,
+// while MySQL and Redis are accessed through separate clients.
 type TestPersistence struct {
-	configuration util.Configuration
-	db            *gorm.DB
-	redisClient   *redis.Client
+	configuration             util.Configuration
+	db                        *gorm.DB
+	redisClient               *redis.Client
+	memoryDatabasePersistence *storage.MemoryDatabasePersistence
+	memoryCachePersistence    *storage.MemoryCachePersistence
 }
 
 func NewTestPersistence() *TestPersistence {
@@ -33,7 +43,71 @@ func (testPersistence *TestPersistence) GetTestConfiguration() util.Configuratio
 	return testPersistence.configuration
 }
 
+// NewPersistenceManager creates a PersistenceManager on top of the test backends.
+func (testPersistence *TestPersistence) NewPersistenceManager() *storage.PersistenceManager {
+	var databasePersistence storage.DatabasePersistence
+	if testPersistence.memoryDatabasePersistence != nil {
+		databasePersistence = testPersistence.memoryDatabasePersistence
+	} else {
+		databasePersistence = storage.NewDatabasePersistence(testPersistence.configuration)
+	}
+
+	var cachePersistence storage.CachePersistence
+	if testPersistence.memoryCachePersistence != nil {
+		cachePersistence = testPersistence.memoryCachePersistence
+	} else {
+		cachePersistence = storage.NewCachePersistence(testPersistence.configuration)
+	}
+
+	return storage.NewPersistenceManagerWithBackends(testPersistence.configuration, databasePersistence, cachePersistence)
+}
+
 func (testPersistence *TestPersistence) initTestDatabase() {
+	switch testPersistence.configuration.Storage.Database {
+	case storage.MemoryBackend:
+		testPersistence.memoryDatabasePersistence = storage.NewMemoryDatabasePersistence()
+	case storage.SqliteBackend:
+		testPersistence.initTestSqliteDatabase()
+	case storage.PostgresBackend:
+		testPersistence.initTestPostgresDatabase()
+	default:
+		testPersistence.initTestMysqlDatabase()
+	}
+}
+
+func (testPersistence *TestPersistence) initTestSqliteDatabase() {
+	var err error
+	testPersistence.db, err = gorm.Open("sqlite3", testPersistence.configuration.Sqlite.Path)
+	if err != nil {
+		panic(err)
+	}
+
+	err = testPersistence.db.DropTableIfExists(schemaTables...).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// initTestPostgresDatabase expects the test database to be already created, as PostgreSQL has no CREATE DATABASE IF NOT EXISTS.
+func (testPersistence *TestPersistence) initTestPostgresDatabase() {
+	connectionString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		testPersistence.configuration.Postgres.Host, testPersistence.configuration.Postgres.Port,
+		testPersistence.configuration.Postgres.User, testPersistence.configuration.Postgres.Password,
+		testPersistence.configuration.Postgres.Database, testPersistence.configuration.Postgres.SSLMode)
+
+	var err error
+	testPersistence.db, err = gorm.Open("postgres", connectionString)
+	if err != nil {
+		panic(err)
+	}
+
+	err = testPersistence.db.DropTableIfExists(schemaTables...).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (testPersistence *TestPersistence) initTestMysqlDatabase() {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/?loc=Local&parseTime=True",
 		testPersistence.configuration.Mysql.User, testPersistence.configuration.Mysql.Password,
 		testPersistence.configuration.Mysql.Host, testPersistence.configuration.Mysql.Port)
@@ -54,13 +128,18 @@ func (testPersistence *TestPersistence) initTestDatabase() {
 		panic(err)
 	}
 
-	err = testPersistence.db.DropTableIfExists(model.UrlData{}).Error
+	err = testPersistence.db.DropTableIfExists(schemaTables...).Error
 	if err != nil {
 		panic(err)
 	}
 }
 
 func (testPersistence *TestPersistence) initTestCache() {
+	if testPersistence.configuration.Storage.Cache == storage.MemoryBackend {
+		testPersistence.memoryCachePersistence = storage.NewMemoryCachePersistence()
+		return
+	}
+
 	testPersistence.redisClient = redis.NewClient(&redis.Options{
 		Addr:     testPersistence.configuration.Redis.Host + ":" + strconv.Itoa(testPersistence.configuration.Redis.Port),
 		Password: testPersistence.configuration.Redis.Password,
@@ -71,33 +150,72 @@ func (testPersistence *TestPersistence) initTestCache() {
 }
 
 func (testPersistence *TestPersistence) FlushTestPersistence() error {
-	err := testPersistence.db.DropTableIfExists(&model.UrlData{}).Error
-	if err != nil {
-		return err
+	if testPersistence.memoryDatabasePersistence != nil {
+		testPersistence.memoryDatabasePersistence.Flush()
+	} else {
+		err := testPersistence.db.DropTableIfExists(schemaTables...).Error
+		if err != nil {
+			return err
+		}
+
+		err = testPersistence.migrateTestDatabase()
+		if err != nil {
+			return err
+		}
 	}
 
-	err = testPersistence.db.AutoMigrate(&model.UrlData{}).Error
+	testPersistence.FlushTestCache()
+
+	return nil
+}
+
+// migrateTestDatabase creates the schema of the test database through the migrations, as the application does.
+func (testPersistence *TestPersistence) migrateTestDatabase() error {
+	migrator, err := storage.NewMigrator(testPersistence.configuration)
 	if err != nil {
 		return err
 	}
+	defer migrator.Close()
 
-	testPersistence.FlushTestCache()
-
-	return nil
+	_, err = migrator.Up()
+	return err
 }
 
 func (testPersistence *TestPersistence) CleanUp() {
-	testPersistence.db.Exec("DROP DATABASE " + testPersistence.configuration.Mysql.Database)
-	testPersistence.redisClient.FlushAll(context.Background())
-	testPersistence.db.Close()
-	testPersistence.redisClient.Close()
+	switch testPersistence.configuration.Storage.Database {
+	case storage.MemoryBackend, storage.SqliteBackend:
+	case storage.PostgresBackend:
+		testPersistence.db.DropTableIfExists(schemaTables...)
+	default:
+		testPersistence.db.Exec("DROP DATABASE " + testPersistence.configuration.Mysql.Database)
+	}
+	testPersistence.FlushTestCache()
+	testPersistence.Close()
+
+	if testPersistence.configuration.Storage.Database == storage.SqliteBackend {
+		os.Remove(testPersistence.configuration.Sqlite.Path)
+	}
 }
 
 func (testPersistence *TestPersistence) FlushTestCache() {
+	if testPersistence.memoryCachePersistence != nil {
+		testPersistence.memoryCachePersistence.Flush()
+		return
+	}
+
 	testPersistence.redisClient.FlushAll(context.Background())
 }
 
 func (testPersistence *TestPersistence) ExistsInTestCache(shortSlug string) bool {
+	if testPersistence.memoryCachePersistence != nil {
+		exists, err := testPersistence.memoryCachePersistence.Exists(context.Background(), shortSlug)
+		if err != nil {
+			panic(err)
+		}
+
+		return exists
+	}
+
 	exists, err := testPersistence.redisClient.Exists(context.Background(), shortSlug).Result()
 	if err != nil {
 		panic(err)
@@ -107,6 +225,10 @@ func (testPersistence *TestPersistence) ExistsInTestCache(shortSlug string) bool
 }
 
 func (testPersistence *TestPersistence) Close() {
-	testPersistence.db.Close()
-	testPersistence.redisClient.Close()
+	if testPersistence.db != nil {
+		testPersistence.db.Close()
+	}
+	if testPersistence.redisClient != nil {
+		testPersistence.redisClient.Close()
+	}
 }
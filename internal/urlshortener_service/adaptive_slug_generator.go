@@ -0,0 +1,180 @@
+package urlshortener_service
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"sync"
+)
+
+// defaultCollisionWindow is used when UrlShortenerService.CollisionWindow is not configured.
+const defaultCollisionWindow = 1000
+
+// AdaptiveSlugGenerator generates the short slugs with the configured strategy and tracks how often they collide
+// with the short slugs in use. The collision rate is measured over windows of collisionWindow attempts.
+// Once the rate of a window crosses collisionRateThreshold, the short slugs get one symbol longer,
+// up to maxSlugLength, which makes the keyspace larger.
+// A generated short slug collides with the probability of the share of the keyspace in use,
+// so the collision rate of the last window is reported as the estimated keyspace utilization.
+// The length is not stored, so RestoreSlugLength derives it again from the stored short slugs after a restart.
+type AdaptiveSlugGenerator struct {
+	configuration          util.Configuration
+	maxSlugLength          int
+	collisionRateThreshold float64
+	collisionWindow        int
+	mutex                  sync.RWMutex
+	slugGenerator          SlugGenerator
+	slugLength             int
+	windowAttempts         int
+	windowCollisions       int
+	lastCollisionRate      float64
+	attempts               int64
+	collisions             int64
+}
+
+func NewAdaptiveSlugGenerator(configuration util.Configuration) *AdaptiveSlugGenerator {
+	adaptiveSlugGenerator := new(AdaptiveSlugGenerator)
+
+	adaptiveSlugGenerator.configuration = configuration
+	adaptiveSlugGenerator.slugGenerator = NewSlugGenerator(configuration)
+	adaptiveSlugGenerator.slugLength = configuration.UrlShortenerService.SlugLength
+	adaptiveSlugGenerator.maxSlugLength = configuration.UrlShortenerService.MaxSlugLength
+	adaptiveSlugGenerator.collisionRateThreshold = configuration.UrlShortenerService.CollisionRateThreshold
+	adaptiveSlugGenerator.collisionWindow = configuration.UrlShortenerService.CollisionWindow
+	if adaptiveSlugGenerator.collisionWindow <= 0 {
+		adaptiveSlugGenerator.collisionWindow = defaultCollisionWindow
+	}
+
+	return adaptiveSlugGenerator
+}
+
+// GenerateShortSlug generates a short slug of the current length.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) GenerateShortSlug() (string, error) {
+	adaptiveSlugGenerator.mutex.RLock()
+	slugGenerator := adaptiveSlugGenerator.slugGenerator
+	adaptiveSlugGenerator.mutex.RUnlock()
+
+	return slugGenerator.GenerateShortSlug()
+}
+
+// KeyspaceSize returns the keyspace of the short slugs of the current length.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) KeyspaceSize() float64 {
+	adaptiveSlugGenerator.mutex.RLock()
+	defer adaptiveSlugGenerator.mutex.RUnlock()
+
+	return adaptiveSlugGenerator.slugGenerator.KeyspaceSize()
+}
+
+// SlugLength returns the current length of the generated short slugs.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) SlugLength() int {
+	adaptiveSlugGenerator.mutex.RLock()
+	defer adaptiveSlugGenerator.mutex.RUnlock()
+
+	return adaptiveSlugGenerator.slugLength
+}
+
+// RecordAttempts records how many generated short slugs have been tried and how many of them have collided.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) RecordAttempts(attempts int, collisions int) {
+	adaptiveSlugGenerator.mutex.Lock()
+	defer adaptiveSlugGenerator.mutex.Unlock()
+
+	adaptiveSlugGenerator.attempts += int64(attempts)
+	adaptiveSlugGenerator.collisions += int64(collisions)
+	adaptiveSlugGenerator.windowAttempts += attempts
+	adaptiveSlugGenerator.windowCollisions += collisions
+	if adaptiveSlugGenerator.windowAttempts < adaptiveSlugGenerator.collisionWindow {
+		return
+	}
+
+	adaptiveSlugGenerator.lastCollisionRate =
+		float64(adaptiveSlugGenerator.windowCollisions) / float64(adaptiveSlugGenerator.windowAttempts)
+	adaptiveSlugGenerator.windowAttempts = 0
+	adaptiveSlugGenerator.windowCollisions = 0
+
+	if adaptiveSlugGenerator.collisionRateThreshold > 0 &&
+		adaptiveSlugGenerator.lastCollisionRate > adaptiveSlugGenerator.collisionRateThreshold {
+		adaptiveSlugGenerator.grow()
+	}
+}
+
+// RestoreSlugLength grows the short slugs to the length they have had before a restart, as the collisions
+// which have grown them are not kept. A generated short slug collides with the probability of the share of its
+// keyspace in use, so the length grows for as long as the stored short slugs of the current length fill more than
+// collisionRateThreshold of its keyspace. The short slugs are counted with a scan, so it is done once at startup.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) RestoreSlugLength(ctx context.Context,
+	persistenceManager *storage.PersistenceManager) error {
+	if adaptiveSlugGenerator.collisionRateThreshold <= 0 {
+		return nil
+	}
+
+	adaptiveSlugGenerator.mutex.Lock()
+	defer adaptiveSlugGenerator.mutex.Unlock()
+
+	for {
+		// The length of a short slug is not always its slug length, such as a pronounceable one with dashes
+		sample, err := adaptiveSlugGenerator.slugGenerator.GenerateShortSlug()
+		if err != nil {
+			return err
+		}
+		count, err := persistenceManager.CountShortSlugs(ctx, len(sample))
+		if err != nil {
+			return err
+		}
+
+		utilization := float64(count) / adaptiveSlugGenerator.slugGenerator.KeyspaceSize()
+		if utilization <= adaptiveSlugGenerator.collisionRateThreshold {
+			return nil
+		}
+		adaptiveSlugGenerator.lastCollisionRate = utilization
+
+		slugLength := adaptiveSlugGenerator.slugLength
+		adaptiveSlugGenerator.grow()
+		if adaptiveSlugGenerator.slugLength == slugLength {
+			return nil
+		}
+	}
+}
+
+// Stats returns the slug length, the collisions and the keyspace utilization for capacity planning.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) Stats() storage.Stats {
+	adaptiveSlugGenerator.mutex.RLock()
+	defer adaptiveSlugGenerator.mutex.RUnlock()
+
+	return storage.Stats{
+		"slugs.length":                         adaptiveSlugGenerator.slugLength,
+		"slugs.attempts":                       adaptiveSlugGenerator.attempts,
+		"slugs.collisions":                     adaptiveSlugGenerator.collisions,
+		"slugs.keyspace.size":                  adaptiveSlugGenerator.slugGenerator.KeyspaceSize(),
+		"slugs.keyspace.estimated_utilization": adaptiveSlugGenerator.lastCollisionRate,
+	}
+}
+
+// grow makes the short slugs longer by as few symbols as increase the keyspace, if the maximum length allows it.
+// A longer short slug does not always have a bigger keyspace, such as a pronounceable one of an odd length.
+// The caller must hold the write lock.
+func (adaptiveSlugGenerator *AdaptiveSlugGenerator) grow() {
+	keyspaceSize := adaptiveSlugGenerator.slugGenerator.KeyspaceSize()
+	slugLength := adaptiveSlugGenerator.slugLength
+	for slugLength < adaptiveSlugGenerator.maxSlugLength {
+		slugLength++
+		slugGenerator, err := newSlugGenerator(adaptiveSlugGenerator.configuration, slugLength)
+		if err != nil {
+			log.Printf("Error in AdaptiveSlugGenerator.grow(): %v.\n", err)
+			return
+		}
+		if slugGenerator.KeyspaceSize() <= keyspaceSize {
+			continue
+		}
+
+		adaptiveSlugGenerator.slugGenerator = slugGenerator
+		adaptiveSlugGenerator.slugLength = slugLength
+		log.Printf("The collision rate of the short slugs is %.2f, so their length is increased to %d.\n",
+			adaptiveSlugGenerator.lastCollisionRate, adaptiveSlugGenerator.slugLength)
+		return
+	}
+
+	log.Printf("The collision rate of the short slugs is %.2f, but their keyspace cannot grow "+
+		"within the maximum length of %d.\n", adaptiveSlugGenerator.lastCollisionRate,
+		adaptiveSlugGenerator.maxSlugLength)
+}
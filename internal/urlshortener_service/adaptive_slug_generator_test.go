@@ -0,0 +1,148 @@
+package urlshortener_service_test
+
+import (
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdaptiveTestConfiguration(slugLength int, maxSlugLength int) util.Configuration {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.UrlShortenerService.SlugStrategy = urlshortener_service.RandomSlugStrategy
+	configuration.UrlShortenerService.SlugAlphabet = "ab"
+	configuration.UrlShortenerService.SlugLength = slugLength
+	configuration.UrlShortenerService.MaxSlugLength = maxSlugLength
+	configuration.UrlShortenerService.CollisionRateThreshold = 0.5
+	configuration.UrlShortenerService.CollisionWindow = 4
+	configuration.UrlShortenerService.MaxSlugRetries = 5
+
+	return configuration
+}
+
+func TestAdaptiveSlugGeneratorGrowsWhenCollisionsAreFrequent(t *testing.T) {
+	adaptiveSlugGenerator := urlshortener_service.NewAdaptiveSlugGenerator(newAdaptiveTestConfiguration(2, 3))
+
+	// A window at the threshold keeps the length
+	adaptiveSlugGenerator.RecordAttempts(4, 2)
+	if adaptiveSlugGenerator.SlugLength() != 2 {
+		t.Fatalf("Expected the slug length to stay 2, got: %d.", adaptiveSlugGenerator.SlugLength())
+	}
+
+	adaptiveSlugGenerator.RecordAttempts(3, 3)
+	adaptiveSlugGenerator.RecordAttempts(1, 0)
+	if adaptiveSlugGenerator.SlugLength() != 3 {
+		t.Fatalf("Expected the slug length to grow to 3, got: %d.", adaptiveSlugGenerator.SlugLength())
+	}
+	if shortSlug := generateShortSlug(t, adaptiveSlugGenerator); len(shortSlug) != 3 {
+		t.Errorf("Expected a short slug of 3 symbols, got: %q.", shortSlug)
+	}
+
+	// The maximum length is never exceeded
+	adaptiveSlugGenerator.RecordAttempts(4, 4)
+	if adaptiveSlugGenerator.SlugLength() != 3 {
+		t.Errorf("Expected the slug length to stay at the maximum of 3, got: %d.", adaptiveSlugGenerator.SlugLength())
+	}
+
+	stats := adaptiveSlugGenerator.Stats()
+	if stats["slugs.keyspace.size"] != 8.0 || stats["slugs.keyspace.estimated_utilization"] != 1.0 ||
+		stats["slugs.collisions"] != int64(9) || stats["slugs.attempts"] != int64(12) {
+		t.Errorf("Unexpected stats: %v.", stats)
+	}
+}
+
+// After a restart the length is derived from the stored short slugs: 3 of the 4 short slugs of 2 symbols are taken,
+// while 1 of the 8 short slugs of 3 symbols is, so the length grows to 3 and stays there.
+func TestAdaptiveSlugGeneratorRestoresTheSlugLength(t *testing.T) {
+	configuration := newAdaptiveTestConfiguration(2, 4)
+	persistenceManager := newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence())
+	for _, shortSlug := range []string{"aa", "ab", "ba", "aaa"} {
+		err := persistenceManager.SaveUrlData(context.Background(), model.UrlData{ShortSlug: shortSlug,
+			RealUrl: testRealUrl, Expires: model.CustomTime{Time: time.Now().Add(time.Hour)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	adaptiveSlugGenerator := urlshortener_service.NewAdaptiveSlugGenerator(configuration)
+	if err := adaptiveSlugGenerator.RestoreSlugLength(context.Background(), persistenceManager); err != nil {
+		t.Fatalf("Unexpected error: %v.", err)
+	}
+	if adaptiveSlugGenerator.SlugLength() != 3 {
+		t.Errorf("Expected the slug length to be restored to 3, got: %d.", adaptiveSlugGenerator.SlugLength())
+	}
+}
+
+func TestAdaptiveSlugGeneratorGrowsTheKeyspaceOfPronounceableShortSlugs(t *testing.T) {
+	configuration := newAdaptiveTestConfiguration(6, 9)
+	configuration.UrlShortenerService.SlugStrategy = urlshortener_service.PronounceableSlugStrategy
+	adaptiveSlugGenerator := urlshortener_service.NewAdaptiveSlugGenerator(configuration)
+	keyspaceSize := adaptiveSlugGenerator.KeyspaceSize()
+
+	// A pronounceable short slug of 7 symbols has as many syllables as one of 6
+	adaptiveSlugGenerator.RecordAttempts(4, 4)
+	if adaptiveSlugGenerator.SlugLength() != 8 || adaptiveSlugGenerator.KeyspaceSize() <= keyspaceSize {
+		t.Errorf("Expected the slug length to grow to 8 with a bigger keyspace, got: %d with keyspace: %v.",
+			adaptiveSlugGenerator.SlugLength(), adaptiveSlugGenerator.KeyspaceSize())
+	}
+
+	// Growing to 9 would not increase the keyspace, so the length stays
+	adaptiveSlugGenerator.RecordAttempts(4, 4)
+	if adaptiveSlugGenerator.SlugLength() != 8 {
+		t.Errorf("Expected the slug length to stay 8, got: %d.", adaptiveSlugGenerator.SlugLength())
+	}
+}
+
+func sendCreateRequestTo(service *urlshortener_service.UrlShortenerService) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "/api/create", strings.NewReader(`{"real-url":"`+testRealUrl+`"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(service.HandleGenerateShortSlug).ServeHTTP(rr, request)
+
+	return rr
+}
+
+func TestCreateShortUrlWhenKeyspaceIsFull(t *testing.T) {
+	configuration := newAdaptiveTestConfiguration(1, 1)
+	service := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence()))
+
+	// The keyspace has only the short slugs "a" and "b"
+	created := 0
+	for i := 0; i < 10 && created < 2; i++ {
+		if rr := sendCreateRequestTo(service); rr.Code == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 2 {
+		t.Fatalf("Expected to fill the keyspace of 2 short slugs, created: %d.", created)
+	}
+
+	if rr := sendCreateRequestTo(service); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %v after the retries, got status: %v.", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestCreateShortUrlGrowsSlugLengthAsKeyspaceFills(t *testing.T) {
+	// The length grows well before the keyspace is full, so that the retries are practically never exhausted
+	configuration := newAdaptiveTestConfiguration(1, 16)
+	configuration.UrlShortenerService.CollisionRateThreshold = 0.25
+	configuration.UrlShortenerService.MaxSlugRetries = 30
+	service := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence()))
+
+	for i := 0; i < 64; i++ {
+		if rr := sendCreateRequestTo(service); rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status: %v for create %d, got status: %v.", http.StatusCreated, i, rr.Code)
+		}
+	}
+
+	if slugLength := service.Stats()["slugs.length"]; slugLength.(int) < 6 {
+		t.Errorf("Expected the short slugs to grow to hold 64 url data, got length: %v.", slugLength)
+	}
+}
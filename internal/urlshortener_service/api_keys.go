@@ -0,0 +1,140 @@
+package urlshortener_service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks the api keys, so that a leaked one is easy to recognize.
+const apiKeyPrefix = "usk_"
+
+// apiKeyRandomBytes is the entropy of an api key. It is too high for the key to be guessed,
+// which is why a single SHA-256 is enough to store it, unlike a password.
+const apiKeyRandomBytes = 32
+
+// ErrUnauthorized is returned when a request has an api key which is malformed, unknown or revoked.
+var ErrUnauthorized = errors.New("invalid api key")
+
+// ErrForbidden is returned when the api key of a request does not have the required scope.
+var ErrForbidden = errors.New("the api key does not have the required scope")
+
+// apiKeyContextKey is the key of the authenticated api key in the request context.
+type apiKeyContextKey struct{}
+
+// NewApiKey generates an api key of the owner with the scopes. It returns the key, which must be shown
+// to the owner as it is not stored, and the api key to save, which holds only its hash.
+func NewApiKey(owner string, scopes []string) (string, model.ApiKey, error) {
+	if owner == "" {
+		return "", model.ApiKey{}, errors.New("the owner of an api key must not be empty")
+	}
+	if len(scopes) == 0 {
+		return "", model.ApiKey{}, errors.New("an api key must have at least one scope")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case model.ScopeCreate, model.ScopeManage, model.ScopeAdmin:
+		default:
+			return "", model.ApiKey{}, fmt.Errorf("unknown api key scope: %q", scope)
+		}
+	}
+
+	randomBytes := make([]byte, apiKeyRandomBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", model.ApiKey{}, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	return key, model.ApiKey{KeyHash: HashApiKey(key), Owner: owner, Scopes: strings.Join(scopes, ","),
+		CreatedAt: time.Now()}, nil
+}
+
+// HashApiKey returns the hash under which the api key is stored.
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// WithScope wraps the handler, so that it is called only for the requests whose api key has the scope.
+// The api key is sent in the Authorization header as "Bearer <key>" and is available to the handler
+// through the request context. A request without an api key is rejected, unless it creates a short url
+// and ApiKeys.AllowAnonymousCreate is configured.
+func (urlShortenerService *UrlShortenerService) WithScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		authorization := request.Header.Get("Authorization")
+		if authorization == "" {
+			if scope == model.ScopeCreate && urlShortenerService.allowAnonymousCreate {
+				handler(writer, request)
+				return
+			}
+			urlShortenerService.sendAuthErrorResponse(writer, ErrUnauthorized)
+			return
+		}
+
+		apiKey, err := urlShortenerService.authenticate(request.Context(), authorization)
+		if err == nil && !apiKey.HasScope(scope) {
+			err = ErrForbidden
+		}
+		if err != nil {
+			urlShortenerService.sendAuthErrorResponse(writer, err)
+			return
+		}
+
+		handler(writer, request.WithContext(context.WithValue(request.Context(), apiKeyContextKey{}, apiKey)))
+	}
+}
+
+// authenticate returns the api key of the Authorization header.
+func (urlShortenerService *UrlShortenerService) authenticate(ctx context.Context,
+	authorization string) (model.ApiKey, error) {
+	fields := strings.Fields(authorization)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") || !strings.HasPrefix(fields[1], apiKeyPrefix) {
+		return model.ApiKey{}, ErrUnauthorized
+	}
+
+	apiKey, err := urlShortenerService.persistenceManager.GetApiKey(ctx, HashApiKey(fields[1]))
+	if errors.Is(err, storage.ErrNotFound) {
+		return model.ApiKey{}, ErrUnauthorized
+	}
+
+	return apiKey, err
+}
+
+// apiKeyFromRequest returns the api key authenticated by WithScope, if the request has one.
+func apiKeyFromRequest(request *http.Request) (model.ApiKey, bool) {
+	apiKey, found := request.Context().Value(apiKeyContextKey{}).(model.ApiKey)
+	return apiKey, found
+}
+
+// canManage reports whether the api key of the request may read, change or delete the url data.
+// The anonymous url data can be managed only with the admin scope.
+func canManage(request *http.Request, urlData model.UrlData) bool {
+	apiKey, found := apiKeyFromRequest(request)
+	if !found {
+		return false
+	}
+
+	return apiKey.HasScope(model.ScopeAdmin) || (urlData.Owner != "" && urlData.Owner == apiKey.Owner)
+}
+
+// sendAuthErrorResponse maps an error of the authentication to the matching http status code.
+func (urlShortenerService *UrlShortenerService) sendAuthErrorResponse(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		urlShortenerService.sendErrorResponse(writer, http.StatusUnauthorized, "Error: Unauthorized")
+	case errors.Is(err, ErrForbidden):
+		urlShortenerService.sendErrorResponse(writer, http.StatusForbidden, "Error: Forbidden")
+	default:
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+	}
+}
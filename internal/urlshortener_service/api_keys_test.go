@@ -0,0 +1,146 @@
+package urlshortener_service_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewApiKey(t *testing.T) {
+	key, apiKey, err := urlshortener_service.NewApiKey(testOwner, []string{model.ScopeCreate, model.ScopeManage})
+	if err != nil {
+		t.Fatalf("Could not create an api key: %v.", err)
+	}
+
+	if strings.Contains(apiKey.KeyHash, key) || apiKey.KeyHash != urlshortener_service.HashApiKey(key) {
+		t.Errorf("Expected the api key to hold only the hash of the key, got: %v.", apiKey)
+	}
+	if !apiKey.HasScope(model.ScopeCreate) || !apiKey.HasScope(model.ScopeManage) || apiKey.HasScope(model.ScopeAdmin) {
+		t.Errorf("Expected the create and manage scopes, got: %s.", apiKey.Scopes)
+	}
+
+	otherKey, _, _ := urlshortener_service.NewApiKey(testOwner, []string{model.ScopeCreate})
+	if otherKey == key {
+		t.Errorf("Expected a new key for every api key, got the same: %s.", key)
+	}
+
+	if _, _, err := urlshortener_service.NewApiKey("", []string{model.ScopeCreate}); err == nil {
+		t.Errorf("Expected an error for an api key without an owner.")
+	}
+	if _, _, err := urlshortener_service.NewApiKey(testOwner, []string{"delete"}); err == nil {
+		t.Errorf("Expected an error for an unknown scope.")
+	}
+}
+
+func TestWithScopeRejectsInvalidApiKeys(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	handler := service.WithScope(model.ScopeManage, service.HandleGetLink)
+
+	createOnlyKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+
+	keys := map[string]struct {
+		key    string
+		status int
+	}{
+		"missing key":       {"", http.StatusUnauthorized},
+		"unknown key":       {"usk_unknown", http.StatusUnauthorized},
+		"malformed key":     {"not-an-api-key", http.StatusUnauthorized},
+		"missing the scope": {createOnlyKey, http.StatusForbidden},
+		"valid key":         {testApiKey, http.StatusOK},
+	}
+
+	for name, key := range keys {
+		if rr := sendAuthorizedRequest(handler, "GET", testShortSlug, "", key.key); rr.Code != key.status {
+			t.Errorf("Expected status: %v for the %s, got status: %v.\n", key.status, name, rr.Code)
+		}
+	}
+}
+
+func TestRevokedApiKeyIsRejected(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+
+	err := databasePersistence.DeleteApiKey(context.Background(),
+		urlshortener_service.HashApiKey(testApiKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := sendLinkRequest(service, service.HandleGetLink, "GET", testShortSlug, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status: %v for a revoked api key, got status: %v.\n", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestLinksOfOtherOwnersAreNotFound(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	otherOwnerKey := saveTestApiKey(t, databasePersistence, "puppy-lover", model.ScopeManage)
+	adminKey := saveTestApiKey(t, databasePersistence, "admin", model.ScopeAdmin)
+
+	for _, handler := range []http.HandlerFunc{service.HandleGetLink, service.HandleDeleteLink} {
+		rr := sendAuthorizedRequest(service.WithScope(model.ScopeManage, handler), "GET", testShortSlug, "",
+			otherOwnerKey)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Expected status: %v for the link of another owner, got status: %v.\n", http.StatusNotFound, rr.Code)
+		}
+	}
+
+	rr := sendAuthorizedRequest(service.WithScope(model.ScopeManage, service.HandleGetLink), "GET", testShortSlug, "",
+		adminKey)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status: %v for an admin api key, got status: %v.\n", http.StatusOK, rr.Code)
+	}
+}
+
+func sendCreateRequestWithKey(service *urlshortener_service.UrlShortenerService, body string,
+	key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/create", bytes.NewBufferString(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	rr := httptest.NewRecorder()
+	service.WithScope(model.ScopeCreate, service.HandleGenerateShortSlug).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestCreateShortUrlRecordsOwnerOfApiKey(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	createKey := saveTestApiKey(t, databasePersistence, "puppy-lover", model.ScopeCreate)
+
+	// The owner sent in the request is ignored
+	rr := sendCreateRequestWithKey(service, `{"real-url":"`+testRealUrl+`", "short-slug":"puppies", "owner":"admin"}`,
+		createKey)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusCreated, rr.Code)
+	}
+	rr = sendCreateRequestWithKey(service, `{"real-url":"`+testRealUrl+`", "short-slug":"anonymous", "owner":"admin"}`,
+		"")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status: %v for an anonymous create, got status: %v.\n", http.StatusCreated, rr.Code)
+	}
+
+	for shortSlug, owner := range map[string]string{"puppies": "puppy-lover", "anonymous": ""} {
+		urlData, err := databasePersistence.GetUrlData(context.Background(), shortSlug)
+		if err != nil || urlData.Owner != owner {
+			t.Errorf("Expected owner: %q of short slug: %s, got: %q, error: %v.", owner, shortSlug, urlData.Owner, err)
+		}
+	}
+}
+
+func TestCreateShortUrlWithoutApiKeyWhenAnonymousCreateIsNotAllowed(t *testing.T) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.ApiKeys.AllowAnonymousCreate = false
+	service := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence()))
+
+	rr := sendCreateRequestWithKey(service, `{"real-url":"`+testRealUrl+`"}`, "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status: %v, got status: %v.\n", http.StatusUnauthorized, rr.Code)
+	}
+}
@@ -0,0 +1,240 @@
+package urlshortener_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxLinksBatchSize is the maximum number of links in a single batch create request.
+const maxLinksBatchSize = 1000
+
+// errMissingRealUrl is the error of an url data of a batch without a real url.
+var errMissingRealUrl = errors.New("missing real url")
+
+// linksBatchResponse is the response of a batch create request. It has the result of each link
+// in the order of the request.
+type linksBatchResponse struct {
+	Results []Response `json:"results"`
+}
+
+// HandleCreateLinksBatch is the REST handler for an incoming POST request for creating several short urls at once.
+// The body is a json array of url data, each of which is handled as by HandleGenerateShortSlug, and the response
+// has the short url or the error message of each of them, even if some of them have failed.
+// The url data is saved with batched inserts in the database and in the cache, see PersistenceManager.SaveUrlDataBatch.
+// With the query parameter all-or-nothing=true either every short url is created or none of them, in which case
+// the url data which has not failed gets an error as well.
+func (urlShortenerService *UrlShortenerService) HandleCreateLinksBatch(writer http.ResponseWriter,
+	request *http.Request) {
+	allOrNothing := false
+	if value := request.URL.Query().Get("all-or-nothing"); value != "" {
+		var err error
+		if allOrNothing, err = strconv.ParseBool(value); err != nil {
+			log.Printf("Error in HandleCreateLinksBatch() - invalid all-or-nothing: %v.\n", err)
+			urlShortenerService.sendErrorResponse(writer, http.StatusBadRequest, "Error: Invalid Request")
+			return
+		}
+	}
+
+	var urlData []model.UrlData
+	err := json.NewDecoder(request.Body).Decode(&urlData)
+	if err != nil || len(urlData) == 0 || len(urlData) > maxLinksBatchSize {
+		log.Printf("Error in HandleCreateLinksBatch() - invalid request body of %d url data: %v.\n", len(urlData), err)
+		urlShortenerService.sendErrorResponse(writer, http.StatusBadRequest, "Error: Invalid Request")
+		return
+	}
+
+	owner := ""
+	if apiKey, found := apiKeyFromRequest(request); found {
+		owner = apiKey.Owner
+	}
+
+	errs := make([]error, len(urlData))
+	generated := make([]bool, len(urlData))
+	failed := false
+	for i := range urlData {
+		generated[i] = urlData[i].ShortSlug == ""
+		errs[i] = urlShortenerService.prepareBatchUrlData(&urlData[i], owner)
+		failed = failed || errs[i] != nil
+	}
+
+	if failed && allOrNothing {
+		abortLinksBatch(errs)
+	} else {
+		urlShortenerService.saveUrlDataBatch(request.Context(), urlData, generated, errs, allOrNothing)
+	}
+
+	response := linksBatchResponse{Results: make([]Response, len(urlData))}
+	for i, err := range errs {
+		response.Results[i] = urlShortenerService.linksBatchResult(urlData[i], err)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		log.Printf("Error while encoding the batch results in json format: %v.\n", err)
+	}
+}
+
+// prepareBatchUrlData validates the url data of a batch and sets its owner and its default expire date.
+func (urlShortenerService *UrlShortenerService) prepareBatchUrlData(urlData *model.UrlData, owner string) error {
+	if urlData.RealUrl == "" {
+		return errMissingRealUrl
+	}
+
+	var err error
+	if urlData.Tags, err = normalizeTags(urlData.Tags); err != nil {
+		return err
+	}
+	if urlData.ShortSlug != "" {
+		if err := urlShortenerService.slugValidator.Validate(urlData.ShortSlug); err != nil {
+			return err
+		}
+	}
+
+	urlData.Owner = owner
+	// The creation time is set by the storage
+	urlData.CreatedAt = time.Time{}
+	if urlData.Expires.IsZero() {
+		urlData.Expires.Time = time.Now().Local().AddDate(0, 0, urlShortenerService.defaultExpiresDays)
+	}
+
+	return nil
+}
+
+// saveUrlDataBatch saves the url data whose error is nil and sets the result of each of them in errs.
+// The generated short slugs which collide are generated anew and saved with the next batch,
+// at most maxSlugRetries times. With allOrNothing such a collision retries the whole batch, of which nothing
+// has been saved, while any other failure aborts it.
+func (urlShortenerService *UrlShortenerService) saveUrlDataBatch(ctx context.Context, urlData []model.UrlData,
+	generated []bool, errs []error, allOrNothing bool) {
+	var pending []int
+	regenerate := make(map[int]bool)
+	for i := range urlData {
+		if errs[i] == nil {
+			pending = append(pending, i)
+			regenerate[i] = generated[i]
+		}
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		batch := make([]model.UrlData, 0, len(pending))
+		batchIndexes := make([]int, 0, len(pending))
+		for _, i := range pending {
+			if regenerate[i] {
+				shortSlug, err := urlShortenerService.nextShortSlug(ctx)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				urlData[i].ShortSlug = shortSlug
+			}
+			batch = append(batch, urlData[i])
+			batchIndexes = append(batchIndexes, i)
+		}
+		if allOrNothing && len(batch) < len(pending) {
+			abortLinksBatch(errs)
+			return
+		}
+
+		batchErrs := urlShortenerService.persistenceManager.SaveUrlDataBatch(ctx, batch, allOrNothing)
+
+		regenerate = make(map[int]bool)
+		var retry []int
+		attempts, collisions := 0, 0
+		failed := false
+		for j, i := range batchIndexes {
+			err := batchErrs[j]
+			if generated[i] && errors.Is(err, storage.ErrDuplicate) {
+				attempts++
+				collisions++
+				if attempt < urlShortenerService.maxSlugRetries {
+					regenerate[i] = true
+					retry = append(retry, i)
+					continue
+				}
+				err = ErrShortSlugRetriesExhausted
+			} else if generated[i] && err == nil {
+				attempts++
+			}
+
+			errs[i] = err
+			failed = failed || (err != nil && !errors.Is(err, storage.ErrBatchAborted))
+		}
+		if urlShortenerService.slugKeyPool == nil {
+			urlShortenerService.slugGenerator.RecordAttempts(attempts, collisions)
+		}
+
+		if !allOrNothing {
+			pending = retry
+			continue
+		}
+		if failed {
+			abortLinksBatch(errs)
+			return
+		}
+		if len(retry) == 0 {
+			return
+		}
+		for _, i := range batchIndexes {
+			errs[i] = nil
+		}
+		pending = batchIndexes
+	}
+}
+
+// nextShortSlug returns a short slug for an url data of a batch without a desired short slug, claimed from
+// the slug key pool if there is one. The reserved short slugs and the ones with a blocked word are skipped,
+// at most maxSlugRetries times.
+func (urlShortenerService *UrlShortenerService) nextShortSlug(ctx context.Context) (string, error) {
+	for attempt := 0; attempt < urlShortenerService.maxSlugRetries; attempt++ {
+		var shortSlug string
+		var err error
+		if urlShortenerService.slugKeyPool != nil {
+			shortSlug, err = urlShortenerService.slugKeyPool.Claim(ctx)
+		} else {
+			shortSlug, err = urlShortenerService.slugGenerator.GenerateShortSlug()
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if urlShortenerService.slugValidator.validateWords(shortSlug) == nil {
+			return shortSlug, nil
+		}
+	}
+
+	return "", ErrShortSlugRetriesExhausted
+}
+
+// abortLinksBatch sets storage.ErrBatchAborted as the error of the url data of an all-or-nothing batch
+// which has not failed.
+func abortLinksBatch(errs []error) {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = storage.ErrBatchAborted
+		}
+	}
+}
+
+// linksBatchResult returns the result of a single url data of a batch create request.
+func (urlShortenerService *UrlShortenerService) linksBatchResult(urlData model.UrlData, err error) Response {
+	switch {
+	case err == nil:
+		return Response{urlShortenerService.domainName + "/" + urlData.ShortSlug, ""}
+	case errors.Is(err, errMissingRealUrl):
+		return Response{"", "Error: Invalid Request"}
+	case errors.Is(err, ErrInvalidShortSlug), errors.Is(err, ErrInvalidTags):
+		return Response{"", validationErrorMessage(err)}
+	default:
+		_, errorMessage := storageErrorResponse(err)
+		return Response{"", errorMessage}
+	}
+}
@@ -0,0 +1,159 @@
+package urlshortener_service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sendBatchRequest(t *testing.T, service *urlshortener_service.UrlShortenerService, query string, body string,
+	key string) []urlshortener_service.Response {
+	req := httptest.NewRequest("POST", "/api/links:batch?"+query, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	rr := httptest.NewRecorder()
+	service.WithScope(model.ScopeCreate, service.HandleCreateLinksBatch).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v, body: %s.", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Results []urlshortener_service.Response `json:"results"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response.Results
+}
+
+func TestCreateLinksBatch(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	createKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+
+	results := sendBatchRequest(t, service, "", `[
+		{"real-url":"`+testRealUrl+`"},
+		{"real-url":"`+testUpdatedRealUrl+`", "short-slug":"puppies", "tags":["Pets"]},
+		{"real-url":"`+testRealUrl+`", "short-slug":"`+testShortSlug+`"},
+		{"short-slug":"no-real-url"},
+		{"real-url":"`+testRealUrl+`", "short-slug":"api"},
+		{"real-url":"`+testRealUrl+`", "tags":["a,b"]},
+		{"real-url":"`+testRealUrl+`", "short-slug":"puppies"}
+	]`, createKey)
+
+	if len(results) != 7 {
+		t.Fatalf("Expected a result for each of the 7 links, got: %v.", results)
+	}
+	for i, result := range results[:2] {
+		if result.ErrorMessage != "" || !strings.HasPrefix(result.ShortUrl, "localhost:8080/") {
+			t.Errorf("Expected link: %d to be created, got: %v.", i, result)
+		}
+	}
+	expectedErrorMessages := []string{"Error: Please choose another short slug or leave it empty!",
+		"Error: Invalid Request", "Error: Invalid short slug: \"api\" is reserved",
+		"Error: Invalid tags: the character ',' is not allowed",
+		"Error: Please choose another short slug or leave it empty!"}
+	for i, expectedErrorMessage := range expectedErrorMessages {
+		if result := results[i+2]; result.ShortUrl != "" || result.ErrorMessage != expectedErrorMessage {
+			t.Errorf("Expected error message: %s for link: %d, got: %v.", expectedErrorMessage, i+2, result)
+		}
+	}
+
+	generatedShortSlug := strings.TrimPrefix(results[0].ShortUrl, "localhost:8080/")
+	if rr := sendRedirectRequest(service, generatedShortSlug); rr.Header().Get("Location") != testRealUrl {
+		t.Errorf("Expected a redirect to: %s, got: %s.", testRealUrl, rr.Header().Get("Location"))
+	}
+	urlData, err := databasePersistence.GetUrlData(context.Background(), "puppies")
+	if err != nil || urlData.Owner != testOwner || !urlData.Tags.HasTag("pets") || urlData.Expires.IsZero() {
+		t.Errorf("Expected the owner, the tags and the default expire date to be set, got: %v, error: %v.", urlData, err)
+	}
+}
+
+func TestCreateLinksBatchAllOrNothing(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	createKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+
+	for _, failing := range []string{`{"real-url":"` + testRealUrl + `", "short-slug":"` + testShortSlug + `"}`,
+		`{"real-url":"` + testRealUrl + `", "short-slug":"x"}`} {
+		results := sendBatchRequest(t, service, "all-or-nothing=true", `[
+			{"real-url":"`+testRealUrl+`"},
+			{"real-url":"`+testRealUrl+`", "short-slug":"puppies"},
+			`+failing+`
+		]`, createKey)
+
+		for i, result := range results[:2] {
+			if result.ShortUrl != "" || result.ErrorMessage != "Error: Not created, as another URL of the batch has failed" {
+				t.Errorf("Expected link: %d to be aborted, got: %v.", i, result)
+			}
+		}
+		if results[2].ShortUrl != "" || results[2].ErrorMessage == "" {
+			t.Errorf("Expected the failing link to have an error, got: %v.", results[2])
+		}
+		if _, err := databasePersistence.GetUrlData(context.Background(), "puppies"); err != storage.ErrNotFound {
+			t.Errorf("Expected no link of the aborted batch to be saved, got error: %v.", err)
+		}
+	}
+
+	results := sendBatchRequest(t, service, "all-or-nothing=true", `[
+		{"real-url":"`+testRealUrl+`"},
+		{"real-url":"`+testRealUrl+`", "short-slug":"puppies"}
+	]`, createKey)
+	for i, result := range results {
+		if result.ErrorMessage != "" {
+			t.Errorf("Expected link: %d to be created, got: %v.", i, result)
+		}
+	}
+}
+
+func TestCreateLinksBatchRetriesCollidingGeneratedShortSlugs(t *testing.T) {
+	// There are only two short slugs to generate
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.UrlShortenerService.SlugAlphabet = "ab"
+	configuration.UrlShortenerService.SlugLength = 1
+	configuration.UrlShortenerService.MaxSlugLength = 1
+	configuration.UrlShortenerService.MaxSlugRetries = 50
+
+	for _, query := range []string{"", "all-or-nothing=true"} {
+		databasePersistence := storage.NewMemoryDatabasePersistence()
+		createKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+		service := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+			storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+				storage.NewMemoryCachePersistence()))
+
+		results := sendBatchRequest(t, service, query,
+			`[{"real-url":"`+testRealUrl+`"}, {"real-url":"`+testRealUrl+`"}]`, createKey)
+		if results[0].ErrorMessage != "" || results[1].ErrorMessage != "" || results[0].ShortUrl == results[1].ShortUrl {
+			t.Errorf("Expected both links to be created with different short slugs, got: %v.", results)
+		}
+
+		results = sendBatchRequest(t, service, query, `[{"real-url":"`+testRealUrl+`"}]`, createKey)
+		if results[0].ErrorMessage != "Error: Could not generate a short url, please try again" {
+			t.Errorf("Expected the retries to be exhausted, got: %v.", results)
+		}
+	}
+}
+
+func TestCreateLinksBatchWithInvalidRequest(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	createKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+
+	tooMany := "[" + strings.Repeat(`{"real-url":"`+testRealUrl+`"},`, 1000) + `{"real-url":"` + testRealUrl + `"}]`
+	for query, body := range map[string]string{"": "[]", "all-or-nothing=maybe": `[{"real-url":"` + testRealUrl + `"}]`,
+		"all-or-nothing=false": `{"real-url":"` + testRealUrl + `"}`, "all-or-nothing=true": tooMany} {
+		req := httptest.NewRequest("POST", "/api/links:batch?"+query, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+createKey)
+		rr := httptest.NewRecorder()
+		service.WithScope(model.ScopeCreate, service.HandleCreateLinksBatch).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for query: %s, got status: %v.", http.StatusBadRequest, query, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package urlshortener_service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultListLimit is the number of links on a page when the request does not set the limit.
+	defaultListLimit = 50
+	// maxListLimit is the maximum number of links on a page.
+	maxListLimit = 500
+)
+
+// ErrInvalidListQuery is returned when a query parameter of a listing request is not valid.
+var ErrInvalidListQuery = errors.New("invalid query")
+
+// linksPage is the response of a listing request. NextCursor is passed as the cursor of the request
+// for the next page and it is empty on the last page.
+type linksPage struct {
+	Links      []model.UrlData `json:"links"`
+	NextCursor string          `json:"next-cursor,omitempty"`
+}
+
+// HandleListLinks is the REST handler for an incoming GET request for listing the links, newest first.
+// The links are filtered by the query parameters owner, created-from, created-to, expires-from, expires-to,
+// host, tag and q, which searches the short slugs and the real urls. The times are in RFC 3339 format.
+// A page has at most limit links, defaultListLimit by default, and the next one is requested with the cursor
+// of the response. An api key without the admin scope lists only the links of its owner.
+func (urlShortenerService *UrlShortenerService) HandleListLinks(writer http.ResponseWriter, request *http.Request) {
+	query, err := getUrlDataQueryFromRequest(request.URL.Query())
+	if err != nil {
+		urlShortenerService.sendValidationErrorResponse(writer, err)
+		return
+	}
+
+	apiKey, _ := apiKeyFromRequest(request)
+	if !apiKey.HasScope(model.ScopeAdmin) {
+		if apiKey.Owner == "" || (query.Owner != "" && query.Owner != apiKey.Owner) {
+			urlShortenerService.sendAuthErrorResponse(writer, ErrForbidden)
+			return
+		}
+		query.Owner = apiKey.Owner
+	}
+
+	// One more link is requested to find out whether there is a next page
+	limit := query.Limit
+	query.Limit++
+	links, err := urlShortenerService.persistenceManager.ListUrlData(request.Context(), query)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	page := linksPage{Links: links}
+	if len(links) > limit {
+		page.Links = links[:limit]
+		page.NextCursor = encodeListCursor(page.Links[limit-1])
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(writer).Encode(page)
+	if err != nil {
+		log.Printf("Error while encoding the links in json format: %v.\n", err)
+	}
+}
+
+// getUrlDataQueryFromRequest converts the query parameters of a listing request to the storage query.
+func getUrlDataQueryFromRequest(parameters url.Values) (storage.UrlDataQuery, error) {
+	query := storage.UrlDataQuery{
+		Owner:  parameters.Get("owner"),
+		Host:   parameters.Get("host"),
+		Tag:    strings.ToLower(parameters.Get("tag")),
+		Search: parameters.Get("q"),
+		Limit:  defaultListLimit,
+	}
+
+	times := map[string]*time.Time{"created-from": &query.CreatedFrom, "created-to": &query.CreatedTo,
+		"expires-from": &query.ExpiresFrom, "expires-to": &query.ExpiresTo}
+	for parameter, value := range times {
+		if parameters.Get(parameter) == "" {
+			continue
+		}
+
+		parsedTime, err := time.Parse(time.RFC3339, parameters.Get(parameter))
+		if err != nil {
+			return query, fmt.Errorf("%w: %s must be a time in RFC 3339 format", ErrInvalidListQuery, parameter)
+		}
+		*value = parsedTime
+	}
+
+	if parameters.Get("limit") != "" {
+		limit, err := strconv.Atoi(parameters.Get("limit"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return query, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidListQuery, maxListLimit)
+		}
+		query.Limit = limit
+	}
+
+	if cursor := parameters.Get("cursor"); cursor != "" {
+		createdAt, shortSlug, err := decodeListCursor(cursor)
+		if err != nil {
+			return query, fmt.Errorf("%w: the cursor is not valid", ErrInvalidListQuery)
+		}
+		query.AfterCreatedAt, query.AfterShortSlug = createdAt, shortSlug
+	}
+
+	return query, nil
+}
+
+// encodeListCursor returns the cursor of the page which starts after the url data.
+// The creation time is kept in whole seconds, see storage.UrlDataQuery.
+func encodeListCursor(urlData model.UrlData) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(urlData.CreatedAt.Unix(), 10) + ":" + urlData.ShortSlug))
+}
+
+func decodeListCursor(cursor string) (time.Time, string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, "", errors.New("the cursor has no short slug")
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	return time.Unix(seconds, 0).UTC(), parts[1], nil
+}
@@ -0,0 +1,203 @@
+package urlshortener_service_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type linksPage struct {
+	Links      []model.UrlData `json:"links"`
+	NextCursor string          `json:"next-cursor"`
+}
+
+// saveListingTestLinks saves count links of testOwner, created a minute apart, newest first,
+// and a link of another owner.
+func saveListingTestLinks(t *testing.T, databasePersistence storage.DatabasePersistence, count int) []string {
+	createdAt := time.Now().Add(-time.Hour)
+	var shortSlugs []string
+	for i := 0; i < count; i++ {
+		shortSlug := fmt.Sprintf("listed-%d", i)
+		err := databasePersistence.SaveUrlData(context.Background(), model.UrlData{ShortSlug: shortSlug,
+			RealUrl: fmt.Sprintf("https://listed.example.com/%d", i), Owner: testOwner,
+			Expires:   model.CustomTime{Time: time.Now().Add(time.Hour)},
+			CreatedAt: createdAt.Add(-time.Duration(i) * time.Minute), Tags: model.Tags{fmt.Sprintf("tag-%d", i%2)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shortSlugs = append(shortSlugs, shortSlug)
+	}
+
+	err := databasePersistence.SaveUrlData(context.Background(), model.UrlData{ShortSlug: "not-listed",
+		RealUrl: testRealUrl, Expires: model.CustomTime{Time: time.Now().Add(time.Hour)}, Owner: "puppy-lover"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return shortSlugs
+}
+
+func sendListRequest(service *urlshortener_service.UrlShortenerService, query string,
+	key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/links?"+query, nil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	rr := httptest.NewRecorder()
+	service.WithScope(model.ScopeManage, service.HandleListLinks).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func decodeLinksPage(t *testing.T, rr *httptest.ResponseRecorder) linksPage {
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v, body: %s.", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var page linksPage
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+
+	return page
+}
+
+func linksPageShortSlugs(page linksPage) []string {
+	shortSlugs := []string{}
+	for _, link := range page.Links {
+		shortSlugs = append(shortSlugs, link.ShortSlug)
+	}
+
+	return shortSlugs
+}
+
+func TestHandleListLinksPaginates(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	// A deleted link is listed until it is swept, as the listing includes the expired links
+	databasePersistence.DeleteUrlData(context.Background(), testShortSlug)
+	databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now().Add(time.Second), 10)
+	expectedShortSlugs := saveListingTestLinks(t, databasePersistence, 5)
+
+	var shortSlugs []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page := decodeLinksPage(t, sendListRequest(service, "limit=2&cursor="+cursor, testApiKey))
+		shortSlugs = append(shortSlugs, linksPageShortSlugs(page)...)
+
+		cursor = page.NextCursor
+		if cursor == "" {
+			if pages != 3 {
+				t.Errorf("Expected 3 pages, got: %d.", pages)
+			}
+			break
+		}
+		if pages == 3 {
+			t.Fatalf("Expected no cursor after the last page, got: %s.", cursor)
+		}
+	}
+
+	if !reflect.DeepEqual(shortSlugs, expectedShortSlugs) {
+		t.Errorf("Expected the links of the owner newest first: %v, got: %v.", expectedShortSlugs, shortSlugs)
+	}
+}
+
+func TestHandleListLinksFilters(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	saveListingTestLinks(t, databasePersistence, 4)
+	createdTo := time.Now().Add(-time.Hour - 90*time.Second).Format(time.RFC3339)
+
+	tests := map[string][]string{
+		"tag=TAG-1":                         {"listed-1", "listed-3"},
+		"q=LISTED-2":                        {"listed-2"},
+		"host=www.google.com&q=kitten":      {testShortSlug},
+		"created-to=" + createdTo:           {"listed-2", "listed-3"},
+		"owner=" + testOwner + "&tag=tag-0": {"listed-0", "listed-2"},
+		"expires-from=2000-01-01T00:00:00Z": {testShortSlug, "listed-0", "listed-1", "listed-2", "listed-3"},
+		"expires-to=2000-01-01T00:00:00Z":   {},
+		"tag=tag-0&created-to=" + createdTo: {"listed-2"},
+	}
+	for query, expectedShortSlugs := range tests {
+		page := decodeLinksPage(t, sendListRequest(service, query, testApiKey))
+		if shortSlugs := linksPageShortSlugs(page); !reflect.DeepEqual(shortSlugs, expectedShortSlugs) {
+			t.Errorf("Expected links: %v for query: %s, got: %v.", expectedShortSlugs, query, shortSlugs)
+		}
+	}
+}
+
+func TestHandleListLinksOfOtherOwners(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	saveListingTestLinks(t, databasePersistence, 1)
+
+	rr := sendListRequest(service, "owner=puppy-lover", testApiKey)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status: %v when listing the links of another owner, got status: %v.",
+			http.StatusForbidden, rr.Code)
+	}
+
+	adminKey := saveTestApiKey(t, databasePersistence, "admin", model.ScopeAdmin)
+	page := decodeLinksPage(t, sendListRequest(service, "owner=puppy-lover", adminKey))
+	if shortSlugs := linksPageShortSlugs(page); !reflect.DeepEqual(shortSlugs, []string{"not-listed"}) {
+		t.Errorf("Expected the admin to list the links of another owner, got: %v.", shortSlugs)
+	}
+	page = decodeLinksPage(t, sendListRequest(service, "", adminKey))
+	if len(page.Links) != 3 {
+		t.Errorf("Expected the admin to list the links of every owner, got: %v.", linksPageShortSlugs(page))
+	}
+}
+
+func TestHandleListLinksWithInvalidQuery(t *testing.T) {
+	service, _ := newLinksTestService(t)
+
+	for _, query := range []string{"limit=0", "limit=501", "limit=many", "created-from=yesterday",
+		"expires-to=01/01/2030", "cursor=!", "cursor=bm8tc2x1Zw"} {
+		rr := sendListRequest(service, query, testApiKey)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for query: %s, got status: %v.", http.StatusBadRequest, query, rr.Code)
+		}
+	}
+}
+
+func TestCreateAndPatchLinkTags(t *testing.T) {
+	service, databasePersistence := newLinksTestService(t)
+	createKey := saveTestApiKey(t, databasePersistence, testOwner, model.ScopeCreate)
+
+	rr := sendCreateRequestWithKey(service, `{"real-url":"`+testRealUrl+`", "short-slug":"tagged",
+		"tags":["Pets", "cats", "pets"]}`, createKey)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status: %v, got status: %v.", http.StatusCreated, rr.Code)
+	}
+	urlData, err := databasePersistence.GetUrlData(context.Background(), "tagged")
+	if err != nil || !reflect.DeepEqual(urlData.Tags, model.Tags{"pets", "cats"}) {
+		t.Errorf("Expected normalized tags: %v, got: %v, error: %v.", model.Tags{"pets", "cats"}, urlData.Tags, err)
+	}
+
+	rr = sendLinkRequest(service, service.HandlePatchLink, "PATCH", "tagged", `{"tags":["dogs"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v.", http.StatusOK, rr.Code)
+	}
+	urlData, err = databasePersistence.GetUrlData(context.Background(), "tagged")
+	if err != nil || !reflect.DeepEqual(urlData.Tags, model.Tags{"dogs"}) {
+		t.Errorf("Expected patched tags: %v, got: %v, error: %v.", model.Tags{"dogs"}, urlData.Tags, err)
+	}
+
+	for _, tags := range []string{`["a,b"]`, `[""]`, `["1","2","3","4","5","6","7","8","9"]`,
+		`["a-tag-which-is-longer-than-thirty"]`} {
+		rr = sendCreateRequestWithKey(service, `{"real-url":"`+testRealUrl+`", "tags":`+tags+`}`, createKey)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for tags: %s on create, got status: %v.", http.StatusBadRequest, tags, rr.Code)
+		}
+		rr = sendLinkRequest(service, service.HandlePatchLink, "PATCH", "tagged", `{"tags":`+tags+`}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for tags: %s on patch, got status: %v.", http.StatusBadRequest, tags, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package urlshortener_service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testUpdatedRealUrl = "https://www.google.com/search?q=puppies"
+const testOwner = "kitten-lover"
+
+// testApiKey is the key of testOwner with the manage scope, saved by newLinksTestService.
+var testApiKey string
+
+// newLinksTestService creates a service whose redirects are served by a local cache, so that a stale copy
+// of an updated or deleted short slug would be noticed. The test short slug is owned by testOwner.
+func newLinksTestService(t *testing.T) (*urlshortener_service.UrlShortenerService,
+	*storage.MemoryDatabasePersistence) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.LocalCache.Size = 10
+	configuration.LocalCache.TtlMillis = 60000
+
+	databasePersistence := storage.NewMemoryDatabasePersistence()
+	databasePersistence.SaveUrlData(context.Background(), model.UrlData{ShortSlug: testShortSlug, RealUrl: testRealUrl,
+		Expires: model.CustomTime{Time: time.Now().Add(time.Hour)}, Owner: testOwner})
+	testApiKey = saveTestApiKey(t, databasePersistence, testOwner, model.ScopeManage)
+
+	return urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+			storage.NewLruCachePersistence(configuration, storage.NewMemoryCachePersistence()))), databasePersistence
+}
+
+func saveTestApiKey(t *testing.T, apiKeyStore storage.ApiKeyStore, owner string,
+	scopes ...string) string {
+	key, apiKey, err := urlshortener_service.NewApiKey(owner, scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apiKeyStore.SaveApiKey(context.Background(), apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// sendLinkRequest sends the request with testApiKey through the authentication of the manage scope.
+func sendLinkRequest(service *urlshortener_service.UrlShortenerService, handler http.HandlerFunc, method string,
+	shortSlug string, body string) *httptest.ResponseRecorder {
+	return sendAuthorizedRequest(service.WithScope(model.ScopeManage, handler), method, shortSlug, body, testApiKey)
+}
+
+func sendAuthorizedRequest(handler http.HandlerFunc, method string, shortSlug string, body string,
+	key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/links/"+shortSlug, bytes.NewBufferString(body))
+	req = mux.SetURLVars(req, map[string]string{
+		"short-slug": shortSlug,
+	})
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleGetLink(t *testing.T) {
+	service, _ := newLinksTestService(t)
+
+	rr := sendLinkRequest(service, service.HandleGetLink, "GET", testShortSlug, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusOK, rr.Code)
+	}
+
+	var urlData model.UrlData
+	if err := json.NewDecoder(rr.Body).Decode(&urlData); err != nil {
+		t.Fatal(err)
+	}
+	if urlData.ShortSlug != testShortSlug || urlData.RealUrl != testRealUrl {
+		t.Errorf("Expected the url data of short slug: %s, got: %v.\n", testShortSlug, urlData)
+	}
+
+	if rr := sendLinkRequest(service, service.HandleGetLink, "GET", "missing", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status: %v for a missing short slug, got status: %v.\n", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestHandlePatchLinkRedirectsToNewRealUrl(t *testing.T) {
+	service, _ := newLinksTestService(t)
+	sendRedirectRequest(service, testShortSlug)
+
+	rr := sendLinkRequest(service, service.HandlePatchLink, "PATCH", testShortSlug, `{"real-url":"`+testUpdatedRealUrl+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusOK, rr.Code)
+	}
+
+	rr = sendRedirectRequest(service, testShortSlug)
+	if location := rr.Header().Get("Location"); location != testUpdatedRealUrl {
+		t.Errorf("Expected a redirect to: %s after the update, got: %s.\n", testUpdatedRealUrl, location)
+	}
+}
+
+func TestHandlePatchLinkKeepsOmittedFields(t *testing.T) {
+	service, _ := newLinksTestService(t)
+	expires := time.Now().Add(48 * time.Hour).Truncate(time.Minute)
+
+	rr := sendLinkRequest(service, service.HandlePatchLink, "PATCH", testShortSlug,
+		`{"expires":"`+expires.Format("02/01/2006 15:04")+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusOK, rr.Code)
+	}
+
+	var urlData model.UrlData
+	if err := json.NewDecoder(rr.Body).Decode(&urlData); err != nil {
+		t.Fatal(err)
+	}
+	if urlData.RealUrl != testRealUrl || !urlData.Expires.Equal(expires) {
+		t.Errorf("Expected real url: %s and expires: %v, got: %v.\n", testRealUrl, expires, urlData)
+	}
+}
+
+func TestHandlePatchLinkWithAnInvalidRequest(t *testing.T) {
+	service, _ := newLinksTestService(t)
+
+	for _, body := range []string{`{"real-url":""}`, `{"real-url":`, `{"expires":"tomorrow"}`} {
+		if rr := sendLinkRequest(service, service.HandlePatchLink, "PATCH", testShortSlug, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for body: %s, got status: %v.\n", http.StatusBadRequest, body, rr.Code)
+		}
+	}
+
+	rr := sendLinkRequest(service, service.HandlePatchLink, "PATCH", "missing", `{"real-url":"`+testUpdatedRealUrl+`"}`)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status: %v for a missing short slug, got status: %v.\n", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestHandleDeleteLinkStopsRedirecting(t *testing.T) {
+	service, _ := newLinksTestService(t)
+	sendRedirectRequest(service, testShortSlug)
+
+	rr := sendLinkRequest(service, service.HandleDeleteLink, "DELETE", testShortSlug, "")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusNoContent, rr.Code)
+	}
+
+	// The deleted short slug has expired, so it is not reused until the reuse cooldown passes
+	if rr := sendRedirectRequest(service, testShortSlug); rr.Code != http.StatusGone {
+		t.Errorf("Expected status: %v after the delete, got status: %v.\n", http.StatusGone, rr.Code)
+	}
+	rr = sendLinkRequest(service, service.HandleDeleteLink, "DELETE", testShortSlug, "")
+	if rr.Code != http.StatusGone {
+		t.Errorf("Expected status: %v when deleting again, got status: %v.\n", http.StatusGone, rr.Code)
+	}
+}
@@ -0,0 +1,65 @@
+package urlshortener_service
+
+import (
+	"errors"
+	"math"
+)
+
+// The symbols of the pronounceable short slugs. The letters which are easy to mishear or misspell are left out.
+const (
+	pronounceableConsonants = "bdfgklmnprstvz"
+	pronounceableVowels     = "aeiou"
+)
+
+// pronounceableWordSyllables is how many syllables the words of a pronounceable short slug have at most.
+const pronounceableWordSyllables = 3
+
+// PronounceableSlugGenerator generates short slugs of random words built from consonant-vowel syllables,
+// joined with a dash, such as "dikamo-tulesa". The short slugs are easy to read out and type,
+// but a short slug of the same length has a far smaller keyspace than a random one.
+type PronounceableSlugGenerator struct {
+	syllables int
+}
+
+// NewPronounceableSlugGenerator creates a generator of short slugs with slugLength / 2 syllables.
+// The dashes between the words are not counted in the length.
+func NewPronounceableSlugGenerator(slugLength int) (*PronounceableSlugGenerator, error) {
+	if slugLength < 2 {
+		return nil, errors.New("the pronounceable slug strategy needs a slug length of at least 2")
+	}
+
+	pronounceableSlugGenerator := new(PronounceableSlugGenerator)
+	pronounceableSlugGenerator.syllables = slugLength / 2
+
+	return pronounceableSlugGenerator, nil
+}
+
+// KeyspaceSize returns the number of the different sequences of syllables.
+func (pronounceableSlugGenerator *PronounceableSlugGenerator) KeyspaceSize() float64 {
+	return math.Pow(float64(len(pronounceableConsonants)*len(pronounceableVowels)),
+		float64(pronounceableSlugGenerator.syllables))
+}
+
+// GenerateShortSlug generates the syllables from crypto/rand, starting a new word after every
+// pronounceableWordSyllables syllables.
+func (pronounceableSlugGenerator *PronounceableSlugGenerator) GenerateShortSlug() (string, error) {
+	shortSlugBytes := make([]byte, 0, pronounceableSlugGenerator.syllables*3)
+
+	for i := 0; i < pronounceableSlugGenerator.syllables; i++ {
+		if i > 0 && i%pronounceableWordSyllables == 0 {
+			shortSlugBytes = append(shortSlugBytes, '-')
+		}
+
+		consonant, err := randomInt(int64(len(pronounceableConsonants)))
+		if err != nil {
+			return "", err
+		}
+		vowel, err := randomInt(int64(len(pronounceableVowels)))
+		if err != nil {
+			return "", err
+		}
+		shortSlugBytes = append(shortSlugBytes, pronounceableConsonants[consonant], pronounceableVowels[vowel])
+	}
+
+	return string(shortSlugBytes), nil
+}
@@ -0,0 +1,64 @@
+package urlshortener_service
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+)
+
+// RandomSlugGenerator generates short slugs of random symbols from an alphabet.
+type RandomSlugGenerator struct {
+	alphabet   string
+	slugLength int
+}
+
+func NewRandomSlugGenerator(alphabet string, slugLength int) (*RandomSlugGenerator, error) {
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if slugLength <= 0 {
+		return nil, errors.New("the slug length must be positive")
+	}
+
+	randomSlugGenerator := new(RandomSlugGenerator)
+	randomSlugGenerator.alphabet = alphabet
+	randomSlugGenerator.slugLength = slugLength
+
+	return randomSlugGenerator, nil
+}
+
+// KeyspaceSize returns the number of the short slugs of slugLength symbols from the alphabet.
+func (randomSlugGenerator *RandomSlugGenerator) KeyspaceSize() float64 {
+	return math.Pow(float64(len(randomSlugGenerator.alphabet)), float64(randomSlugGenerator.slugLength))
+}
+
+// GenerateShortSlug generates a short slug of slugLength symbols from the alphabet.
+// The symbols are read from crypto/rand, so the short slugs are not predictable. Every random byte
+// is mapped to a symbol with a modulo, which would favour the first symbols of the alphabet,
+// so the bytes above the largest multiple of the alphabet size are rejected.
+func (randomSlugGenerator *RandomSlugGenerator) GenerateShortSlug() (string, error) {
+	alphabetSize := len(randomSlugGenerator.alphabet)
+	maxUnbiasedByte := 256 - 256%alphabetSize
+
+	shortSlugBytes := make([]byte, 0, randomSlugGenerator.slugLength)
+	// A quarter more bytes than symbols, so that usually a single read is enough despite the rejected bytes
+	randomBytes := make([]byte, randomSlugGenerator.slugLength+randomSlugGenerator.slugLength/4+1)
+
+	for len(shortSlugBytes) < randomSlugGenerator.slugLength {
+		if _, err := rand.Read(randomBytes); err != nil {
+			return "", err
+		}
+
+		for _, randomByte := range randomBytes {
+			if int(randomByte) >= maxUnbiasedByte {
+				continue
+			}
+			shortSlugBytes = append(shortSlugBytes, randomSlugGenerator.alphabet[int(randomByte)%alphabetSize])
+			if len(shortSlugBytes) == randomSlugGenerator.slugLength {
+				break
+			}
+		}
+	}
+
+	return string(shortSlugBytes), nil
+}
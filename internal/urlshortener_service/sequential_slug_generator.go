@@ -0,0 +1,109 @@
+package urlshortener_service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// SequentialSlugGenerator encodes the numbers of a sequence as short slugs of a fixed length.
+// Every number of the keyspace is mapped to another one by the permutation x * multiplier + offset,
+// with the multiplier and the offset derived from the secret, so that consecutive short slugs do not look
+// consecutive. The permutation only hides the order from a casual reader, it is not cryptographic -
+// the random strategy should be used where the short slugs must not be guessable.
+// The sequence is kept by the process and starts from a random number, so that the instances and the restarts
+// do not walk the same part of the keyspace. A short slug taken by another instance is generated again.
+type SequentialSlugGenerator struct {
+	alphabet   string
+	slugLength int
+	keyspace   uint64
+	multiplier uint64
+	offset     uint64
+	sequence   uint64
+}
+
+func NewSequentialSlugGenerator(alphabet string, slugLength int, secret string) (*SequentialSlugGenerator, error) {
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	if slugLength <= 0 {
+		return nil, errors.New("the slug length must be positive")
+	}
+
+	keyspace := uint64(1)
+	for i := 0; i < slugLength; i++ {
+		if keyspace > math.MaxInt64/uint64(len(alphabet)) {
+			return nil, errors.New("the sequential slug strategy supports keyspaces up to 2^63, " +
+				"use a shorter slug length or alphabet")
+		}
+		keyspace *= uint64(len(alphabet))
+	}
+
+	sequentialSlugGenerator := new(SequentialSlugGenerator)
+	sequentialSlugGenerator.alphabet = alphabet
+	sequentialSlugGenerator.slugLength = slugLength
+	sequentialSlugGenerator.keyspace = keyspace
+
+	secretHash := sha256.Sum256([]byte(secret))
+	sequentialSlugGenerator.multiplier = coprimeMultiplier(binary.BigEndian.Uint64(secretHash[0:8])%keyspace, keyspace)
+	sequentialSlugGenerator.offset = binary.BigEndian.Uint64(secretHash[8:16]) % keyspace
+
+	start, err := randomInt(int64(keyspace))
+	if err != nil {
+		return nil, err
+	}
+	sequentialSlugGenerator.sequence = uint64(start)
+
+	return sequentialSlugGenerator, nil
+}
+
+// KeyspaceSize returns the number of the short slugs of slugLength symbols from the alphabet.
+func (sequentialSlugGenerator *SequentialSlugGenerator) KeyspaceSize() float64 {
+	return float64(sequentialSlugGenerator.keyspace)
+}
+
+// GenerateShortSlug encodes the permuted next number of the sequence with the symbols of the alphabet.
+func (sequentialSlugGenerator *SequentialSlugGenerator) GenerateShortSlug() (string, error) {
+	number := atomic.AddUint64(&sequentialSlugGenerator.sequence, 1) % sequentialSlugGenerator.keyspace
+
+	// number * multiplier can overflow, so it is computed in 128 bits. Both are below the keyspace,
+	// so the high half is below the keyspace as well, which bits.Div64 requires.
+	high, low := bits.Mul64(number, sequentialSlugGenerator.multiplier)
+	_, permuted := bits.Div64(high, low, sequentialSlugGenerator.keyspace)
+	permuted = (permuted + sequentialSlugGenerator.offset) % sequentialSlugGenerator.keyspace
+
+	alphabetSize := uint64(len(sequentialSlugGenerator.alphabet))
+	shortSlugBytes := make([]byte, sequentialSlugGenerator.slugLength)
+	for i := len(shortSlugBytes) - 1; i >= 0; i-- {
+		shortSlugBytes[i] = sequentialSlugGenerator.alphabet[permuted%alphabetSize]
+		permuted /= alphabetSize
+	}
+
+	return string(shortSlugBytes), nil
+}
+
+// coprimeMultiplier returns the first number from candidate on which is coprime with the keyspace and above 1,
+// so that multiplying by it modulo the keyspace is a permutation. A keyspace below 3 has no such number,
+// so the multiplier there is 1 and only the offset permutes it.
+func coprimeMultiplier(candidate uint64, keyspace uint64) uint64 {
+	if keyspace < 3 {
+		return 1
+	}
+
+	for candidate < 2 || greatestCommonDivisor(candidate, keyspace) != 1 {
+		candidate = (candidate + 1) % keyspace
+	}
+
+	return candidate
+}
+
+func greatestCommonDivisor(a uint64, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
@@ -0,0 +1,93 @@
+package urlshortener_service
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"math/big"
+	"strings"
+)
+
+// Names of the built-in slug generation strategies, used in Configuration.UrlShortenerService.SlugStrategy.
+// An empty value falls back to the random strategy.
+const (
+	RandomSlugStrategy        = "random"
+	SequentialSlugStrategy    = "sequential"
+	PronounceableSlugStrategy = "pronounceable"
+)
+
+// defaultSlugAlphabet is used when UrlShortenerService.SlugAlphabet is not configured.
+const defaultSlugAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// unreservedSymbols are the symbols which a slug alphabet can have. They are the unreserved symbols of RFC 3986,
+// so a short slug is a single path segment which needs no escaping and is safe in the cache keys as well.
+const unreservedSymbols = defaultSlugAlphabet + "-._~"
+
+// SlugGenerator generates the short slugs of the url data saved without a desired short slug.
+// The generated short slugs are not guaranteed to be unique, a duplicate is detected when it is saved
+// and another short slug is generated. KeyspaceSize returns how many different short slugs can be generated.
+// The implementations are safe for concurrent use.
+type SlugGenerator interface {
+	GenerateShortSlug() (string, error)
+	KeyspaceSize() float64
+}
+
+// NewSlugGenerator creates the slug generator of the strategy in Configuration.UrlShortenerService.SlugStrategy.
+// It panics for an unknown strategy or an invalid alphabet, like the other components created from the configuration.
+func NewSlugGenerator(configuration util.Configuration) SlugGenerator {
+	slugGenerator, err := newSlugGenerator(configuration, configuration.UrlShortenerService.SlugLength)
+	if err != nil {
+		panic(err)
+	}
+
+	return slugGenerator
+}
+
+// newSlugGenerator creates the slug generator of the configured strategy for short slugs of slugLength.
+func newSlugGenerator(configuration util.Configuration, slugLength int) (SlugGenerator, error) {
+	alphabet := configuration.UrlShortenerService.SlugAlphabet
+	if alphabet == "" {
+		alphabet = defaultSlugAlphabet
+	}
+
+	switch configuration.UrlShortenerService.SlugStrategy {
+	case "", RandomSlugStrategy:
+		return NewRandomSlugGenerator(alphabet, slugLength)
+	case SequentialSlugStrategy:
+		return NewSequentialSlugGenerator(alphabet, slugLength, configuration.UrlShortenerService.SlugSecret)
+	case PronounceableSlugStrategy:
+		return NewPronounceableSlugGenerator(slugLength)
+	default:
+		return nil, errors.New("unknown slug strategy: " + configuration.UrlShortenerService.SlugStrategy)
+	}
+}
+
+// validateAlphabet checks that the alphabet has at least 2 distinct symbols, all of them unreserved in an url.
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return errors.New("the slug alphabet must have at least 2 symbols")
+	}
+
+	var seen [256]bool
+	for i := 0; i < len(alphabet); i++ {
+		if strings.IndexByte(unreservedSymbols, alphabet[i]) < 0 {
+			return errors.New("the slug alphabet must have only letters, digits and the symbols -._~")
+		}
+		if seen[alphabet[i]] {
+			return errors.New("the slug alphabet has a repeated symbol: " + string(alphabet[i]))
+		}
+		seen[alphabet[i]] = true
+	}
+
+	return nil
+}
+
+// randomInt returns a uniformly distributed number in [0, max) from crypto/rand.
+func randomInt(max int64) (int64, error) {
+	number, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0, err
+	}
+
+	return number.Int64(), nil
+}
@@ -0,0 +1,212 @@
+package urlshortener_service_test
+
+import (
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func newTestSlugGenerator(strategy string, alphabet string, slugLength int) urlshortener_service.SlugGenerator {
+	var configuration util.Configuration
+	configuration.UrlShortenerService.SlugStrategy = strategy
+	configuration.UrlShortenerService.SlugAlphabet = alphabet
+	configuration.UrlShortenerService.SlugLength = slugLength
+	configuration.UrlShortenerService.SlugSecret = "test secret"
+
+	return urlshortener_service.NewSlugGenerator(configuration)
+}
+
+func generateShortSlug(t *testing.T, slugGenerator urlshortener_service.SlugGenerator) string {
+	shortSlug, err := slugGenerator.GenerateShortSlug()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v.", err)
+	}
+
+	return shortSlug
+}
+
+func TestSlugGeneratorsUseTheAlphabet(t *testing.T) {
+	for _, strategy := range []string{"", urlshortener_service.RandomSlugStrategy,
+		urlshortener_service.SequentialSlugStrategy} {
+		slugGenerator := newTestSlugGenerator(strategy, "", 8)
+
+		for i := 0; i < 1000; i++ {
+			shortSlug := generateShortSlug(t, slugGenerator)
+			if len(shortSlug) != 8 {
+				t.Fatalf("Expected a short slug of 8 symbols from strategy %q, got: %q.", strategy, shortSlug)
+			}
+			for _, symbol := range shortSlug {
+				if !strings.ContainsRune(testAlphabet, symbol) {
+					t.Fatalf("Unexpected symbol %q in short slug %q of strategy %q.", symbol, shortSlug, strategy)
+				}
+			}
+		}
+	}
+}
+
+func TestSlugGeneratorsWithACustomAlphabet(t *testing.T) {
+	for _, strategy := range []string{urlshortener_service.RandomSlugStrategy,
+		urlshortener_service.SequentialSlugStrategy} {
+		slugGenerator := newTestSlugGenerator(strategy, "01", 16)
+
+		shortSlug := generateShortSlug(t, slugGenerator)
+		if !regexp.MustCompile("^[01]{16}$").MatchString(shortSlug) {
+			t.Errorf("Expected a binary short slug from strategy %q, got: %q.", strategy, shortSlug)
+		}
+	}
+}
+
+func TestSlugGeneratorsGenerateUniqueShortSlugsConcurrently(t *testing.T) {
+	const goroutines = 50
+	const shortSlugsPerGoroutine = 200
+
+	for _, strategy := range []string{urlshortener_service.RandomSlugStrategy,
+		urlshortener_service.SequentialSlugStrategy} {
+		slugGenerator := newTestSlugGenerator(strategy, "", 10)
+
+		var mutex sync.Mutex
+		var waitGroup sync.WaitGroup
+		shortSlugs := make(map[string]bool)
+		for i := 0; i < goroutines; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for j := 0; j < shortSlugsPerGoroutine; j++ {
+					shortSlug, err := slugGenerator.GenerateShortSlug()
+					if err != nil {
+						t.Errorf("Unexpected error: %v.", err)
+						return
+					}
+
+					mutex.Lock()
+					if shortSlugs[shortSlug] {
+						t.Errorf("Short slug %q has been generated twice by strategy %q.", shortSlug, strategy)
+					}
+					shortSlugs[shortSlug] = true
+					mutex.Unlock()
+				}
+			}()
+		}
+		waitGroup.Wait()
+	}
+}
+
+// TestRandomSlugGeneratorDistributionIsUniform runs a chi-squared test on the frequencies of the symbols.
+// With 61 degrees of freedom a statistic above 120 has a probability of about 1e-5 for a uniform distribution,
+// while mapping every byte with a modulo, without the rejection, would give a statistic of about 1600.
+func TestRandomSlugGeneratorDistributionIsUniform(t *testing.T) {
+	const expectedPerSymbol = 4000
+	slugGenerator := newTestSlugGenerator(urlshortener_service.RandomSlugStrategy, "",
+		len(testAlphabet)*expectedPerSymbol/100)
+
+	frequencies := make(map[rune]int)
+	for i := 0; i < 100; i++ {
+		for _, symbol := range generateShortSlug(t, slugGenerator) {
+			frequencies[symbol]++
+		}
+	}
+
+	chiSquared := 0.0
+	for _, symbol := range testAlphabet {
+		difference := float64(frequencies[symbol] - expectedPerSymbol)
+		chiSquared += difference * difference / expectedPerSymbol
+	}
+
+	if chiSquared > 120 {
+		t.Errorf("The symbols are not uniformly distributed, chi-squared: %.1f.", chiSquared)
+	}
+}
+
+// With a keyspace of 2^8 short slugs, the sequential generator goes through all of them before repeating one.
+func TestSequentialSlugGeneratorIsAPermutationOfTheKeyspace(t *testing.T) {
+	slugGenerator := newTestSlugGenerator(urlshortener_service.SequentialSlugStrategy, "01", 8)
+
+	shortSlugs := make(map[string]bool)
+	previous := generateShortSlug(t, slugGenerator)
+	shortSlugs[previous] = true
+	consecutive := 0
+	for i := 1; i < 256; i++ {
+		shortSlug := generateShortSlug(t, slugGenerator)
+		if shortSlugs[shortSlug] {
+			t.Fatalf("Short slug %q has been repeated after %d short slugs.", shortSlug, i)
+		}
+		shortSlugs[shortSlug] = true
+
+		if shortSlug == increment(previous) {
+			consecutive++
+		}
+		previous = shortSlug
+	}
+
+	if consecutive > 16 {
+		t.Errorf("Expected the permutation to hide the order, but %d short slugs were consecutive.", consecutive)
+	}
+}
+
+func TestSequentialSlugGeneratorWithTheSmallestKeyspace(t *testing.T) {
+	slugGenerator := newTestSlugGenerator(urlshortener_service.SequentialSlugStrategy, "01", 1)
+
+	shortSlugs := map[string]bool{generateShortSlug(t, slugGenerator): true, generateShortSlug(t, slugGenerator): true}
+	if !shortSlugs["0"] || !shortSlugs["1"] {
+		t.Errorf("Expected both short slugs of the keyspace, got: %v.", shortSlugs)
+	}
+}
+
+// increment adds 1 to a binary number.
+func increment(binary string) string {
+	bytes := []byte(binary)
+	for i := len(bytes) - 1; i >= 0; i-- {
+		if bytes[i] == '0' {
+			bytes[i] = '1'
+			return string(bytes)
+		}
+		bytes[i] = '0'
+	}
+
+	return "1" + string(bytes)
+}
+
+func TestPronounceableSlugGenerator(t *testing.T) {
+	slugGenerator := newTestSlugGenerator(urlshortener_service.PronounceableSlugStrategy, "", 12)
+	pronounceable := regexp.MustCompile("^([bdfgklmnprstvz][aeiou]){3}-([bdfgklmnprstvz][aeiou]){3}$")
+
+	for i := 0; i < 100; i++ {
+		shortSlug := generateShortSlug(t, slugGenerator)
+		if !pronounceable.MatchString(shortSlug) {
+			t.Fatalf("Expected two words of three syllables, got: %q.", shortSlug)
+		}
+	}
+}
+
+func TestNewSlugGeneratorWithInvalidConfiguration(t *testing.T) {
+	configurations := map[string]struct {
+		strategy   string
+		alphabet   string
+		slugLength int
+	}{
+		"unknown strategy":             {"uuid", "", 8},
+		"repeated alphabet symbol":     {urlshortener_service.RandomSlugStrategy, "abca", 8},
+		"reserved alphabet symbol":     {urlshortener_service.RandomSlugStrategy, "abc/", 8},
+		"hash tag alphabet symbol":     {urlshortener_service.SequentialSlugStrategy, "abc{}", 8},
+		"non ascii alphabet symbol":    {urlshortener_service.RandomSlugStrategy, "abcé", 8},
+		"zero slug length":             {urlshortener_service.RandomSlugStrategy, "", 0},
+		"sequential keyspace too big":  {urlshortener_service.SequentialSlugStrategy, "", 11},
+		"pronounceable slug too short": {urlshortener_service.PronounceableSlugStrategy, "", 1},
+	}
+
+	for name, configuration := range configurations {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected NewSlugGenerator to panic.")
+				}
+			}()
+			newTestSlugGenerator(configuration.strategy, configuration.alphabet, configuration.slugLength)
+		})
+	}
+}
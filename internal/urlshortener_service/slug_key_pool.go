@@ -0,0 +1,165 @@
+package urlshortener_service
+
+import (
+	"context"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"log"
+	"sync"
+)
+
+// defaultSlugKeyPoolRefillSize is used when SlugKeyPool.RefillSize is not configured.
+const defaultSlugKeyPoolRefillSize = 1000
+
+// ErrSlugKeyPoolEmpty is returned when there is no short slug left in the pool while it is refilled.
+var ErrSlugKeyPoolEmpty = errors.New("the slug key pool is empty")
+
+// SlugKeyPool hands out short slugs which have been generated in advance and verified to be unused.
+// The short slugs are kept in the database, from where every instance claims a batch of them at once,
+// so creating an url data needs neither an existence check nor a retry after a collision.
+// Once the database pool falls below the low-water mark, the instance which has noticed it generates and verifies
+// a new set of short slugs in the background, so the requests never wait for a refill.
+// The short slugs claimed by an instance which stops are not used, which only wastes a small part of the keyspace.
+// A claimed short slug which is not saved yet can be generated and added to the pool again. Then one of its
+// claimers gets ErrDuplicate on save and claims the next short slug, so the url data are still unique.
+type SlugKeyPool struct {
+	slugGenerator      SlugGenerator
+	persistenceManager *storage.PersistenceManager
+	batchSize          int
+	refillSize         int
+	lowWaterMark       int
+	mutex              sync.Mutex
+	shortSlugs         []string
+	refilling          bool
+	// refillCtx is cancelled by Close, as the refills are not bound to the request which has started them.
+	refillCtx    context.Context
+	cancelRefill context.CancelFunc
+	refills      sync.WaitGroup
+}
+
+// NewSlugKeyPool creates a SlugKeyPool and starts filling the database pool in the background.
+// It panics if the database backend cannot keep the pool, see storage.SlugKeyStore.
+func NewSlugKeyPool(configuration util.Configuration, slugGenerator SlugGenerator,
+	persistenceManager *storage.PersistenceManager) *SlugKeyPool {
+	if !persistenceManager.SupportsSlugKeys() {
+		panic("urlshortener_service: the database backend does not support the slug key pool")
+	}
+
+	slugKeyPool := new(SlugKeyPool)
+
+	slugKeyPool.slugGenerator = slugGenerator
+	slugKeyPool.persistenceManager = persistenceManager
+	slugKeyPool.batchSize = configuration.SlugKeyPool.BatchSize
+	slugKeyPool.refillSize = configuration.SlugKeyPool.RefillSize
+	if slugKeyPool.refillSize <= 0 {
+		slugKeyPool.refillSize = defaultSlugKeyPoolRefillSize
+	}
+	if slugKeyPool.refillSize < slugKeyPool.batchSize {
+		slugKeyPool.refillSize = slugKeyPool.batchSize
+	}
+	slugKeyPool.lowWaterMark = configuration.SlugKeyPool.LowWaterMark
+	if slugKeyPool.lowWaterMark <= 0 {
+		slugKeyPool.lowWaterMark = slugKeyPool.refillSize / 2
+	}
+	if slugKeyPool.lowWaterMark < slugKeyPool.batchSize {
+		slugKeyPool.lowWaterMark = slugKeyPool.batchSize
+	}
+	slugKeyPool.refillCtx, slugKeyPool.cancelRefill = context.WithCancel(context.Background())
+
+	slugKeyPool.mutex.Lock()
+	slugKeyPool.startRefill()
+	slugKeyPool.mutex.Unlock()
+
+	return slugKeyPool
+}
+
+// Claim returns a short slug which is not used by any url data and has not been handed out before.
+// A new batch is claimed from the database once the claimed short slugs run out.
+// Returns ErrSlugKeyPoolEmpty if the database pool is empty, until the refill started by the claim adds to it.
+func (slugKeyPool *SlugKeyPool) Claim(ctx context.Context) (string, error) {
+	slugKeyPool.mutex.Lock()
+	defer slugKeyPool.mutex.Unlock()
+
+	if len(slugKeyPool.shortSlugs) == 0 {
+		shortSlugs, err := slugKeyPool.persistenceManager.ClaimSlugKeys(ctx, slugKeyPool.batchSize)
+		if err != nil {
+			return "", err
+		}
+		slugKeyPool.shortSlugs = shortSlugs
+		slugKeyPool.startRefill()
+
+		if len(slugKeyPool.shortSlugs) == 0 {
+			return "", ErrSlugKeyPoolEmpty
+		}
+	}
+
+	shortSlug := slugKeyPool.shortSlugs[len(slugKeyPool.shortSlugs)-1]
+	slugKeyPool.shortSlugs = slugKeyPool.shortSlugs[:len(slugKeyPool.shortSlugs)-1]
+
+	return shortSlug, nil
+}
+
+// Close stops the refill in progress and waits for it, so it is called before the persistence manager is closed.
+func (slugKeyPool *SlugKeyPool) Close() {
+	slugKeyPool.cancelRefill()
+	slugKeyPool.refills.Wait()
+}
+
+// startRefill refills the database pool in the background, unless a refill of this instance is already running.
+// The caller must hold the mutex.
+func (slugKeyPool *SlugKeyPool) startRefill() {
+	if slugKeyPool.refilling {
+		return
+	}
+	slugKeyPool.refilling = true
+	slugKeyPool.refills.Add(1)
+
+	go func() {
+		defer slugKeyPool.refills.Done()
+
+		if err := slugKeyPool.refill(slugKeyPool.refillCtx); err != nil {
+			log.Printf("Error in SlugKeyPool.refill(): %v.\n", err)
+		}
+
+		slugKeyPool.mutex.Lock()
+		slugKeyPool.refilling = false
+		slugKeyPool.mutex.Unlock()
+	}()
+}
+
+// refill generates refillSize short slugs and adds the unused ones to the database pool
+// if it has fewer than lowWaterMark short slugs.
+func (slugKeyPool *SlugKeyPool) refill(ctx context.Context) error {
+	count, err := slugKeyPool.persistenceManager.CountSlugKeys(ctx)
+	if err != nil || count >= slugKeyPool.lowWaterMark {
+		return err
+	}
+
+	shortSlugs := make([]string, 0, slugKeyPool.refillSize)
+	generated := make(map[string]bool, slugKeyPool.refillSize)
+	for i := 0; i < slugKeyPool.refillSize; i++ {
+		shortSlug, err := slugKeyPool.slugGenerator.GenerateShortSlug()
+		if err != nil {
+			return err
+		}
+		if generated[shortSlug] {
+			continue
+		}
+		generated[shortSlug] = true
+		shortSlugs = append(shortSlugs, shortSlug)
+	}
+
+	saved, err := slugKeyPool.persistenceManager.SaveSlugKeys(ctx, shortSlugs)
+	if err != nil {
+		return err
+	}
+
+	// The short slugs which have been generated twice or are taken are the collisions of the refill
+	if adaptiveSlugGenerator, ok := slugKeyPool.slugGenerator.(*AdaptiveSlugGenerator); ok {
+		adaptiveSlugGenerator.RecordAttempts(slugKeyPool.refillSize, slugKeyPool.refillSize-saved)
+	}
+
+	log.Printf("Added %d short slugs to the slug key pool.\n", saved)
+	return nil
+}
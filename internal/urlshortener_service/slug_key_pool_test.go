@@ -0,0 +1,187 @@
+package urlshortener_service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
+	testing_utils "github.com/gdgenchev/urlshortener/internal/testing"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSlugKeyPoolConfiguration(batchSize int, refillSize int) util.Configuration {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.SlugKeyPool.BatchSize = batchSize
+	configuration.SlugKeyPool.RefillSize = refillSize
+
+	return configuration
+}
+
+func newMemoryPersistenceManager(configuration util.Configuration,
+	databasePersistence storage.DatabasePersistence) *storage.PersistenceManager {
+	return storage.NewPersistenceManagerWithBackends(configuration, databasePersistence,
+		storage.NewMemoryCachePersistence())
+}
+
+// claimEventually claims a short slug, waiting for the background refill while the pool is empty.
+func claimEventually(slugKeyPool *urlshortener_service.SlugKeyPool) (string, error) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		shortSlug, err := slugKeyPool.Claim(context.Background())
+		if err != urlshortener_service.ErrSlugKeyPoolEmpty || time.Now().After(deadline) {
+			return shortSlug, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Two instances sharing a database never get the same short slug, even while they refill the pool.
+func TestSlugKeyPoolsClaimUniqueShortSlugs(t *testing.T) {
+	configuration := newSlugKeyPoolConfiguration(10, 50)
+	persistenceManager := newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence())
+	slugGenerator := urlshortener_service.NewSlugGenerator(configuration)
+	slugKeyPools := []*urlshortener_service.SlugKeyPool{
+		urlshortener_service.NewSlugKeyPool(configuration, slugGenerator, persistenceManager),
+		urlshortener_service.NewSlugKeyPool(configuration, slugGenerator, persistenceManager),
+	}
+
+	var mutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	shortSlugs := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(slugKeyPool *urlshortener_service.SlugKeyPool) {
+			defer waitGroup.Done()
+			for j := 0; j < 25; j++ {
+				shortSlug, err := claimEventually(slugKeyPool)
+				if err != nil {
+					t.Errorf("Unexpected error: %v.", err)
+					return
+				}
+
+				mutex.Lock()
+				if shortSlugs[shortSlug] {
+					t.Errorf("Short slug %q has been claimed twice.", shortSlug)
+				}
+				shortSlugs[shortSlug] = true
+				mutex.Unlock()
+			}
+		}(slugKeyPools[i%2])
+	}
+	waitGroup.Wait()
+
+	for _, slugKeyPool := range slugKeyPools {
+		slugKeyPool.Close()
+	}
+}
+
+// stubSlugGenerator returns its short slugs in order, starting over after the last one.
+type stubSlugGenerator struct {
+	shortSlugs []string
+	next       int
+}
+
+func (stubSlugGenerator *stubSlugGenerator) GenerateShortSlug() (string, error) {
+	shortSlug := stubSlugGenerator.shortSlugs[stubSlugGenerator.next%len(stubSlugGenerator.shortSlugs)]
+	stubSlugGenerator.next++
+
+	return shortSlug, nil
+}
+
+func (stubSlugGenerator *stubSlugGenerator) KeyspaceSize() float64 {
+	return float64(len(stubSlugGenerator.shortSlugs))
+}
+
+func TestSlugKeyPoolSkipsTakenShortSlugs(t *testing.T) {
+	configuration := newSlugKeyPoolConfiguration(2, 2)
+	persistenceManager := newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence())
+	persistenceManager.SaveUrlData(context.Background(), model.UrlData{ShortSlug: "taken", RealUrl: testRealUrl,
+		Expires: model.CustomTime{Time: time.Now().Add(time.Hour)}})
+
+	slugGenerator := &stubSlugGenerator{shortSlugs: []string{"taken", "free"}}
+	slugKeyPool := urlshortener_service.NewSlugKeyPool(configuration, slugGenerator, persistenceManager)
+	// Close waits for the refill started by NewSlugKeyPool
+	slugKeyPool.Close()
+
+	shortSlugs, err := persistenceManager.ClaimSlugKeys(context.Background(), 10)
+	if err != nil || len(shortSlugs) != 1 || shortSlugs[0] != "free" {
+		t.Errorf("Expected only the free short slug in the pool, got: %v, error: %v.", shortSlugs, err)
+	}
+}
+
+func TestSlugKeyPoolWhenDatabaseIsUnavailable(t *testing.T) {
+	configuration := newSlugKeyPoolConfiguration(5, 10)
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	persistenceManager := newMemoryPersistenceManager(configuration, databasePersistence)
+	databasePersistence.SetDown(true)
+	slugKeyPool := urlshortener_service.NewSlugKeyPool(configuration,
+		urlshortener_service.NewSlugGenerator(configuration), persistenceManager)
+	defer slugKeyPool.Close()
+
+	if _, err := slugKeyPool.Claim(context.Background()); !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got: %v.", err)
+	}
+
+	// The pool is refilled once the database is back and the claimed batch is used without the database
+	databasePersistence.SetDown(false)
+	if _, err := claimEventually(slugKeyPool); err != nil {
+		t.Fatalf("Expected a short slug after the refill, got error: %v.", err)
+	}
+	databasePersistence.SetDown(true)
+	for i := 0; i < 4; i++ {
+		if _, err := slugKeyPool.Claim(context.Background()); err != nil {
+			t.Errorf("Expected a short slug from the claimed batch, got error: %v.", err)
+		}
+	}
+}
+
+func TestNewSlugKeyPoolWithoutSlugKeyStore(t *testing.T) {
+	configuration := newSlugKeyPoolConfiguration(5, 10)
+	persistenceManager := newMemoryPersistenceManager(configuration, urlDataOnlyDatabasePersistence{
+		storage.NewMemoryDatabasePersistence()})
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected NewSlugKeyPool to panic.")
+		}
+	}()
+	urlshortener_service.NewSlugKeyPool(configuration, urlshortener_service.NewSlugGenerator(configuration),
+		persistenceManager)
+}
+
+// urlDataOnlyDatabasePersistence hides the optional interfaces of the wrapped database persistence.
+type urlDataOnlyDatabasePersistence struct {
+	storage.DatabasePersistence
+}
+
+func TestCreateShortUrlWithSlugKeyPool(t *testing.T) {
+	configuration := newSlugKeyPoolConfiguration(5, 10)
+	slugKeyPoolService := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		newMemoryPersistenceManager(configuration, storage.NewMemoryDatabasePersistence()))
+
+	for i := 0; i < 12; i++ {
+		request := httptest.NewRequest("POST", "/api/create", strings.NewReader(`{"real-url":"`+testRealUrl+`"}`))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(slugKeyPoolService.HandleGenerateShortSlug).ServeHTTP(rr, request)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status: %v, got status: %v.", http.StatusCreated, rr.Code)
+		}
+
+		var response urlshortener_service.Response
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		shortSlug := strings.TrimPrefix(response.ShortUrl, configuration.UrlShortenerService.DomainName+"/")
+		if rr := sendRedirectRequest(slugKeyPoolService, shortSlug); rr.Code != http.StatusFound {
+			t.Errorf("Expected a redirect for short slug %q, got status: %v.", shortSlug, rr.Code)
+		}
+	}
+}
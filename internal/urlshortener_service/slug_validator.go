@@ -0,0 +1,132 @@
+package urlshortener_service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/util"
+	"strings"
+	"sync"
+)
+
+// Used when the SlugValidation section does not configure them. The maximum length is the size of the
+// short slug column.
+const (
+	defaultMinSlugLength      = 1
+	defaultMaxSlugLength      = 50
+	defaultSlugAllowedSymbols = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+)
+
+// forbiddenSlugSymbols cannot be allowed in the short slugs, nor can the whitespace, the control and the non ASCII
+// symbols. They end the path or start the query or the fragment of an url, need escaping or are the separators
+// and the hash tag braces of the cache keys.
+const forbiddenSlugSymbols = "/?#%{}:"
+
+// ErrInvalidShortSlug is wrapped by the errors of SlugValidator.Validate, which describe why the short slug
+// has been rejected, so that the message can be sent to the user.
+var ErrInvalidShortSlug = errors.New("invalid short slug")
+
+// SlugValidator checks the desired short slugs of the users. A short slug must have between minLength
+// and maxLength symbols from allowedSymbols, which are printable ASCII only, so that unicode lookalikes of other
+// short slugs are rejected. It must not be a reserved word, such as a path served by the router,
+// and must not contain a blocked word. Both are compared case insensitively.
+type SlugValidator struct {
+	minLength      int
+	maxLength      int
+	allowedSymbols [128]bool
+	blockedWords   []string
+	mutex          sync.RWMutex
+	reservedWords  map[string]bool
+}
+
+// NewSlugValidator creates the validator of the SlugValidation rules. It panics if the lengths are out of order
+// or the allowed symbols have a forbidden one, like the other components created from the configuration.
+func NewSlugValidator(configuration util.Configuration) *SlugValidator {
+	slugValidator := new(SlugValidator)
+
+	slugValidator.minLength = configuration.SlugValidation.MinLength
+	if slugValidator.minLength <= 0 {
+		slugValidator.minLength = defaultMinSlugLength
+	}
+	slugValidator.maxLength = configuration.SlugValidation.MaxLength
+	if slugValidator.maxLength <= 0 {
+		slugValidator.maxLength = defaultMaxSlugLength
+	}
+
+	if slugValidator.minLength > slugValidator.maxLength || slugValidator.maxLength > defaultMaxSlugLength {
+		panic(fmt.Sprintf("the short slug length must be between %d and %d, got: %d to %d", defaultMinSlugLength,
+			defaultMaxSlugLength, slugValidator.minLength, slugValidator.maxLength))
+	}
+
+	allowedSymbols := configuration.SlugValidation.AllowedSymbols
+	if allowedSymbols == "" {
+		allowedSymbols = defaultSlugAllowedSymbols
+	}
+	for _, symbol := range allowedSymbols {
+		if symbol <= ' ' || symbol >= 127 || strings.ContainsRune(forbiddenSlugSymbols, symbol) {
+			panic(fmt.Sprintf("the symbol %q cannot be allowed in a short slug", symbol))
+		}
+		slugValidator.allowedSymbols[symbol] = true
+	}
+
+	for _, blockedWord := range configuration.SlugValidation.Blocklist {
+		slugValidator.blockedWords = append(slugValidator.blockedWords, normalizeSlugWord(blockedWord))
+	}
+
+	slugValidator.reservedWords = make(map[string]bool)
+	slugValidator.Reserve(configuration.SlugValidation.ReservedWords...)
+
+	return slugValidator
+}
+
+// Reserve adds words which cannot be used as short slugs, such as the first segments of the router paths.
+func (slugValidator *SlugValidator) Reserve(words ...string) {
+	slugValidator.mutex.Lock()
+	defer slugValidator.mutex.Unlock()
+
+	for _, word := range words {
+		slugValidator.reservedWords[strings.ToLower(word)] = true
+	}
+}
+
+// Validate checks a desired short slug. The returned error wraps ErrInvalidShortSlug
+// and its message tells the user what to change.
+func (slugValidator *SlugValidator) Validate(shortSlug string) error {
+	if len(shortSlug) < slugValidator.minLength || len(shortSlug) > slugValidator.maxLength {
+		return fmt.Errorf("%w: it must be between %d and %d characters long", ErrInvalidShortSlug,
+			slugValidator.minLength, slugValidator.maxLength)
+	}
+
+	for _, symbol := range shortSlug {
+		if symbol >= 128 || !slugValidator.allowedSymbols[symbol] {
+			return fmt.Errorf("%w: the character %q is not allowed", ErrInvalidShortSlug, symbol)
+		}
+	}
+
+	return slugValidator.validateWords(shortSlug)
+}
+
+// validateWords checks only that the short slug is not reserved and has no blocked word.
+// It is used for the generated short slugs, whose length and symbols are set by the configured strategy.
+func (slugValidator *SlugValidator) validateWords(shortSlug string) error {
+	slugValidator.mutex.RLock()
+	reserved := slugValidator.reservedWords[strings.ToLower(shortSlug)]
+	slugValidator.mutex.RUnlock()
+	if reserved {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidShortSlug, shortSlug)
+	}
+
+	normalizedShortSlug := normalizeSlugWord(shortSlug)
+	for _, blockedWord := range slugValidator.blockedWords {
+		if blockedWord != "" && strings.Contains(normalizedShortSlug, blockedWord) {
+			return fmt.Errorf("%w: it contains a blocked word", ErrInvalidShortSlug)
+		}
+	}
+
+	return nil
+}
+
+// normalizeSlugWord lowers the case and removes the separators, so that a blocked word is found
+// even if it is split with dashes or underscores.
+func normalizeSlugWord(word string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(word))
+}
@@ -0,0 +1,111 @@
+package urlshortener_service_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestSlugValidator() *urlshortener_service.SlugValidator {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.SlugValidation.MinLength = 3
+	configuration.SlugValidation.MaxLength = 10
+	configuration.SlugValidation.AllowedSymbols = ""
+	configuration.SlugValidation.ReservedWords = []string{"admin"}
+	configuration.SlugValidation.Blocklist = []string{"darn"}
+
+	return urlshortener_service.NewSlugValidator(configuration)
+}
+
+func TestSlugValidatorRejectsInvalidShortSlugs(t *testing.T) {
+	slugValidator := newTestSlugValidator()
+	slugValidator.Reserve("favicon.ico", "css")
+
+	rejected := map[string]string{
+		"ab":          "between 3 and 10 characters",
+		"abcdefghijk": "between 3 and 10 characters",
+		"with/slash":  "'/' is not allowed",
+		"with space":  "' ' is not allowed",
+		"kittеns":     "'е' is not allowed", // Cyrillic е instead of the Latin e
+		"ADMIN":       "\"ADMIN\" is reserved",
+		"CsS":         "\"CsS\" is reserved",
+		"so-da_rn":    "contains a blocked word",
+	}
+	for shortSlug, expectedMessage := range rejected {
+		err := slugValidator.Validate(shortSlug)
+		if !errors.Is(err, urlshortener_service.ErrInvalidShortSlug) {
+			t.Errorf("Expected %q to be rejected, got: %v.", shortSlug, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), expectedMessage) {
+			t.Errorf("Expected the error for %q to contain %q, got: %v.", shortSlug, expectedMessage, err)
+		}
+	}
+}
+
+func TestSlugValidatorAcceptsValidShortSlugs(t *testing.T) {
+	slugValidator := newTestSlugValidator()
+
+	for _, shortSlug := range []string{"kittens", "my-link_2", "administer", "abc"} {
+		if err := slugValidator.Validate(shortSlug); err != nil {
+			t.Errorf("Expected %q to be valid, got: %v.", shortSlug, err)
+		}
+	}
+}
+
+func TestNewSlugValidatorWithInvalidConfiguration(t *testing.T) {
+	configurations := map[string]struct {
+		minLength      int
+		maxLength      int
+		allowedSymbols string
+	}{
+		"slash":                  {3, 10, "abc/"},
+		"query":                  {3, 10, "abc?"},
+		"fragment":               {3, 10, "abc#"},
+		"percent":                {3, 10, "abc%"},
+		"hash tag braces":        {3, 10, "abc{}"},
+		"colon":                  {3, 10, "abc:"},
+		"space":                  {3, 10, "abc "},
+		"tab":                    {3, 10, "abc\t"},
+		"non ascii":              {3, 10, "abcé"},
+		"lengths out of order":   {10, 3, ""},
+		"longer than the column": {3, 51, ""},
+	}
+
+	for name, configuration := range configurations {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected NewSlugValidator to panic.")
+				}
+			}()
+			testConfiguration := testPersistence.GetTestConfiguration()
+			testConfiguration.SlugValidation.MinLength = configuration.minLength
+			testConfiguration.SlugValidation.MaxLength = configuration.maxLength
+			testConfiguration.SlugValidation.AllowedSymbols = configuration.allowedSymbols
+			urlshortener_service.NewSlugValidator(testConfiguration)
+		})
+	}
+}
+
+func TestCreateShortUrlWithAReservedShortSlug(t *testing.T) {
+	urlShortenerService.ReserveShortSlugs("api", "index.html")
+
+	for _, shortSlug := range []string{"api", "index.html", "k/ttens"} {
+		jsonStr := []byte(`{"real-url":"` + testRealUrl + `", "short-slug":"` + shortSlug + `"}`)
+		request := httptest.NewRequest("POST", "/api/create", bytes.NewBuffer(jsonStr))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(urlShortenerService.HandleGenerateShortSlug).ServeHTTP(rr, request)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status: %v for short slug %q, got status: %v.", http.StatusBadRequest, shortSlug, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "Error: Invalid short slug") {
+			t.Errorf("Expected a validation error message for short slug %q, got: %s.", shortSlug, rr.Body.String())
+		}
+	}
+}
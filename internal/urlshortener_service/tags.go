@@ -0,0 +1,61 @@
+package urlshortener_service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"strings"
+)
+
+const (
+	// maxTags is the maximum number of tags of an url data.
+	maxTags = 8
+	// maxTagLength is the maximum length of a single tag.
+	maxTagLength = 30
+)
+
+// ErrInvalidTags is returned when the tags of an url data break one of the rules, see normalizeTags.
+var ErrInvalidTags = errors.New("invalid tags")
+
+// normalizeTags lower cases the tags and drops the duplicates, keeping the order of the first occurrences.
+// There can be at most maxTags tags of at most maxTagLength lower case letters, digits, '-' and '_' each,
+// so that a tag never contains the comma which separates the tags in the database.
+func normalizeTags(tags model.Tags) (model.Tags, error) {
+	normalized := make(model.Tags, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if err := validateTag(tag); err != nil {
+			return nil, err
+		}
+		if !normalized.HasTag(tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("%w: there can be at most %d tags", ErrInvalidTags, maxTags)
+	}
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+
+	return normalized, nil
+}
+
+func validateTag(tag string) error {
+	if tag == "" || len(tag) > maxTagLength {
+		return fmt.Errorf("%w: a tag must be between 1 and %d characters long", ErrInvalidTags, maxTagLength)
+	}
+
+	for _, symbol := range tag {
+		if !isTagSymbol(symbol) {
+			return fmt.Errorf("%w: the character %q is not allowed", ErrInvalidTags, symbol)
+		}
+	}
+
+	return nil
+}
+
+func isTagSymbol(symbol rune) bool {
+	return (symbol >= 'a' && symbol <= 'z') || (symbol >= '0' && symbol <= '9') || symbol == '-' || symbol == '_'
+}
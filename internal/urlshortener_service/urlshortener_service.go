@@ -2,6 +2,7 @@
 package urlshortener_service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/gdgenchev/urlshortener/internal/model"
@@ -10,9 +11,8 @@ import (
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -22,50 +22,57 @@ type Response struct {
 	ErrorMessage string `json:"error-message"`
 }
 
-// ShortSlugGenerator provides the logic for generating a short url slug.
-type ShortSlugGenerator struct {
-	SlugLength int
+// urlDataPatch holds the fields of an url data which are changed by a PATCH request. The omitted fields are kept.
+type urlDataPatch struct {
+	RealUrl *string           `json:"real-url"`
+	Expires *model.CustomTime `json:"expires"`
+	Tags    *model.Tags       `json:"tags"`
 }
 
-func NewShortSlugGenerator(slugLength int) *ShortSlugGenerator {
-	shortSlugGenerator := new(ShortSlugGenerator)
-	shortSlugGenerator.SlugLength = slugLength
+// defaultMaxSlugRetries is used when UrlShortenerService.MaxSlugRetries is not configured.
+const defaultMaxSlugRetries = 10
 
-	return shortSlugGenerator
-}
-
-// generateShortUrl generates a short slug by using a hardcoded alphabet.
-// The algorithm is simple - choose N times a random symbol from the alphabet
-// where N is equal to shortSlugGenerator.length. Extra persistence check should be
-// made to make sure that the short url slug is unique.
-func (shortSlugGenerator *ShortSlugGenerator) generateShortSlug() string {
-	var alphabet = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	shortSlugBytes := make([]byte, shortSlugGenerator.SlugLength)
-	randomGenerator := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for i := range shortSlugBytes {
-		shortSlugBytes[i] = alphabet[randomGenerator.Intn(len(alphabet))]
-	}
-
-	return string(shortSlugBytes)
-}
+// ErrShortSlugRetriesExhausted is returned when every generated short slug of a create has collided.
+var ErrShortSlugRetriesExhausted = errors.New("could not generate an unused short slug")
 
 // UrlShortenerService wraps the REST handlers for the url shortener.
 type UrlShortenerService struct {
-	domainName         string
-	defaultExpiresDays int
-	shortSlugGenerator *ShortSlugGenerator
-	persistenceManager *storage.PersistenceManager
-	mutex              sync.Mutex
+	domainName           string
+	defaultExpiresDays   int
+	slugGenerator        *AdaptiveSlugGenerator
+	maxSlugRetries       int
+	slugKeyPool          *SlugKeyPool
+	slugValidator        *SlugValidator
+	allowAnonymousCreate bool
+	persistenceManager   *storage.PersistenceManager
 }
 
 func NewUrlShortenerService(config util.Configuration) *UrlShortenerService {
+	return NewUrlShortenerServiceWithPersistenceManager(config, storage.NewPersistenceManager(config))
+}
+
+// NewUrlShortenerServiceWithPersistenceManager creates the service on top of an already created PersistenceManager.
+func NewUrlShortenerServiceWithPersistenceManager(config util.Configuration,
+	persistenceManager *storage.PersistenceManager) *UrlShortenerService {
 	urlShortenerService := new(UrlShortenerService)
 
 	urlShortenerService.domainName = config.UrlShortenerService.DomainName
 	urlShortenerService.defaultExpiresDays = config.UrlShortenerService.DefaultExpireDays
-	urlShortenerService.shortSlugGenerator = NewShortSlugGenerator(config.UrlShortenerService.SlugLength)
-	urlShortenerService.persistenceManager = storage.NewPersistenceManager(config)
+	urlShortenerService.slugGenerator = NewAdaptiveSlugGenerator(config)
+	urlShortenerService.maxSlugRetries = config.UrlShortenerService.MaxSlugRetries
+	if urlShortenerService.maxSlugRetries <= 0 {
+		urlShortenerService.maxSlugRetries = defaultMaxSlugRetries
+	}
+	urlShortenerService.persistenceManager = persistenceManager
+	urlShortenerService.slugValidator = NewSlugValidator(config)
+	err := urlShortenerService.slugGenerator.RestoreSlugLength(context.Background(), persistenceManager)
+	if err != nil {
+		log.Printf("Error in AdaptiveSlugGenerator.RestoreSlugLength(): %v.\n", err)
+	}
+	urlShortenerService.allowAnonymousCreate = config.ApiKeys.AllowAnonymousCreate
+	if config.SlugKeyPool.BatchSize > 0 {
+		urlShortenerService.slugKeyPool = NewSlugKeyPool(config, urlShortenerService.slugGenerator, persistenceManager)
+	}
 
 	return urlShortenerService
 }
@@ -76,10 +83,15 @@ func NewUrlShortenerService(config util.Configuration) *UrlShortenerService {
 // 	 2. The user has not passed a desired expire date - then we generate a default one - Now() + defaultExpiresDays
 // There are 2 cases for handling the short url slug parameter:
 // 	 1. The user has passed a desired short slug in the request
+// 		- Then we validate it and send the broken rule back if it is rejected, see SlugValidator.
 // 		- Then we just try to save it and if it fails, we return a high level error response, so as not to directly
 //        inform the user for the existence of that short url.
 // 	 2. The user has not passed a desired short slug(urlData.ShortSlug is equal to "")
-// 		- Then we use the ShortSlugGenerator to generate a new random string and persist it.
+// 		- Then we use the configured SlugGenerator to generate a new short slug and persist it.
+//        If the generated short slug collides with an existing one, we generate another one.
+// The short slug is reserved atomically by the storage layer, so no locking is needed here.
+// The url data is owned by the owner of the api key of the request, see WithScope, or by no one if it has none.
+// The tags of the url data are validated and sent back if they are rejected, see normalizeTags.
 func (urlShortenerService *UrlShortenerService) HandleGenerateShortSlug(writer http.ResponseWriter, request *http.Request) {
 	urlData, err := urlShortenerService.getUrlDataFromRequest(request)
 	if err != nil {
@@ -87,21 +99,34 @@ func (urlShortenerService *UrlShortenerService) HandleGenerateShortSlug(writer h
 		return
 	}
 
+	urlData.Tags, err = normalizeTags(urlData.Tags)
+	if err != nil {
+		urlShortenerService.sendValidationErrorResponse(writer, err)
+		return
+	}
+	// The creation time is set by the storage
+	urlData.CreatedAt = time.Time{}
+
+	urlData.Owner = ""
+	if apiKey, found := apiKeyFromRequest(request); found {
+		urlData.Owner = apiKey.Owner
+	}
+
 	if urlData.Expires.IsZero() {
 		urlData.Expires.Time = time.Now().Local().AddDate(0, 0, urlShortenerService.defaultExpiresDays)
 	}
 
-	urlShortenerService.mutex.Lock()
 	if urlData.ShortSlug == "" {
-		urlData.ShortSlug = urlShortenerService.generateUniqueShortSlug()
+		err = urlShortenerService.saveUrlDataWithGeneratedShortSlug(request.Context(), &urlData)
+	} else if err = urlShortenerService.slugValidator.Validate(urlData.ShortSlug); err != nil {
+		urlShortenerService.sendValidationErrorResponse(writer, err)
+		return
+	} else {
+		err = urlShortenerService.persistenceManager.SaveUrlData(request.Context(), urlData)
 	}
-	stored := urlShortenerService.persistenceManager.SaveUrlData(urlData)
-	urlShortenerService.mutex.Unlock()
 
-	if !stored {
-		// Send a masked error message for the duplicate short slug, so as to provide some kind of protection :D
-		urlShortenerService.sendErrorResponse(writer, http.StatusConflict,
-			"Error: Please choose another short slug or leave it empty!")
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
 		return
 	}
 
@@ -110,22 +135,140 @@ func (urlShortenerService *UrlShortenerService) HandleGenerateShortSlug(writer h
 }
 
 // HandleRedirectToRealUrl is the REST handler for an incoming GET request for redirecting to the real url.
+// The redirect is temporary and must not be cached, as the short slug can be updated or deleted later.
 func (urlShortenerService *UrlShortenerService) HandleRedirectToRealUrl(writer http.ResponseWriter, request *http.Request) {
 	shortSlug := mux.Vars(request)["short-slug"]
 
-	realUrl, found := urlShortenerService.persistenceManager.GetRealUrl(shortSlug)
+	realUrl, err := urlShortenerService.persistenceManager.GetRealUrl(request.Context(), shortSlug)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	http.Redirect(writer, request, realUrl, http.StatusFound)
+}
+
+// HandleGetArchivedUrlData is the REST handler for an incoming GET request for the archived history of a short slug.
+// It responds with the expired url data which has been archived for the short slug, newest first.
+func (urlShortenerService *UrlShortenerService) HandleGetArchivedUrlData(writer http.ResponseWriter, request *http.Request) {
+	shortSlug := mux.Vars(request)["short-slug"]
+
+	archivedUrlData, err := urlShortenerService.persistenceManager.GetArchivedUrlData(request.Context(), shortSlug)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(writer).Encode(archivedUrlData)
+	if err != nil {
+		log.Printf("Error while encoding the archived url data in json format: %v.\n", err)
+	}
+}
+
+// HandleGetLink is the REST handler for an incoming GET request for the url data of a short slug.
+// The url data is read from the primary database, as the cache and the read replicas may lag behind an update.
+// The links handlers serve only the url data which the api key of the request can manage, see canManage.
+func (urlShortenerService *UrlShortenerService) HandleGetLink(writer http.ResponseWriter, request *http.Request) {
+	shortSlug := mux.Vars(request)["short-slug"]
+
+	urlData, err := urlShortenerService.getManagedUrlData(request, shortSlug)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	urlShortenerService.sendUrlData(writer, urlData)
+}
+
+// HandlePatchLink is the REST handler for an incoming PATCH request for changing the real url,
+// the expire date or the tags of a short slug. It responds with the changed url data.
+// The short slug stops redirecting to its previous real url right away, see PersistenceManager.UpdateUrlData.
+func (urlShortenerService *UrlShortenerService) HandlePatchLink(writer http.ResponseWriter, request *http.Request) {
+	shortSlug := mux.Vars(request)["short-slug"]
+
+	var patch urlDataPatch
+	err := json.NewDecoder(request.Body).Decode(&patch)
+	if err != nil || (patch.RealUrl != nil && *patch.RealUrl == "") {
+		log.Printf("Error in HandlePatchLink() - invalid request body: %v.\n", err)
+		urlShortenerService.sendErrorResponse(writer, http.StatusBadRequest, "Error: Invalid Request")
+		return
+	}
+
+	urlData, err := urlShortenerService.getManagedUrlData(request, shortSlug)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	if patch.RealUrl != nil {
+		urlData.RealUrl = *patch.RealUrl
+	}
+	if patch.Expires != nil && !patch.Expires.IsZero() {
+		urlData.Expires = *patch.Expires
+	}
+	if patch.Tags != nil {
+		urlData.Tags, err = normalizeTags(*patch.Tags)
+		if err != nil {
+			urlShortenerService.sendValidationErrorResponse(writer, err)
+			return
+		}
+	}
+
+	err = urlShortenerService.persistenceManager.UpdateUrlData(request.Context(), urlData)
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
+		return
+	}
+
+	urlShortenerService.sendUrlData(writer, urlData)
+}
 
-	if !found {
-		urlShortenerService.sendErrorResponse(writer, http.StatusNotFound, "Error: URL Not Found")
+// HandleDeleteLink is the REST handler for an incoming DELETE request for a short slug.
+// The short slug stops redirecting right away, but is not reused until the reuse cooldown passes
+// and is archived when the expired url data is removed, see PersistenceManager.DeleteUrlData.
+func (urlShortenerService *UrlShortenerService) HandleDeleteLink(writer http.ResponseWriter, request *http.Request) {
+	shortSlug := mux.Vars(request)["short-slug"]
+
+	_, err := urlShortenerService.getManagedUrlData(request, shortSlug)
+	if err == nil {
+		err = urlShortenerService.persistenceManager.DeleteUrlData(request.Context(), shortSlug)
+	}
+	if err != nil {
+		urlShortenerService.sendStorageErrorResponse(writer, err)
 		return
 	}
 
-	http.Redirect(writer, request, realUrl, http.StatusMovedPermanently)
+	writer.WriteHeader(http.StatusNoContent)
 }
 
-// ClosePersistenceManager closes the open persistence services.
+// ReserveShortSlugs makes the words unavailable as short slugs, such as the paths served next to the redirects.
+func (urlShortenerService *UrlShortenerService) ReserveShortSlugs(words ...string) {
+	urlShortenerService.slugValidator.Reserve(words...)
+}
+
+// Stats returns the monitoring values of the persistence services and of the short slug generation.
+func (urlShortenerService *UrlShortenerService) Stats() storage.Stats {
+	stats := urlShortenerService.persistenceManager.Stats()
+	for name, value := range urlShortenerService.slugGenerator.Stats() {
+		stats[name] = value
+	}
+
+	return stats
+}
+
+// ClosePersistenceManager closes the open persistence services, after the slug key pool has stopped using them.
 func (urlShortenerService *UrlShortenerService) ClosePersistenceManager() {
-	urlShortenerService.persistenceManager.Close()
+	if urlShortenerService.slugKeyPool != nil {
+		urlShortenerService.slugKeyPool.Close()
+	}
+
+	err := urlShortenerService.persistenceManager.Close()
+	if err != nil {
+		log.Printf("Error while closing the persistence manager: %v.\n", err)
+	}
 }
 
 // Private helper methods
@@ -152,13 +295,135 @@ func (urlShortenerService *UrlShortenerService) getUrlDataFromRequest(request *h
 	return urlData, nil
 }
 
-func (urlShortenerService *UrlShortenerService) generateUniqueShortSlug() string {
-	shortSlug := urlShortenerService.shortSlugGenerator.generateShortSlug()
-	for urlShortenerService.persistenceManager.Exists(shortSlug) {
-		shortSlug = urlShortenerService.shortSlugGenerator.generateShortSlug()
+// getManagedUrlData returns the url data of the short slug if the api key of the request can manage it.
+// The url data of the other owners is reported as not found, so as not to inform about its existence.
+func (urlShortenerService *UrlShortenerService) getManagedUrlData(request *http.Request,
+	shortSlug string) (model.UrlData, error) {
+	urlData, err := urlShortenerService.persistenceManager.GetUrlData(request.Context(), shortSlug)
+	if err != nil {
+		return model.UrlData{}, err
+	}
+	if !canManage(request, urlData) {
+		return model.UrlData{}, storage.ErrNotFound
 	}
 
-	return shortSlug
+	return urlData, nil
+}
+
+// saveUrlDataWithGeneratedShortSlug generates short slugs until one of them is saved successfully.
+// ErrDuplicate only means that the generated short slug collided with an existing one, so it is retried
+// at most maxSlugRetries times. The collisions are recorded, so that the short slugs get longer
+// before the keyspace fills up. With a slug key pool the short slugs are claimed from it instead,
+// see saveUrlDataWithSlugKey, unless the pool is empty.
+func (urlShortenerService *UrlShortenerService) saveUrlDataWithGeneratedShortSlug(ctx context.Context,
+	urlData *model.UrlData) error {
+	if urlShortenerService.slugKeyPool != nil {
+		err := urlShortenerService.saveUrlDataWithSlugKey(ctx, urlData)
+		if !errors.Is(err, ErrSlugKeyPoolEmpty) {
+			return err
+		}
+		// The pool is being refilled in the background, so the short slug is generated meanwhile
+	}
+
+	for attempt := 0; attempt < urlShortenerService.maxSlugRetries; attempt++ {
+		shortSlug, err := urlShortenerService.slugGenerator.GenerateShortSlug()
+		if err != nil {
+			return err
+		}
+		if urlShortenerService.slugValidator.validateWords(shortSlug) != nil {
+			continue
+		}
+		urlData.ShortSlug = shortSlug
+
+		err = urlShortenerService.persistenceManager.SaveUrlData(ctx, *urlData)
+		if errors.Is(err, storage.ErrDuplicate) {
+			urlShortenerService.slugGenerator.RecordAttempts(1, 1)
+			continue
+		}
+		if err == nil {
+			urlShortenerService.slugGenerator.RecordAttempts(1, 0)
+		}
+		return err
+	}
+
+	return ErrShortSlugRetriesExhausted
+}
+
+// saveUrlDataWithSlugKey saves the url data with a short slug claimed from the slug key pool.
+// A claimed short slug collides only if it has been taken as a desired short slug after it has been added
+// to the pool, in which case the next one is claimed, at most maxSlugRetries times.
+func (urlShortenerService *UrlShortenerService) saveUrlDataWithSlugKey(ctx context.Context,
+	urlData *model.UrlData) error {
+	for attempt := 0; attempt < urlShortenerService.maxSlugRetries; attempt++ {
+		shortSlug, err := urlShortenerService.slugKeyPool.Claim(ctx)
+		if err != nil {
+			return err
+		}
+		if urlShortenerService.slugValidator.validateWords(shortSlug) != nil {
+			continue
+		}
+		urlData.ShortSlug = shortSlug
+
+		err = urlShortenerService.persistenceManager.SaveUrlDataWithSlugKey(ctx, *urlData)
+		if !errors.Is(err, storage.ErrDuplicate) {
+			return err
+		}
+	}
+
+	return ErrShortSlugRetriesExhausted
+}
+
+// sendStorageErrorResponse sends the response for an error returned by the storage, see storageErrorResponse.
+func (urlShortenerService *UrlShortenerService) sendStorageErrorResponse(writer http.ResponseWriter, err error) {
+	status, errorMessage := storageErrorResponse(err)
+	urlShortenerService.sendErrorResponse(writer, status, errorMessage)
+}
+
+// storageErrorResponse maps an error returned by the storage to the matching http status code and error message.
+// The errors which are not caused by the user are logged and their details are not sent in the response.
+func storageErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, storage.ErrDuplicate):
+		// Send a masked error message for the duplicate short slug, so as to provide some kind of protection :D
+		return http.StatusConflict, "Error: Please choose another short slug or leave it empty!"
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "Error: URL Not Found"
+	case errors.Is(err, storage.ErrExpired):
+		return http.StatusGone, "Error: URL Expired"
+	case errors.Is(err, storage.ErrBatchAborted):
+		return http.StatusFailedDependency, "Error: Not created, as another URL of the batch has failed"
+	case errors.Is(err, ErrShortSlugRetriesExhausted):
+		log.Printf("Short slug generation failed: %v.\n", err)
+		return http.StatusServiceUnavailable, "Error: Could not generate a short url, please try again"
+	case errors.Is(err, storage.ErrUnsupported):
+		return http.StatusNotImplemented, "Error: Not Implemented"
+	case errors.Is(err, storage.ErrUnavailable):
+		log.Printf("Storage unavailable: %v.\n", err)
+		return http.StatusServiceUnavailable, "Error: Service Unavailable"
+	default:
+		log.Printf("Storage error: %v.\n", err)
+		return http.StatusInternalServerError, "Error: Internal Server Error"
+	}
+}
+
+// sendValidationErrorResponse sends the validation error, which describes the rule broken by the request,
+// to the user.
+func (urlShortenerService *UrlShortenerService) sendValidationErrorResponse(writer http.ResponseWriter, err error) {
+	urlShortenerService.sendErrorResponse(writer, http.StatusBadRequest, validationErrorMessage(err))
+}
+
+func validationErrorMessage(err error) string {
+	message := err.Error()
+	return "Error: " + strings.ToUpper(message[:1]) + message[1:]
+}
+
+func (urlShortenerService *UrlShortenerService) sendUrlData(writer http.ResponseWriter, urlData model.UrlData) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(writer).Encode(&urlData)
+	if err != nil {
+		log.Printf("Error while encoding the url data in json format: %v.\n", err)
+	}
 }
 
 func (urlShortenerService *UrlShortenerService) sendErrorResponse(writer http.ResponseWriter, status int, errorMessage string) {
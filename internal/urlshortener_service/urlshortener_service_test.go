@@ -2,7 +2,10 @@ package urlshortener_service_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"github.com/gdgenchev/urlshortener/internal/model"
+	"github.com/gdgenchev/urlshortener/internal/storage"
 	testing_utils "github.com/gdgenchev/urlshortener/internal/testing"
 	"github.com/gdgenchev/urlshortener/internal/urlshortener_service"
 	"github.com/gorilla/mux"
@@ -10,7 +13,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 const testRealUrl = "https://www.google.com/search?q=kittens&tbm=isch&ved=2ahUKEwj5_ZOS2IjqAhXRNuwKHeRzAVoQ2-cCegQIABAA&oq=kittens&gs_lcp=CgNpbWcQAzIECCMQJzICCAAyBAgAEB4yBAgAEB4yBAgAEB4yBAgAEB4yBAgAEB4yBAgAEB4yBAgAEB4yBAgAEB46BAgAEENQhwVYwgpgsgtoAHAAeACAAYIBiAHOBZIBAzMuNJgBAKABAaoBC2d3cy13aXotaW1n&sclient=img&ei=z_bpXrnaE9HtsAfk54XQBQ&bih=1164&biw=2327&rlz=1C1GCEB_enBG845BG845"
@@ -27,13 +32,14 @@ func TestMain(m *testing.M) {
 }
 
 func cleanUp() {
-	testPersistence.Close()
+	testPersistence.CleanUp()
 	urlShortenerService.ClosePersistenceManager()
 }
 
 func setUp() {
 	testPersistence = testing_utils.NewTestPersistence()
-	urlShortenerService = urlshortener_service.NewUrlShortenerService(testPersistence.GetTestConfiguration())
+	urlShortenerService = urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(
+		testPersistence.GetTestConfiguration(), testPersistence.NewPersistenceManager())
 }
 
 func sendRequestAndGetResponse(t *testing.T, jsonStr []byte) urlshortener_service.Response {
@@ -122,8 +128,12 @@ func TestHandleRedirectToRealUrlWithAValidShortSlug(t *testing.T) {
 	handler := http.HandlerFunc(urlShortenerService.HandleRedirectToRealUrl)
 	handler.ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusMovedPermanently {
-		t.Errorf("Expected a redirect status: %v, got status:%v.\n", http.StatusMovedPermanently, rr.Code)
+	if rr.Code != http.StatusFound {
+		t.Errorf("Expected a redirect status: %v, got status:%v.\n", http.StatusFound, rr.Code)
+	}
+	// The short slug can be updated or deleted, so the browsers must not remember the redirect
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Expected Cache-Control: no-store on the redirect, got: %q.\n", cacheControl)
 	}
 }
 
@@ -164,6 +174,130 @@ func TestGetRealUrlWithANonExistentShortSlug(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusNotFound {
-		t.Errorf("Expected a redirect status: %v, got status:%v.\n", http.StatusMovedPermanently, rr.Code)
+		t.Errorf("Expected a redirect status: %v, got status:%v.\n", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestCreateShortUrlsConcurrently(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	const requests = 50
+	shortUrls := make(chan string, requests)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+
+			var jsonStr = []byte(`{"real-url":"` + testRealUrl + `", "short-slug":"", "expires":""}`)
+			response := sendRequestAndGetResponse(t, jsonStr)
+			if response.ErrorMessage != "" {
+				t.Errorf("HandleGenerateShortSlug returned an error: %v.\n", response.ErrorMessage)
+			}
+			shortUrls <- response.ShortUrl
+		}()
+	}
+	waitGroup.Wait()
+	close(shortUrls)
+
+	seen := make(map[string]bool)
+	for shortUrl := range shortUrls {
+		if seen[shortUrl] {
+			t.Errorf("HandleGenerateShortSlug returned a duplicate short url: %v.\n", shortUrl)
+		}
+		seen[shortUrl] = true
+	}
+}
+
+func TestHandleRedirectToRealUrlWithAnExpiredShortSlug(t *testing.T) {
+	testPersistence.FlushTestPersistence()
+
+	var jsonStr = []byte(`{"real-url":"` + testRealUrl + `", "short-slug":"` + testShortSlug +
+		`", "expires":"` + time.Now().Add(-time.Hour).Format("02/01/2006 15:04") + `"}`)
+	sendRequestAndGetResponse(t, jsonStr)
+
+	rr := sendRedirectRequest(urlShortenerService, testShortSlug)
+
+	if rr.Code != http.StatusGone {
+		t.Errorf("Expected a gone status: %v, got status:%v.\n", http.StatusGone, rr.Code)
+	}
+}
+
+func TestHandlersWhenDatabaseIsUnavailable(t *testing.T) {
+	databasePersistence := testing_utils.NewFaultyDatabasePersistence(storage.NewMemoryDatabasePersistence())
+	faultyUrlShortenerService := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(
+		testPersistence.GetTestConfiguration(),
+		storage.NewPersistenceManagerWithBackends(testPersistence.GetTestConfiguration(),
+			databasePersistence, storage.NewMemoryCachePersistence()))
+
+	databasePersistence.SetDown(true)
+
+	var jsonStr = []byte(`{"real-url":"` + testRealUrl + `", "short-slug":"", "expires":""}`)
+	req, err := http.NewRequest("POST", "/api/create", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(faultyUrlShortenerService.HandleGenerateShortSlug).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %v when creating, got status:%v.\n", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	rr = sendRedirectRequest(faultyUrlShortenerService, testShortSlug)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status: %v when redirecting, got status:%v.\n", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func sendRedirectRequest(service *urlshortener_service.UrlShortenerService, shortSlug string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req = mux.SetURLVars(req, map[string]string{
+		"short-slug": shortSlug,
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(service.HandleRedirectToRealUrl).ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHandleGetArchivedUrlData(t *testing.T) {
+	configuration := testPersistence.GetTestConfiguration()
+	configuration.Storage.Database = storage.MemoryBackend
+	configuration.ExpiredUrlData.Archive = true
+
+	databasePersistence := storage.NewDatabasePersistence(configuration)
+	archivingService := urlshortener_service.NewUrlShortenerServiceWithPersistenceManager(configuration,
+		storage.NewPersistenceManagerWithBackends(configuration, databasePersistence, storage.NewNoCachePersistence()))
+
+	expiredUrlData := model.UrlData{ShortSlug: testShortSlug, RealUrl: testRealUrl,
+		Expires: model.CustomTime{Time: time.Now().Add(-time.Minute)}}
+	databasePersistence.SaveUrlData(context.Background(), expiredUrlData)
+	databasePersistence.DeleteExpiredUrlData(context.Background(), time.Now(), 10)
+
+	req, err := http.NewRequest("GET", "/api/admin/archive/"+testShortSlug, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{
+		"short-slug": testShortSlug,
+	})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(archivingService.HandleGetArchivedUrlData)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status: %v, got status: %v.\n", http.StatusOK, rr.Code)
+	}
+
+	var archivedUrlData []model.ArchivedUrlData
+	if err := json.NewDecoder(rr.Body).Decode(&archivedUrlData); err != nil {
+		t.Fatal(err)
+	}
+	if len(archivedUrlData) != 1 || archivedUrlData[0].RealUrl != testRealUrl {
+		t.Errorf("Expected the archived url data of short slug: %s, got: %v.\n", testShortSlug, archivedUrlData)
 	}
 }
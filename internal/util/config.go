@@ -7,6 +7,7 @@ import (
 )
 
 type Configuration struct {
+	// Mysql.Replicas are the read replicas of the primary at Host:Port, with the same user and database.
 	Mysql struct {
 		DriverName string
 		Host       string
@@ -14,19 +15,147 @@ type Configuration struct {
 		User       string
 		Password   string
 		Database   string
+		Replicas   []struct {
+			Host string
+			Port int
+		}
 	}
 
-	Redis struct {
+	Postgres struct {
 		Host     string
 		Port     int
+		User     string
 		Password string
-		DB       int
+		Database string
+		SSLMode  string
+	}
+
+	Sqlite struct {
+		Path string
+	}
+
+	// Redis is a standalone server at Host:Port by default. Mode "sentinel" connects to the master MasterName
+	// through the sentinels in Addrs and Mode "cluster" discovers the cluster from the seed nodes in Addrs.
+	// The timeouts are in milliseconds and the zero values keep the client defaults.
+	Redis struct {
+		Mode               string
+		Host               string
+		Port               int
+		Addrs              []string
+		MasterName         string
+		Password           string
+		DB                 int
+		PoolSize           int
+		DialTimeoutMillis  int
+		ReadTimeoutMillis  int
+		WriteTimeoutMillis int
+		TLS                struct {
+			Enabled            bool
+			ServerName         string
+			CAFile             string
+			InsecureSkipVerify bool
+		}
+	}
+
+	// Storage names the registered database and cache backends - "mysql"/"redis" by default,
+	// "postgres" or "sqlite" for the database, "none" for the cache and "memory" for both.
+	// The timeouts limit a single database or cache operation in milliseconds, 0 means no limit.
+	// The short slugs which are not found in the database are cached as unknown for UnknownSlugTtlMillis,
+	// 0 disables it.
+	Storage struct {
+		Database              string
+		Cache                 string
+		DatabaseTimeoutMillis int
+		CacheTimeoutMillis    int
+		UnknownSlugTtlMillis  int
+	}
+
+	// CacheCircuitBreaker stops calling the cache after FailureThreshold consecutive failures,
+	// 0 disables it, and probes it again after RetryMillis.
+	CacheCircuitBreaker struct {
+		FailureThreshold int
+		RetryMillis      int
+	}
+
+	// ReplicaHealthCheck is how often and how long the read replicas are checked, in milliseconds.
+	// A replica which lags behind the primary by more than MaxLagMillis, 10 seconds by default,
+	// or whose replication is stopped is taken out of rotation.
+	ReplicaHealthCheck struct {
+		IntervalMillis int
+		TimeoutMillis  int
+		MaxLagMillis   int
+	}
+
+	// ExpirySweeper deletes the expired url data every IntervalMillis, every 24 hours if it is not configured
+	// and never if it is negative, in batches of BatchSize so that a single statement does not lock the table for long.
+	ExpirySweeper struct {
+		IntervalMillis int
+		BatchSize      int
+	}
+
+	// ExpiredUrlData moves the expired url data to an archive instead of deleting it if Archive is set.
+	// The short slug of an expired url data cannot be taken by a new one for ReuseCooldownMinutes after it expires.
+	ExpiredUrlData struct {
+		Archive              bool
+		ReuseCooldownMinutes int
+	}
+
+	// LocalCache keeps up to Size url data entries in process memory in front of the cache, 0 disables it.
+	// An entry lives for TtlMillis, 0 means until the url data expires.
+	LocalCache struct {
+		Size      int
+		TtlMillis int
+	}
+
+	// SlugValidation holds the rules for the desired short slugs. The router paths are reserved as well.
+	// AllowedSymbols must be printable ASCII symbols other than /?#%{}:, letters, digits, - and _ by default.
+	// Blocklist is optional, a short slug containing any of its words is rejected.
+	SlugValidation struct {
+		MinLength      int
+		MaxLength      int
+		AllowedSymbols string
+		ReservedWords  []string
+		Blocklist      []string
+	}
+
+	// SlugKeyPool claims BatchSize pre-generated short slugs at once, 0 generates every short slug on create.
+	// RefillSize short slugs are generated in the background when the pool in the database has fewer than
+	// LowWaterMark, half of RefillSize by default.
+	SlugKeyPool struct {
+		BatchSize    int
+		RefillSize   int
+		LowWaterMark int
+	}
+
+	// Debug.Address is where the monitoring values are served at /debug/vars, empty disables it.
+	// They are not protected, so it should be reachable from the internal network only.
+	Debug struct {
+		Address string
+	}
+
+	// ApiKeys.AllowAnonymousCreate lets the requests without an api key create short urls, which are owned by no one.
+	ApiKeys struct {
+		AllowAnonymousCreate bool
 	}
 
+	// UrlShortenerService.SlugStrategy is "random" by default, "sequential" or "pronounceable".
+	// SlugAlphabet is used by the random and the sequential strategies, empty for letters and digits.
+	// It can have only the symbols which are unreserved in an url - letters, digits and -._~.
+	// SlugSecret derives the permutation which hides the order of the sequential short slugs.
+	// The short slugs get longer, up to MaxSlugLength, once more than CollisionRateThreshold of the attempts
+	// in a window of CollisionWindow attempts collide, and on startup once the stored short slugs fill more than
+	// CollisionRateThreshold of the keyspace. A create fails after MaxSlugRetries collisions.
 	UrlShortenerService struct {
-		SlugLength        int
-		DomainName        string
-		DefaultExpireDays int
+		SlugLength             int
+		MaxSlugLength          int
+		SlugStrategy           string
+		SlugAlphabet           string
+		SlugSecret             string
+		CollisionRateThreshold float64
+		CollisionWindow        int
+		MaxSlugRetries         int
+		DomainName             string
+		DefaultExpireDays      int
 	}
 }
 